@@ -0,0 +1,314 @@
+package breaker
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"regexp"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+	"github.com/gw31415/pgautorole/internal/command"
+	"github.com/gw31415/pgautorole/internal/store"
+)
+
+// 停止中にロールの変更を拒否した際のエラー
+var ErrPaused = errors.New("role mutations are paused by the circuit breaker")
+
+// 割合による判定を行う一括処理の最小の変更数(少数の変更では停止しない)
+const MIN_BULK_CHANGES = 10
+
+// ロールの変更の暴走を防ぐサーキットブレーカー
+type CircuitBreaker interface {
+	// ロールの変更を監視・遮断するトランスポートを生成
+	Transport(next http.RoundTripper) http.RoundTripper
+	// 一括処理の変更数が対象のメンバー数に対して多すぎないか確認する
+	// 多すぎる場合は停止してfalseを返す
+	AllowBulk(operation string, changes, total int) bool
+	// 停止中かどうか
+	Paused() bool
+	// スラッシュコマンドを登録
+	RegisterCommands(r *command.Router)
+}
+
+// 停止状態
+type State struct {
+	Paused bool `json:"paused"`
+	// 停止した理由
+	Reason string `json:"reason,omitempty"`
+	// 停止した日時
+	At time.Time `json:"at,omitempty"`
+}
+
+// サーキットブレーカーの設定
+type Options struct {
+	// Window内に許可するロールの変更数(0の場合は数による停止を行わない)
+	MaxChanges int
+	// ロールの変更数を数える期間
+	Window time.Duration
+	// 一括処理で変更してよい対象のメンバーの割合(%, 0の場合は割合による停止を行わない)
+	MaxBulkPercent int
+	// 停止時に通知するチャンネルID(空の場合は通知しない)
+	AlertChannelID string
+	// 停止状態の保存先
+	State *store.Store[State]
+}
+
+type circuitBreaker struct {
+	// 通知に用いるセッション
+	session *discordgo.Session
+	opts    Options
+	// recentを操作するためのロック
+	mu sync.Mutex
+	// Window内に行ったロールの変更の日時
+	recent []time.Time
+}
+
+// サーキットブレーカーを生成
+func NewCircuitBreaker(s *discordgo.Session, opts Options) CircuitBreaker {
+	if opts.State == nil {
+		opts.State = store.Memory(State{})
+	}
+	return &circuitBreaker{session: s, opts: opts}
+}
+
+// ロールやチャンネルを変更するAPIのメソッドとパス
+var mutationPaths = []struct {
+	methods []string
+	path    *regexp.Regexp
+}{
+	// メンバーへのロールの付与・剥奪
+	{[]string{http.MethodPut, http.MethodDelete}, regexp.MustCompile(`/guilds/\d+/members/\d+/roles/\d+$`)},
+	// メンバーのロールの一括変更
+	{[]string{http.MethodPatch}, regexp.MustCompile(`/guilds/\d+/members/\d+$`)},
+	// サーバーのロールの作成・並び替え・編集・削除
+	{[]string{http.MethodPost, http.MethodPatch}, regexp.MustCompile(`/guilds/\d+/roles$`)},
+	{[]string{http.MethodPatch, http.MethodDelete}, regexp.MustCompile(`/guilds/\d+/roles/\d+$`)},
+	// チャンネルの作成・編集・削除と権限の変更
+	{[]string{http.MethodPost}, regexp.MustCompile(`/guilds/\d+/channels$`)},
+	{[]string{http.MethodPatch, http.MethodDelete}, regexp.MustCompile(`/channels/\d+$`)},
+	{[]string{http.MethodPut, http.MethodDelete}, regexp.MustCompile(`/channels/\d+/permissions/\d+$`)},
+}
+
+// ロールやチャンネルを変更するリクエストかどうか
+// メッセージの送信など、それ以外のリクエストは停止中も通す
+func isRoleMutation(req *http.Request) bool {
+	for _, p := range mutationPaths {
+		if slices.Contains(p.methods, req.Method) && p.path.MatchString(req.URL.Path) {
+			return true
+		}
+	}
+	return false
+}
+
+// 運営者がコマンドで実行した変更であることを示すコンテキストのキー
+type operatorKey struct{}
+
+// 運営者がコマンドで実行した変更であることを示すコンテキストを返す
+// 運営者が内容を確認して実行した一括の変更が途中で停止しないよう、変更数に数えず、変更数の上限による停止も行わない
+// 停止中は他の変更と同じく拒否する
+func WithOperator(ctx context.Context) context.Context {
+	return context.WithValue(ctx, operatorKey{}, true)
+}
+
+// 運営者がコマンドで実行した変更として送信するリクエストのオプション
+var OperatorRequest = discordgo.WithContext(WithOperator(context.Background()))
+
+// 運営者がコマンドで実行した変更のリクエストかどうか
+func isOperator(req *http.Request) bool {
+	operator, _ := req.Context().Value(operatorKey{}).(bool)
+	return operator
+}
+
+type transport struct {
+	breaker *circuitBreaker
+	next    http.RoundTripper
+}
+
+func (t *transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if !isRoleMutation(req) {
+		return t.next.RoundTrip(req)
+	}
+	if isOperator(req) {
+		if t.breaker.Paused() {
+			return nil, ErrPaused
+		}
+		return t.next.RoundTrip(req)
+	}
+	if !t.breaker.allow(time.Now()) {
+		return nil, ErrPaused
+	}
+	res, err := t.next.RoundTrip(req)
+	// レート制限で再送されるリクエストを重複して数えないよう、応答を受け取ってから数える
+	if err == nil && res.StatusCode != http.StatusTooManyRequests {
+		t.breaker.record(time.Now())
+	}
+	return res, err
+}
+
+func (b *circuitBreaker) Transport(next http.RoundTripper) http.RoundTripper {
+	if next == nil {
+		next = http.DefaultTransport
+	}
+	return &transport{b, next}
+}
+
+// ロールの変更を許可するかどうかを返す
+// Window内の変更数が既に上限に達している場合は停止する
+func (b *circuitBreaker) allow(now time.Time) bool {
+	if b.Paused() {
+		return false
+	}
+	if b.opts.MaxChanges <= 0 {
+		return true
+	}
+
+	b.mu.Lock()
+	b.prune(now)
+	count := len(b.recent)
+	b.mu.Unlock()
+
+	if count >= b.opts.MaxChanges {
+		b.pause(fmt.Sprintf("%sの間にロールの変更が%d件を超えました", b.opts.Window, b.opts.MaxChanges))
+		return false
+	}
+	return true
+}
+
+// 行ったロールの変更を記録する
+func (b *circuitBreaker) record(now time.Time) {
+	if b.opts.MaxChanges <= 0 {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.prune(now)
+	b.recent = append(b.recent, now)
+}
+
+// Windowより前の変更の記録を破棄する
+// muのロックを取得した状態で呼び出す
+func (b *circuitBreaker) prune(now time.Time) {
+	cut := 0
+	for cut < len(b.recent) && now.Sub(b.recent[cut]) >= b.opts.Window {
+		cut++
+	}
+	b.recent = b.recent[cut:]
+}
+
+func (b *circuitBreaker) AllowBulk(operation string, changes, total int) bool {
+	if b.Paused() {
+		return false
+	}
+	if b.opts.MaxBulkPercent <= 0 || changes < MIN_BULK_CHANGES || changes*100 <= total*b.opts.MaxBulkPercent {
+		return true
+	}
+	b.pause(fmt.Sprintf("%sが対象の%d人のうち%d人のロールを変更しようとしました(上限: %d%%)", operation, total, changes, b.opts.MaxBulkPercent))
+	return false
+}
+
+func (b *circuitBreaker) Paused() bool {
+	paused := false
+	b.opts.State.View(func(st *State) {
+		paused = st.Paused
+	})
+	return paused
+}
+
+// ロールの変更を停止し、運営用チャンネルに通知する
+func (b *circuitBreaker) pause(reason string) {
+	tripped := false
+	err := b.opts.State.Update(func(st *State) error {
+		if st.Paused {
+			return nil
+		}
+		*st = State{Paused: true, Reason: reason, At: time.Now()}
+		tripped = true
+		return nil
+	})
+	if err != nil {
+		slog.Error("Failed to save circuit breaker state", "err", err)
+	}
+	if !tripped {
+		return
+	}
+	slog.Error("Role mutations paused", "REASON", reason)
+	if b.opts.AlertChannelID != "" && b.session != nil {
+		// ロールの変更の途中で呼ばれるため、通知は別のgoroutineで行う
+		go func() {
+			msg := fmt.Sprintf("⚠️ ロールの変更を停止しました: %s\n確認後、`/bot resume` で再開してください。", reason)
+			if _, err := b.session.ChannelMessageSend(b.opts.AlertChannelID, msg); err != nil {
+				slog.Error("Failed to send circuit breaker alert", "err", err)
+			}
+		}()
+	}
+}
+
+// ロールの変更を再開する
+func (b *circuitBreaker) resume() error {
+	err := b.opts.State.Update(func(st *State) error {
+		*st = State{}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	b.mu.Lock()
+	b.recent = nil
+	b.mu.Unlock()
+	return nil
+}
+
+// bot自体の管理コマンド
+var botCommand = &discordgo.ApplicationCommand{
+	Name:                     "bot",
+	Description:              "botの管理",
+	DefaultMemberPermissions: command.Permission(discordgo.PermissionManageRoles),
+}
+
+func (b *circuitBreaker) RegisterCommands(r *command.Router) {
+	r.Subcommand(botCommand, &discordgo.ApplicationCommandOption{
+		Name:        "status",
+		Description: "ロールの変更が停止しているかを表示",
+	}, func(s *discordgo.Session, i *discordgo.InteractionCreate, opts command.Options) {
+		var st State
+		b.opts.State.View(func(v *State) {
+			st = *v
+		})
+		if !st.Paused {
+			command.Respond(s, i, "ロールの変更は稼働中です。")
+			return
+		}
+		command.Respond(s, i, fmt.Sprintf("%s からロールの変更を停止しています: %s", st.At.Local().Format(time.DateTime), st.Reason))
+	})
+	r.Subcommand(botCommand, &discordgo.ApplicationCommandOption{
+		Name:        "pause",
+		Description: "ロールの変更を全て停止",
+	}, func(s *discordgo.Session, i *discordgo.InteractionCreate, opts command.Options) {
+		if b.Paused() {
+			command.Respond(s, i, "既に停止しています。")
+			return
+		}
+		b.pause(fmt.Sprintf("<@%s> が手動で停止しました", i.Member.User.ID))
+		command.Respond(s, i, "ロールの変更を停止しました。`/bot resume` で再開します。")
+	})
+	r.Subcommand(botCommand, &discordgo.ApplicationCommandOption{
+		Name:        "resume",
+		Description: "停止したロールの変更を再開",
+	}, func(s *discordgo.Session, i *discordgo.InteractionCreate, opts command.Options) {
+		if !b.Paused() {
+			command.Respond(s, i, "停止していません。")
+			return
+		}
+		if err := b.resume(); err != nil {
+			command.Respond(s, i, "再開に失敗しました: "+err.Error())
+			return
+		}
+		slog.Info("Role mutations resumed", "USER", i.Member.User.ID)
+		command.Respond(s, i, "ロールの変更を再開しました。")
+	})
+}
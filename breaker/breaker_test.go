@@ -0,0 +1,138 @@
+package breaker_test
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gw31415/pgautorole/breaker"
+)
+
+// 常に成功するトランスポート
+type okTransport struct{ count int }
+
+func (t *okTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	t.count++
+	return &http.Response{StatusCode: http.StatusNoContent, Body: http.NoBody, Request: req}, nil
+}
+
+// 指定した回数だけレート制限の応答を返すトランスポート
+type rateLimitedTransport struct{ limited int }
+
+func (t *rateLimitedTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	status := http.StatusNoContent
+	if t.limited > 0 {
+		t.limited--
+		status = http.StatusTooManyRequests
+	}
+	return &http.Response{StatusCode: status, Body: http.NoBody, Request: req}, nil
+}
+
+const roleURL = "https://discord.com/api/v9/guilds/1/members/2/roles/3"
+
+func TestTransport(t *testing.T) {
+	b := breaker.NewCircuitBreaker(nil, breaker.Options{MaxChanges: 2, Window: time.Minute})
+	next := &okTransport{}
+	tr := b.Transport(next)
+
+	for range 2 {
+		if _, err := tr.RoundTrip(httptest.NewRequest(http.MethodPut, roleURL, nil)); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+	// ロールの変更以外は数えない
+	if _, err := tr.RoundTrip(httptest.NewRequest(http.MethodGet, roleURL, nil)); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if b.Paused() {
+		t.Fatal("unexpected pause")
+	}
+	if _, err := tr.RoundTrip(httptest.NewRequest(http.MethodDelete, roleURL, nil)); !errors.Is(err, breaker.ErrPaused) {
+		t.Fatalf("expected ErrPaused: %v", err)
+	}
+	if !b.Paused() {
+		t.Fatal("expected pause")
+	}
+	// 停止中はロールの変更以外のリクエストは通す
+	if _, err := tr.RoundTrip(httptest.NewRequest(http.MethodPost, "https://discord.com/api/v9/channels/1/messages", nil)); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if next.count != 4 {
+		t.Fatalf("unexpected request count: %v", next.count)
+	}
+}
+
+func TestAllowBulk(t *testing.T) {
+	b := breaker.NewCircuitBreaker(nil, breaker.Options{MaxBulkPercent: 20})
+	if !b.AllowBulk("refresh", 5, 10) {
+		t.Fatal("small changes should be allowed")
+	}
+	if !b.AllowBulk("refresh", 20, 100) {
+		t.Fatal("changes within the limit should be allowed")
+	}
+	if b.AllowBulk("refresh", 21, 100) {
+		t.Fatal("changes over the limit should not be allowed")
+	}
+	if !b.Paused() || b.AllowBulk("refresh", 0, 100) {
+		t.Fatal("expected pause")
+	}
+}
+
+func TestTransportMutations(t *testing.T) {
+	b := breaker.NewCircuitBreaker(nil, breaker.Options{MaxChanges: 1, Window: time.Minute})
+	tr := b.Transport(&okTransport{})
+	// メンバーのロールの一括変更も数える
+	if _, err := tr.RoundTrip(httptest.NewRequest(http.MethodPatch, "https://discord.com/api/v9/guilds/1/members/2", nil)); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	// サーバーのロールの作成も停止する
+	if _, err := tr.RoundTrip(httptest.NewRequest(http.MethodPost, "https://discord.com/api/v9/guilds/1/roles", nil)); !errors.Is(err, breaker.ErrPaused) {
+		t.Fatalf("expected ErrPaused: %v", err)
+	}
+}
+
+func TestTransportRateLimited(t *testing.T) {
+	b := breaker.NewCircuitBreaker(nil, breaker.Options{MaxChanges: 2, Window: time.Minute})
+	tr := b.Transport(&rateLimitedTransport{limited: 3})
+	// レート制限で再送したリクエストは1件として数える
+	for range 4 {
+		if _, err := tr.RoundTrip(httptest.NewRequest(http.MethodPut, roleURL, nil)); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+	if _, err := tr.RoundTrip(httptest.NewRequest(http.MethodPut, roleURL, nil)); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if b.Paused() {
+		t.Fatal("unexpected pause")
+	}
+}
+
+func TestTransportOperator(t *testing.T) {
+	b := breaker.NewCircuitBreaker(nil, breaker.Options{MaxChanges: 1, Window: time.Minute})
+	tr := b.Transport(&okTransport{})
+	// 運営者のコマンドによる変更は数えず、上限を超えても停止しない
+	for range 3 {
+		req := httptest.NewRequest(http.MethodPut, roleURL, nil).WithContext(breaker.WithOperator(context.Background()))
+		if _, err := tr.RoundTrip(req); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+	if _, err := tr.RoundTrip(httptest.NewRequest(http.MethodPut, roleURL, nil)); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if b.Paused() {
+		t.Fatal("unexpected pause")
+	}
+	// 停止中は運営者のコマンドによる変更も拒否する
+	if _, err := tr.RoundTrip(httptest.NewRequest(http.MethodPut, roleURL, nil)); !errors.Is(err, breaker.ErrPaused) {
+		t.Fatalf("expected ErrPaused: %v", err)
+	}
+	req := httptest.NewRequest(http.MethodPut, roleURL, nil).WithContext(breaker.WithOperator(context.Background()))
+	if _, err := tr.RoundTrip(req); !errors.Is(err, breaker.ErrPaused) {
+		t.Fatalf("expected ErrPaused: %v", err)
+	}
+}
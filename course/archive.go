@@ -0,0 +1,173 @@
+package course
+
+import (
+	"fmt"
+	"log/slog"
+	"slices"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+	"github.com/gw31415/pgautorole/breaker"
+	"github.com/gw31415/pgautorole/course/internal"
+	"github.com/gw31415/pgautorole/internal/command"
+	"github.com/gw31415/pgautorole/internal/utils"
+)
+
+// 修了者のロール名の接尾辞
+const ALUMNI_SUFFIX = "-修了"
+
+// アーカイブしたコースの記録
+type ArchiveRecord struct {
+	// アーカイブ時のコース名
+	Name string `json:"name"`
+	// アーカイブした日時
+	At time.Time `json:"at"`
+	// 修了者のロールID(作成しなかった場合は空)
+	AlumniRoleID string `json:"alumni_role_id,omitempty"`
+	// アーカイブ時の受講者のユーザーIDからレベルへのマップ
+	Members map[string]internal.Level `json:"members"`
+}
+
+// アーカイブしたコースのロールID
+// アーカイブしたコースのロールは名前によるコースの検出から除く
+func (m *courseManager) archivedRoleIDs() []string {
+	ids := []string{}
+	m.definitions.View(func(defs *CourseDefinitions) {
+		for id, def := range *defs {
+			if def.Archive != nil {
+				ids = append(ids, id)
+				ids = append(ids, def.LevelRoleIDs...)
+			}
+		}
+	})
+	return ids
+}
+
+// アーカイブしたコースの名前(アーカイブしていなければ空文字列)
+func (m *courseManager) archivedName(courseID string) string {
+	if def := m.definition(courseID); def != nil && def.Archive != nil {
+		return def.Archive.Name
+	}
+	return ""
+}
+
+// 修了者のロールを取得し、なければ作成する
+func (m *courseManager) ensureAlumniRole(s *discordgo.Session, name string) (string, error) {
+	roles, err := s.GuildRoles(m.guildID)
+	if err != nil {
+		return "", err
+	}
+	alumni := name + ALUMNI_SUFFIX
+	if idx := slices.IndexFunc(roles, func(r *discordgo.Role) bool {
+		return r.Name == alumni
+	}); idx >= 0 {
+		return roles[idx].ID, nil
+	}
+	r, err := s.GuildRoleCreate(m.guildID, &discordgo.RoleParams{Name: alumni})
+	if err != nil {
+		return "", err
+	}
+	slog.Info("Role created", "ROLE", r.ID, "ROLE_NAME", r.Name)
+	return r.ID, nil
+}
+
+// コースをアーカイブする
+// 受講者を記録して修了者のロールを付与し、コース関連ロールを外す
+func (m *courseManager) archiveCourse(s *discordgo.Session, name internal.CourseName, alumni bool) (int, error) {
+	course := m.findCourse(name)
+	if course == nil {
+		return 0, fmt.Errorf("コース %q が見つかりません", name)
+	}
+	courseID := course.String()
+	levelIDs := utils.SlicesMap(course.GetCourseLevelIDs(), (*internal.CourseLevelRoleID).String)
+
+	// 受講者とレベルを記録
+	members := map[string]internal.Level{}
+	err := utils.ForEachMemberPage(s, m.guildID, func(page []*discordgo.Member) {
+		for _, member := range page {
+			if slices.Contains(member.Roles, courseID) {
+				members[member.User.ID] = internal.HighestLevel(member.Roles, levelIDs)
+			}
+		}
+	})
+	if err != nil {
+		return 0, err
+	}
+	record := &ArchiveRecord{Name: string(name), At: time.Now(), Members: members}
+	if alumni {
+		if record.AlumniRoleID, err = m.ensureAlumniRole(s, string(name)); err != nil {
+			return 0, fmt.Errorf("修了者のロールの作成に失敗しました: %w", err)
+		}
+	}
+
+	// 先にアーカイブ済みとして記録し、以降のロールの変更をコースとして扱わないようにする
+	if err := m.defineCourse(courseID, levelIDs); err != nil {
+		return 0, err
+	}
+	err = m.updateDefinition(courseID, func(def *CourseDefinition) {
+		def.Archive = record
+	})
+	if err != nil {
+		return 0, err
+	}
+	err = m.history.Update(func(h *CourseHistory) error {
+		for userID, level := range members {
+			(*h)[userID] = append((*h)[userID], internal.Event{At: record.At, CourseID: courseID, Kind: internal.Archived, Level: level})
+		}
+		return nil
+	})
+	if err != nil {
+		slog.Error("Failed to save course history", "err", err)
+	}
+	err = m.waitlists.Update(func(w *Waitlists) error {
+		delete(*w, courseID)
+		return nil
+	})
+	if err != nil {
+		slog.Error("Failed to save waitlists", "err", err)
+	}
+	m.syncRoles(s)
+	slog.Info("Course archived", "COURSE", courseID, "COURSE_NAME", name, "MEMBERS", len(members))
+
+	// コース関連ロールを外し、修了者のロールを付与する
+	// 運営者が実行したアーカイブが途中で停止しないよう、メンバーごとに1回で変更し、変更数の上限を適用しない
+	for userID := range members {
+		member, err := s.GuildMember(m.guildID, userID)
+		if err != nil {
+			slog.Error("Failed to get member", "USER", userID, "err", err)
+			continue
+		}
+		roles := slices.DeleteFunc(slices.Clone(member.Roles), func(id string) bool {
+			return id == courseID || slices.Contains(levelIDs, id)
+		})
+		if record.AlumniRoleID != "" && !slices.Contains(roles, record.AlumniRoleID) {
+			roles = append(roles, record.AlumniRoleID)
+		}
+		if _, err := s.GuildMemberEdit(m.guildID, userID, &discordgo.GuildMemberParams{Roles: &roles}, breaker.OperatorRequest); err != nil {
+			slog.Error("Failed to replace course roles with alumni role", "USER", userID, "err", err)
+		}
+	}
+	return len(members), nil
+}
+
+func (m *courseManager) registerArchiveCommands(r *command.Router) {
+	r.Subcommand(courseCommand, &discordgo.ApplicationCommandOption{
+		Name:        "archive",
+		Description: "コースをアーカイブし、受講者を修了者として記録",
+		Options: []*discordgo.ApplicationCommandOption{courseNameOption, {
+			Type:        discordgo.ApplicationCommandOptionBoolean,
+			Name:        "alumni_role",
+			Description: "修了者のロール(${コース名}-修了)を付与する(省略時は付与する)",
+		}},
+	}, func(s *discordgo.Session, i *discordgo.InteractionCreate, opts command.Options) {
+		name := internal.CourseName(opts.String("name"))
+		alumni := opts.Get("alumni_role") == nil || opts.Bool("alumni_role")
+		command.Deferred(s, i, func() string {
+			count, err := m.archiveCourse(s, name, alumni)
+			if err != nil {
+				return "コースのアーカイブに失敗しました: " + err.Error()
+			}
+			return fmt.Sprintf("コース %q をアーカイブし、%d人を修了者として記録しました。", name, count)
+		})
+	})
+}
@@ -0,0 +1,343 @@
+package course
+
+import (
+	"fmt"
+	"log/slog"
+	"slices"
+	"strings"
+
+	"github.com/bwmarrin/discordgo"
+	"github.com/gw31415/pgautorole/course/internal"
+	"github.com/gw31415/pgautorole/internal/command"
+	"github.com/gw31415/pgautorole/internal/utils"
+)
+
+// コースロールIDから待機リスト(登録順のユーザーID)へのマップ
+type Waitlists map[string][]string
+
+// 受講者の一覧を取得する(取得済みの場合は何もしない)
+// guildsyncのロックを取得していない状態で呼び出す
+func (m *courseManager) loadEnrollment(s *discordgo.Session) {
+	m.enrollmentLoad.Lock()
+	defer m.enrollmentLoad.Unlock()
+
+	m.waitSync.Lock()
+	loaded := m.enrolled != nil
+	m.waitSync.Unlock()
+	if loaded {
+		return
+	}
+
+	m.guildsync.RLock()
+	courseIDs := []string{}
+	if m.RoleIDRepository != nil {
+		for id := range m.roles {
+			if _, ok := m.FindID(id).(*internal.CourseRoleID); ok {
+				courseIDs = append(courseIDs, id)
+			}
+		}
+	}
+	m.guildsync.RUnlock()
+	if len(courseIDs) == 0 {
+		// ロール情報の同期前は取得しない
+		return
+	}
+
+	members, err := utils.GuildMembers(s, m.guildID)
+	if err != nil {
+		slog.Error("Failed to get members", "err", err)
+		return
+	}
+	enrolled := make(map[string][]string)
+	for _, member := range members {
+		for _, id := range courseIDs {
+			if slices.Contains(member.Roles, id) {
+				enrolled[id] = append(enrolled[id], member.User.ID)
+			}
+		}
+	}
+
+	m.waitSync.Lock()
+	defer m.waitSync.Unlock()
+	m.enrolled = enrolled
+}
+
+// 受講者の一覧を破棄し、次に必要になった時に取得し直す
+func (m *courseManager) resetEnrollment() {
+	m.waitSync.Lock()
+	defer m.waitSync.Unlock()
+	m.enrolled = nil
+}
+
+// コースロールの付与・剥奪を受講者の一覧に反映する
+func (m *courseManager) trackEnrollment(userID string, added, removed []internal.CourseRelatedRoleID) {
+	m.waitSync.Lock()
+	defer m.waitSync.Unlock()
+	if m.enrolled == nil {
+		return
+	}
+	for _, id := range added {
+		if c, ok := id.(*internal.CourseRoleID); ok && !slices.Contains(m.enrolled[c.String()], userID) {
+			m.enrolled[c.String()] = append(m.enrolled[c.String()], userID)
+		}
+	}
+	for _, id := range removed {
+		if c, ok := id.(*internal.CourseRoleID); ok {
+			m.removeEnrolled(c.String(), userID)
+		}
+	}
+}
+
+// 受講者の一覧からメンバーを除く
+// waitSyncのロックを取得した状態で呼び出す
+func (m *courseManager) removeEnrolled(courseID, userID string) {
+	if m.enrolled == nil {
+		return
+	}
+	m.enrolled[courseID] = slices.DeleteFunc(m.enrolled[courseID], func(u string) bool {
+		return u == userID
+	})
+}
+
+// 付与を取り消したコースの受講者の一覧からメンバーを除く
+func (m *courseManager) unenroll(courseID, userID string) {
+	m.waitSync.Lock()
+	defer m.waitSync.Unlock()
+	m.removeEnrolled(courseID, userID)
+}
+
+// 全てのコースの受講者の一覧からメンバーを除く
+func (m *courseManager) unenrollAll(userID string) {
+	m.waitSync.Lock()
+	defer m.waitSync.Unlock()
+	for id := range m.enrolled {
+		m.removeEnrolled(id, userID)
+	}
+}
+
+// コースが満員かどうか(上限が設定されていなければ常にfalse)
+// 同時にロールが付与された場合に上限を超えないよう、コースに加わった順が上限以内のメンバーのみ受講できる
+func (m *courseManager) isFull(courseID, userID string) bool {
+	def := m.definition(courseID)
+	if def == nil || def.Capacity <= 0 {
+		return false
+	}
+	m.waitSync.Lock()
+	defer m.waitSync.Unlock()
+	list := m.enrolled[courseID]
+	idx := slices.Index(list, userID)
+	if idx < 0 {
+		idx = len(list)
+	}
+	return idx >= def.Capacity
+}
+
+// 待機リストにメンバーを追加し、待機順(1始まり)を返す
+func (m *courseManager) enqueue(courseID, userID string) (int, error) {
+	position := 0
+	err := m.waitlists.Update(func(w *Waitlists) error {
+		list := (*w)[courseID]
+		if idx := slices.Index(list, userID); idx >= 0 {
+			position = idx + 1
+			return nil
+		}
+		(*w)[courseID] = append(list, userID)
+		position = len((*w)[courseID])
+		return nil
+	})
+	return position, err
+}
+
+// 全ての待機リストからメンバーを除く
+func (m *courseManager) dequeueAll(userID string) {
+	err := m.waitlists.Update(func(w *Waitlists) error {
+		for id, list := range *w {
+			(*w)[id] = slices.DeleteFunc(list, func(u string) bool {
+				return u == userID
+			})
+		}
+		return nil
+	})
+	if err != nil {
+		slog.Error("Failed to save waitlists", "err", err)
+	}
+}
+
+// 満員のコースに追加されたコースロールを取り消し、待機リストに登録する
+func (m *courseManager) waitlist(s *discordgo.Session, member *discordgo.Member, courseID string) {
+	m.markBotChange(member.User.ID, courseID, revertChange)
+	if err := s.GuildMemberRoleRemove(m.guildID, member.User.ID, courseID); err != nil {
+		slog.Error("Failed to revert course role", "USER", member.User.ID, "COURSE", courseID, "err", err)
+		m.takeBotChange(member.User.ID, courseID)
+		return
+	}
+	m.unenroll(courseID, member.User.ID)
+	position, err := m.enqueue(courseID, member.User.ID)
+	if err != nil {
+		slog.Error("Failed to save waitlists", "err", err)
+		return
+	}
+	name := m.roles[courseID].Name
+	slog.Info("Member waitlisted", "USER", member.User.ID, "USER_NAME", member.User.GlobalName, "COURSE", courseID, "POSITION", position)
+	msg := fmt.Sprintf("コース「%s」は満員のため、待機リストに登録しました(%d番目)。空きができ次第、自動でコースに登録します。", name, position)
+	if err := utils.SendDirectMessage(s, member.User.ID, msg); err != nil {
+		slog.Warn("Failed to notify waitlisted member", "USER", member.User.ID, "err", err)
+	}
+}
+
+// 空きがあれば待機リストの先頭のメンバーを取り出し、受講者の一覧に加えて枠を確保する
+func (m *courseManager) nextWaitlisted(courseID string, capacity int) (string, bool) {
+	m.waitSync.Lock()
+	defer m.waitSync.Unlock()
+	if m.enrolled == nil || (capacity > 0 && len(m.enrolled[courseID]) >= capacity) {
+		return "", false
+	}
+	userID := ""
+	err := m.waitlists.Update(func(w *Waitlists) error {
+		if list := (*w)[courseID]; len(list) > 0 {
+			userID = list[0]
+			(*w)[courseID] = list[1:]
+		}
+		return nil
+	})
+	if err != nil {
+		slog.Error("Failed to save waitlists", "err", err)
+		return "", false
+	}
+	if userID == "" {
+		return "", false
+	}
+	if !slices.Contains(m.enrolled[courseID], userID) {
+		m.enrolled[courseID] = append(m.enrolled[courseID], userID)
+	}
+	return userID, true
+}
+
+// 登録に失敗したメンバーを受講者の一覧から除き、待機リストの先頭に戻す
+func (m *courseManager) requeue(courseID, userID string) {
+	m.waitSync.Lock()
+	defer m.waitSync.Unlock()
+	m.removeEnrolled(courseID, userID)
+	err := m.waitlists.Update(func(w *Waitlists) error {
+		if !slices.Contains((*w)[courseID], userID) {
+			(*w)[courseID] = append([]string{userID}, (*w)[courseID]...)
+		}
+		return nil
+	})
+	if err != nil {
+		slog.Error("Failed to save waitlists", "err", err)
+	}
+}
+
+// 空きがあるだけ待機リストの先頭のメンバーをコースに登録する
+// guildsyncのロックを取得していない状態で呼び出す
+func (m *courseManager) promoteWaitlist(s *discordgo.Session, courseID string) {
+	def := m.definition(courseID)
+	if def == nil {
+		return
+	}
+	m.loadEnrollment(s)
+	m.guildsync.RLock()
+	name := ""
+	if r := m.roles[courseID]; r != nil {
+		name = r.Name
+	}
+	m.guildsync.RUnlock()
+
+	for {
+		userID, ok := m.nextWaitlisted(courseID, def.Capacity)
+		if !ok {
+			return
+		}
+		if _, err := s.GuildMember(m.guildID, userID); err != nil {
+			// 既にサーバーにいないメンバーは待機リストから除く
+			m.unenroll(courseID, userID)
+			continue
+		}
+		if err := s.GuildMemberRoleAdd(m.guildID, userID, courseID); err != nil {
+			slog.Error("Failed to promote waitlisted member", "USER", userID, "COURSE", courseID, "err", err)
+			m.requeue(courseID, userID)
+			return
+		}
+		slog.Info("Waitlisted member promoted", "USER", userID, "COURSE", courseID)
+		msg := fmt.Sprintf("コース「%s」に空きができたため、コースに登録しました。", name)
+		if err := utils.SendDirectMessage(s, userID, msg); err != nil {
+			slog.Warn("Failed to notify promoted member", "USER", userID, "err", err)
+		}
+	}
+}
+
+// 待機リストのある全てのコースについて、空きがあれば待機中のメンバーを登録する
+func (m *courseManager) promoteAllWaitlists(s *discordgo.Session) {
+	ids := []string{}
+	m.waitlists.View(func(w *Waitlists) {
+		for id, list := range *w {
+			if len(list) > 0 {
+				ids = append(ids, id)
+			}
+		}
+	})
+	for _, id := range ids {
+		m.promoteWaitlist(s, id)
+	}
+}
+
+func (m *courseManager) registerCapacityCommands(r *command.Router) {
+	r.Subcommand(courseCommand, &discordgo.ApplicationCommandOption{
+		Name:        "capacity",
+		Description: "コースの受講者の上限を設定(0で無制限)",
+		Options: []*discordgo.ApplicationCommandOption{courseNameOption, {
+			Type:        discordgo.ApplicationCommandOptionInteger,
+			Name:        "limit",
+			Description: "受講者の上限",
+			Required:    true,
+			MinValue:    new(float64),
+		}},
+	}, func(s *discordgo.Session, i *discordgo.InteractionCreate, opts command.Options) {
+		name := internal.CourseName(opts.String("name"))
+		limit, _ := opts.Int("limit")
+		command.Deferred(s, i, func() string {
+			course := m.findCourse(name)
+			if course == nil {
+				return fmt.Sprintf("コース %q が見つかりません。", name)
+			}
+			err := m.updateDefinition(course.String(), func(def *CourseDefinition) {
+				def.Capacity = int(limit)
+			})
+			if err != nil {
+				return "上限の設定に失敗しました: " + err.Error()
+			}
+			// 上限が増えた場合に備えて待機中のメンバーを登録する
+			m.promoteWaitlist(s, course.String())
+			if limit == 0 {
+				return fmt.Sprintf("コース %q の受講者の上限を解除しました。", name)
+			}
+			return fmt.Sprintf("コース %q の受講者の上限を %d 人に設定しました。", name, limit)
+		})
+	})
+	r.Subcommand(courseCommand, &discordgo.ApplicationCommandOption{
+		Name:        "waitlist",
+		Description: "コースの待機リストを表示",
+		Options:     []*discordgo.ApplicationCommandOption{courseNameOption},
+	}, func(s *discordgo.Session, i *discordgo.InteractionCreate, opts command.Options) {
+		name := internal.CourseName(opts.String("name"))
+		course := m.findCourse(name)
+		if course == nil {
+			command.Respond(s, i, fmt.Sprintf("コース %q が見つかりません。", name))
+			return
+		}
+		var list []string
+		m.waitlists.View(func(w *Waitlists) {
+			list = slices.Clone((*w)[course.String()])
+		})
+		if len(list) == 0 {
+			command.Respond(s, i, fmt.Sprintf("コース %q の待機リストは空です。", name))
+			return
+		}
+		lines := []string{fmt.Sprintf("コース %q の待機リスト(%d人)", name, len(list))}
+		for n, userID := range list {
+			lines = append(lines, fmt.Sprintf("%d. <@%s>", n+1, userID))
+		}
+		command.Respond(s, i, strings.Join(lines, "\n"))
+	})
+}
@@ -0,0 +1,183 @@
+package course
+
+import (
+	"log/slog"
+	"os"
+	"slices"
+	"strings"
+
+	"github.com/bwmarrin/discordgo"
+	"github.com/gw31415/pgautorole/course/internal"
+	"github.com/gw31415/pgautorole/internal/utils"
+)
+
+// コースごとのカテゴリとチャンネルの設定
+type ChannelTemplate = internal.ChannelTemplate
+
+// JSONファイルからコースごとのカテゴリとチャンネルの設定を読み込む
+// pathが空の場合はnilを返す(カテゴリを管理しない)
+func LoadChannelTemplate(path string) (*ChannelTemplate, error) {
+	if path == "" {
+		return nil, nil
+	}
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return internal.ParseChannelTemplate(b)
+}
+
+// コースロールIDから管理しているカテゴリとチャンネルへのマップ
+type CourseChannels map[string]*CourseChannel
+
+// コースごとに管理しているカテゴリとチャンネル
+type CourseChannel struct {
+	// カテゴリのチャンネルID
+	CategoryID string `json:"category_id"`
+	// チャンネル名(テンプレート上の名前)からチャンネルIDへのマップ
+	Channels map[string]string `json:"channels"`
+}
+
+// カテゴリとチャンネルの同期に必要なコースの情報
+type courseChannelTarget struct {
+	courseID string
+	name     string
+	// レベルの低い順のコースレベルロールID
+	levelIDs []string
+}
+
+// 検出済みの全てのコースのカテゴリとチャンネルを作成・更新する
+// コースの情報が前回の同期から変わっていない場合は何もしない
+func (m *courseManager) syncChannels(s *discordgo.Session) {
+	if m.channelTemplate == nil {
+		return
+	}
+	m.channelSync.Lock()
+	defer m.channelSync.Unlock()
+
+	m.guildsync.RLock()
+	targets := []courseChannelTarget{}
+	if m.RoleIDRepository != nil {
+		for id, r := range m.roles {
+			course, ok := m.FindID(id).(*internal.CourseRoleID)
+			if !ok {
+				continue
+			}
+			targets = append(targets, courseChannelTarget{
+				courseID: id,
+				name:     r.Name,
+				levelIDs: utils.SlicesMap(course.GetCourseLevelIDs(), (*internal.CourseLevelRoleID).String),
+			})
+		}
+	}
+	m.guildsync.RUnlock()
+	slices.SortFunc(targets, func(a, b courseChannelTarget) int {
+		return strings.Compare(a.courseID, b.courseID)
+	})
+	if m.channelTargets != nil && slices.EqualFunc(targets, m.channelTargets, courseChannelTarget.equal) {
+		return
+	}
+
+	channels, err := s.GuildChannels(m.guildID)
+	if err != nil {
+		slog.Error("Failed to get channels", "err", err)
+		return
+	}
+	for _, t := range targets {
+		m.syncCourseChannels(s, t, channels)
+	}
+	m.channelTargets = targets
+}
+
+func (t courseChannelTarget) equal(other courseChannelTarget) bool {
+	return t.courseID == other.courseID && t.name == other.name && slices.Equal(t.levelIDs, other.levelIDs)
+}
+
+// IDからチャンネルを検索
+func findChannel(channels []*discordgo.Channel, id string) *discordgo.Channel {
+	idx := slices.IndexFunc(channels, func(c *discordgo.Channel) bool {
+		return c.ID == id
+	})
+	if idx < 0 {
+		return nil
+	}
+	return channels[idx]
+}
+
+// チャンネルが期待する状態になるよう作成・更新し、チャンネルIDを返す
+func (m *courseManager) ensureChannel(s *discordgo.Session, existing *discordgo.Channel, data discordgo.GuildChannelCreateData) string {
+	if existing == nil {
+		c, err := s.GuildChannelCreateComplex(m.guildID, data)
+		if err != nil {
+			slog.Error("Failed to create channel", "CHANNEL_NAME", data.Name, "err", err)
+			return ""
+		}
+		slog.Info("Channel created", "CHANNEL", c.ID, "CHANNEL_NAME", c.Name)
+		return c.ID
+	}
+
+	// Discordが正規化した後の名前と比較する
+	if existing.Name == internal.NormalizeChannelName(data.Name, data.Type) && existing.ParentID == data.ParentID && internal.EqualOverwrites(existing.PermissionOverwrites, data.PermissionOverwrites) {
+		return existing.ID
+	}
+	_, err := s.ChannelEdit(existing.ID, &discordgo.ChannelEdit{
+		Name:                 data.Name,
+		ParentID:             data.ParentID,
+		PermissionOverwrites: data.PermissionOverwrites,
+	})
+	if err != nil {
+		slog.Error("Failed to update channel", "CHANNEL", existing.ID, "err", err)
+	} else {
+		slog.Info("Channel updated", "CHANNEL", existing.ID, "CHANNEL_NAME", data.Name)
+	}
+	return existing.ID
+}
+
+// コースのカテゴリとチャンネルを作成・更新する
+func (m *courseManager) syncCourseChannels(s *discordgo.Session, t courseChannelTarget, channels []*discordgo.Channel) {
+	var record CourseChannel
+	m.channels.View(func(c *CourseChannels) {
+		if r := (*c)[t.courseID]; r != nil {
+			record = CourseChannel{r.CategoryID, map[string]string{}}
+			for name, id := range r.Channels {
+				record.Channels[name] = id
+			}
+		}
+	})
+	if record.Channels == nil {
+		record.Channels = map[string]string{}
+	}
+
+	// カテゴリ
+	tmpl := m.channelTemplate
+	categoryID := m.ensureChannel(s, findChannel(channels, record.CategoryID), discordgo.GuildChannelCreateData{
+		Name:                 t.name,
+		Type:                 discordgo.ChannelTypeGuildCategory,
+		PermissionOverwrites: tmpl.Overwrites.Build(m.guildID, t.courseID, t.levelIDs),
+	})
+	if categoryID == "" {
+		return
+	}
+	record.CategoryID = categoryID
+
+	// カテゴリ内のチャンネル
+	for _, spec := range tmpl.Channels {
+		id := m.ensureChannel(s, findChannel(channels, record.Channels[spec.Name]), discordgo.GuildChannelCreateData{
+			Name:                 spec.Name,
+			Type:                 spec.ChannelType(),
+			ParentID:             categoryID,
+			PermissionOverwrites: tmpl.Overwrites.Merge(spec.Overwrites).Build(m.guildID, t.courseID, t.levelIDs),
+		})
+		if id != "" {
+			record.Channels[spec.Name] = id
+		}
+	}
+
+	err := m.channels.Update(func(c *CourseChannels) error {
+		(*c)[t.courseID] = &record
+		return nil
+	})
+	if err != nil {
+		slog.Error("Failed to save course channels", "err", err)
+	}
+}
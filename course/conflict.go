@@ -0,0 +1,76 @@
+package course
+
+import (
+	"log/slog"
+	"slices"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+	"github.com/gw31415/pgautorole/course/internal"
+)
+
+// コースレベルロールが重複した場合の解決方針
+type ConflictPolicy = internal.ConflictPolicy
+
+// 解決方針を解析(空の場合は最後に付与されたレベルを残す)
+func ParseConflictPolicy(s string) (ConflictPolicy, error) {
+	return internal.ParseConflictPolicy(s)
+}
+
+// 重複したコースレベルロールを解決方針に従って1つにする
+// addedは今回の更新で付与されたコースレベルロール(なければnil)
+// 削除したレベルと、受講履歴に記録する解決の変更を返す
+// guildsyncのロックを取得した状態で呼び出す
+func (m *courseManager) resolveConflict(s *discordgo.Session, member *discordgo.Member, course *internal.CourseRoleID, added *internal.CourseLevelRoleID) ([]internal.Level, []transition) {
+	levels := internal.Levels()
+	held := []internal.Level{}
+	heldIDs := map[internal.Level]string{}
+	addedLevel := internal.Level("")
+	for i, id := range course.GetCourseLevelIDs() {
+		if i >= len(levels) || !slices.Contains(member.Roles, id.String()) {
+			continue
+		}
+		held = append(held, levels[i])
+		heldIDs[levels[i]] = id.String()
+		if added != nil && internal.Equal(id, added) {
+			addedLevel = levels[i]
+		}
+	}
+	if len(held) <= 1 {
+		return nil, nil
+	}
+
+	var events []internal.Event
+	m.history.View(func(h *CourseHistory) {
+		events = slices.Clone((*h)[member.User.ID])
+	})
+	latest := internal.LatestLevel(events, course.String(), held)
+	name := m.roles[course.String()].Name
+	keep, ok := m.conflictPolicy.Resolve(held, addedLevel, latest)
+	if !ok {
+		slog.Warn("Duplicated course level roles", "USER", member.User.ID, "USER_NAME", member.User.GlobalName, "COURSE_NAME", name, "LEVELS", held, "POLICY", m.conflictPolicy)
+		return nil, nil
+	}
+
+	removed := []internal.Level{}
+	for _, l := range held {
+		if l == keep {
+			continue
+		}
+		m.markBotChange(member.User.ID, heldIDs[l], systemChange)
+		if err := s.GuildMemberRoleRemove(m.guildID, member.User.ID, heldIDs[l]); err != nil {
+			m.takeBotChange(member.User.ID, heldIDs[l])
+			slog.Error("Failed to remove duplicated course level role", "USER", member.User.ID, "ROLE", heldIDs[l], "err", err)
+			continue
+		}
+		removed = append(removed, l)
+	}
+	if len(removed) == 0 {
+		// 1つも外せなかった場合は解決していないため記録しない
+		return nil, nil
+	}
+	slog.Info("Course level conflict resolved", "USER", member.User.ID, "USER_NAME", member.User.GlobalName, "COURSE_NAME", name, "POLICY", m.conflictPolicy, "KEPT", keep, "REMOVED", removed)
+	// 受講履歴はguildsyncのロックを解放してからrecordTransitionsで保存する
+	resolved := transition{internal.Event{At: time.Now(), CourseID: course.String(), Kind: internal.ConflictResolved, Level: keep}, true}
+	return removed, []transition{resolved}
+}
@@ -1,12 +1,16 @@
 package course
 
 import (
+	"cmp"
 	"log/slog"
 	"slices"
 	"sync"
+	"time"
 
 	"github.com/bwmarrin/discordgo"
 	"github.com/gw31415/pgautorole/course/internal"
+	"github.com/gw31415/pgautorole/internal/command"
+	"github.com/gw31415/pgautorole/internal/store"
 	"github.com/gw31415/pgautorole/internal/utils"
 )
 
@@ -24,10 +28,26 @@ type CourseManager interface {
 	GuildRoleDeleteHandler(s *discordgo.Session, u *discordgo.GuildRoleDelete)
 	// ロール変更時にコース関連ロールを操作するハンドラ
 	MemberRoleUpdateHandler(s *discordgo.Session, m *discordgo.GuildMemberUpdate)
+	// 参加時に持っていたコース関連ロールを操作するハンドラ
+	MemberAddHandler(s *discordgo.Session, m *discordgo.GuildMemberAdd)
+	// 退出したメンバーの情報を破棄するハンドラ
+	MemberRemoveHandler(s *discordgo.Session, m *discordgo.GuildMemberRemove)
 
-	// WARN: MemberRoleUpdateHandlerのハンドラを切って使わなければならない
-	// メンバーのコース関連ロールの競合状態をチェックし、更新可能なら更新する
-	UnsafeCheckCourseRoles(s *discordgo.Session)
+	// 昇格ルールに該当するメンバーを昇格させる
+	PromoteMembers(s *discordgo.Session)
+
+	// スラッシュコマンドを登録
+	RegisterCommands(r *command.Router)
+
+	// 全メンバーのコース関連ロールを検査し、修復する
+	// 更新中のメンバーは飛ばすため、ハンドラと同時に実行できる
+	ReconcileCourseRoles(s *discordgo.Session) *RepairReport
+
+	// メンバー本人向けにコース関連ロールの状態を説明
+	ExplainToMember(member *discordgo.Member) string
+
+	// 管理しているコース関連ロールのID
+	ManagedRoleIDs(s *discordgo.Session) []string
 }
 
 type courseManager struct {
@@ -35,7 +55,9 @@ type courseManager struct {
 	usersSync sync.RWMutex
 	// ユーザー情報を更新中かどうか
 	updatingUsers map[string]bool
-	// roles, roleIDs, levelCourseMapを操作するためのロック
+	// 更新中のため処理できなかった変更があり、更新が終わるのを待っているかどうか
+	recheckingUsers map[string]bool
+	// roles, RoleIDRepository, discoveredを操作するためのロック
 	guildsync sync.RWMutex
 	// サーバーID
 	guildID string
@@ -43,144 +65,345 @@ type courseManager struct {
 	roles map[string]*discordgo.Role
 	// コース関連ロールの情報
 	internal.RoleIDRepository
+	// 自動処理の対象とするメンバーの条件
+	filter utils.MemberFilter
+	// コース作成時のロールの設定
+	template *RoleTemplate
+	// コースごとのカテゴリとチャンネルの設定(nilの場合は管理しない)
+	channelTemplate *ChannelTemplate
+	// 管理しているカテゴリとチャンネル
+	channels *store.Store[CourseChannels]
+	// ロールIDで定義したコース
+	definitions *store.Store[CourseDefinitions]
+	// 名前で検出され、定義されていないコースロールID
+	discovered map[string]bool
+	// 同時に受講できるコース数の上限(0の場合は無制限)
+	maxEnrollments int
+	// 受講できるコース数の上限を適用しないロールID
+	exemptRoleIDs []string
+	// 待機リスト
+	waitlists *store.Store[Waitlists]
+	// 受講履歴
+	history *store.Store[CourseHistory]
+	// 委任に関する操作の記録
+	auditLog *store.Store[AuditLog]
+	// 在籍期間に基づくレベルの昇格ルール
+	promotionRules []*PromotionRule
+	// コースレベルロールが重複した場合の解決方針
+	conflictPolicy ConflictPolicy
+	// 定期処理の名前、変更するメンバー数と対象のメンバー数から、変更を行ってよいかを判定する(nilの場合は常に行う)
+	allowBulk func(operation string, changes, total int) bool
+	// 待機リストからの登録とenrolledを操作するためのロック
+	// guildsyncのロックを取得した状態で取得してもよいが、このロックを取得した状態でguildsyncのロックを取得してはならない
+	waitSync sync.Mutex
+	// コースロールIDから受講者のユーザーID(コースに加わった順)へのマップ(未取得の場合はnil)
+	enrolled map[string][]string
+	// enrolledの取得を直列化するためのロック
+	enrollmentLoad sync.Mutex
+	// notices, noticeSince, noticeTimersを操作するためのロック
+	notifySync sync.Mutex
+	// コースロールIDから通知待ちの変更へのマップ
+	notices map[string][]notice
+	// コースロールIDから最初の通知待ちの変更を追加した日時へのマップ
+	noticeSince map[string]time.Time
+	// コースロールIDから通知を遅延させるタイマーへのマップ
+	noticeTimers map[string]*time.Timer
+	// botChangesを操作するためのロック
+	botSync sync.Mutex
+	// 「ユーザーID/ロールID」からbotが行ったロールの変更へのマップ
+	botChanges map[string]botChange
+	// rebuildTimerを操作するためのロック
+	rebuildSync sync.Mutex
+	// ロール情報の同期を遅延させるタイマー
+	rebuildTimer *time.Timer
+	// カテゴリとチャンネルの同期を直列化するためのロック
+	channelSync sync.Mutex
+	// 前回カテゴリとチャンネルを同期した際のコースの情報
+	channelTargets []courseChannelTarget
+}
+
+// ロールの変更からロール情報を同期するまでの待機時間
+const REBUILD_DELAY = 2 * time.Second
+
+// コースマネージャの設定
+type Options struct {
+	// 自動処理の対象とするメンバーの条件
+	Filter utils.MemberFilter
+	// コース作成時のロールの設定
+	RoleTemplate *RoleTemplate
+	// コースごとのカテゴリとチャンネルの設定(nilの場合は管理しない)
+	ChannelTemplate *ChannelTemplate
+	// 管理しているカテゴリとチャンネルの保存先
+	Channels *store.Store[CourseChannels]
+	// ロールIDで定義したコースの保存先
+	Definitions *store.Store[CourseDefinitions]
+	// 待機リストの保存先
+	Waitlists *store.Store[Waitlists]
+	// 同時に受講できるコース数の上限(0の場合は無制限)
+	MaxEnrollments int
+	// 受講できるコース数の上限を適用しないロールID
+	ExemptRoleIDs []string
+	// 受講履歴の保存先
+	History *store.Store[CourseHistory]
+	// 委任に関する操作の記録の保存先
+	AuditLog *store.Store[AuditLog]
+	// 在籍期間に基づくレベルの昇格ルール
+	PromotionRules []*PromotionRule
+	// コースレベルロールが重複した場合の解決方針(省略時は最後に付与されたレベルを残す)
+	ConflictPolicy ConflictPolicy
+	// 定期処理の名前、変更するメンバー数と対象のメンバー数から、変更を行ってよいかを判定する(nilの場合は常に行う)
+	AllowBulk func(operation string, changes, total int) bool
 }
 
 // コースマネージャを生成
-func NewCourseManager(guildID string) CourseManager {
+func NewCourseManager(guildID string, opts Options) CourseManager {
 	return &courseManager{
-		guildID:       guildID,
-		updatingUsers: make(map[string]bool),
+		guildID:         guildID,
+		updatingUsers:   make(map[string]bool),
+		recheckingUsers: make(map[string]bool),
+		botChanges:      make(map[string]botChange),
+		notices:         make(map[string][]notice),
+		noticeSince:     make(map[string]time.Time),
+		noticeTimers:    make(map[string]*time.Timer),
+		filter:          opts.Filter,
+		template:        cmp.Or(opts.RoleTemplate, &RoleTemplate{}),
+		channelTemplate: opts.ChannelTemplate,
+		channels:        cmp.Or(opts.Channels, store.Memory(CourseChannels{})),
+		definitions:     cmp.Or(opts.Definitions, store.Memory(CourseDefinitions{})),
+		waitlists:       cmp.Or(opts.Waitlists, store.Memory(Waitlists{})),
+		history:         cmp.Or(opts.History, store.Memory(CourseHistory{})),
+		auditLog:        cmp.Or(opts.AuditLog, store.Memory(AuditLog{})),
+		promotionRules:  opts.PromotionRules,
+		conflictPolicy:  cmp.Or(opts.ConflictPolicy, internal.KeepLatest),
+		allowBulk:       opts.AllowBulk,
+		maxEnrollments:  opts.MaxEnrollments,
+		exemptRoleIDs:   opts.ExemptRoleIDs,
 	}
 }
 
-// ロール名からコースIDを逆検索
-func (m *courseManager) reverseNameToRoleID(cl *internal.CourseLevelName) string {
-	for _, r := range m.roles {
-		if r.Name == cl.String() {
-			return r.ID
-		}
-	}
-	return ""
+// 変更するメンバーが多すぎないか確認する
+func (m *courseManager) bulkAllowed(operation string, changes, total int) bool {
+	return m.allowBulk == nil || m.allowBulk(operation, changes, total)
 }
 
-// コース関連ロールIDからロールの表示名を取得
-func (m *courseManager) getCourseName(id internal.CourseRelatedRoleID) *internal.CourseName {
-	name := internal.CourseName(m.roles[id.GetCourseRoleID().String()].Name)
-	return &name
+func (m *courseManager) RegisterCommands(r *command.Router) {
+	m.registerProvisionCommands(r)
+	m.registerDoctorCommands(r)
+	m.registerDefinitionCommands(r)
+	m.registerCapacityCommands(r)
+	m.registerPrerequisiteCommands(r)
+	m.registerHistoryCommands(r)
+	m.registerPromotionCommands(r)
+	m.registerArchiveCommands(r)
+	m.registerRepairCommands(r)
+	m.registerRosterCommands(r)
+	m.registerNotifyCommands(r)
+	m.registerDelegationCommands(r)
 }
 
-func (m *courseManager) UnsafeCheckCourseRoles(s *discordgo.Session) {
-	m.syncRoles(s)
-	m.guildsync.RLock()
-	defer m.guildsync.RUnlock()
-
-	slog.Info("Refreshing members' course roles...")
-	after := ""
-	for {
-		members, err := s.GuildMembers(m.guildID, after, 1000)
-		if err != nil || len(members) == 0 {
-			break
+// サーバーの全てのロールを取得する
+// ステートにサーバーの情報があればAPIを呼ばずにステートから取得する
+func (m *courseManager) guildRoles(s *discordgo.Session) ([]*discordgo.Role, error) {
+	if s.StateEnabled && s.State != nil {
+		if g, err := s.State.Guild(m.guildID); err == nil {
+			s.State.RLock()
+			defer s.State.RUnlock()
+			return slices.Clone(g.Roles), nil
 		}
-		slog.Debug("Paging members", "COUNT", len(members))
-		for _, member := range members {
-			croles := m.FilterIDs(member.Roles)
-			if len(croles) == 0 {
-				continue
-			}
-
-			for _, id := range croles {
-				switch id := id.(type) {
-				case *internal.CourseRoleID:
-					clids := id.GetCourseLevelIDs()
+	}
+	return s.GuildRoles(m.guildID)
+}
 
-					dups := FilterMemberRoles(member, clids)
-					if len(dups) > 1 {
-						cname := m.getCourseName(id)
-						slog.Warn("Duplicated course level roles", "USER", member.User.ID, "USER_NAME", member.User.GlobalName, "COURSE", *cname)
-					}
-				case *internal.CourseLevelRoleID:
-					if !slices.Contains(member.Roles, id.String()) {
-						cname := m.getCourseName(id)
-						slog.Info("Adding missing course role", "USER", member.User.ID, "USER_NAME", member.User.GlobalName, "COURSE", *cname)
-						s.GuildMemberRoleAdd(m.guildID, member.User.ID, id.String())
-					}
-				}
-			}
+// 定義済みのコースのロールを求め、定義済み・アーカイブ済みのコースのロール以外のロールを返す
+// 名前による検出と診断は返したロールのみを対象とする
+func (m *courseManager) claimRoles(allroles []*discordgo.Role, byID map[string]*discordgo.Role) (map[string][]string, []*discordgo.Role) {
+	c2lMap := m.definedCourses(byID)
+	claimed := make(map[string]bool)
+	for _, id := range m.archivedRoleIDs() {
+		claimed[id] = true
+	}
+	for c, ls := range c2lMap {
+		claimed[c] = true
+		for _, l := range ls {
+			claimed[l] = true
 		}
-		after = members[len(members)-1].User.ID
 	}
+	unclaimed := slices.DeleteFunc(slices.Clone(allroles), func(r *discordgo.Role) bool {
+		return claimed[r.ID]
+	})
+	return c2lMap, unclaimed
 }
 
 // サーバーのロール情報を同期
 func (m *courseManager) syncRoles(s *discordgo.Session) {
 	slog.Info("Syncing roles...")
-	m.guildsync.Lock()
-	defer m.guildsync.Unlock()
 
 	// ロールの取得
-	allroles, err := s.GuildRoles(m.guildID)
+	allroles, err := m.guildRoles(s)
 	if err != nil {
-		slog.Error("failed to get roles:", err)
+		slog.Error("failed to get roles", "err", err)
 		return
 	}
 
-	roles := make(map[string]*discordgo.Role)
+	byID := make(map[string]*discordgo.Role)
+	for _, r := range allroles {
+		byID[r.ID] = r
+	}
+
 	// コースレベルロールIDからコースロールIDのマップ
-	c2lMap := make(map[string][]string)
+	// 定義済みのコースはロール名によらず登録する
+	c2lMap, unclaimed := m.claimRoles(allroles, byID)
+
+	// 定義されていないロールの内から名前でコース関連ロールを検出
+	discovered := make(map[string]bool)
+	for c, ls := range internal.DetectCourses(internalRoles(unclaimed)) {
+		slog.Info("Course detected:", "COURSE_NAME", byID[c].Name)
+		c2lMap[c] = ls
+		discovered[c] = true
+	}
+	reportIssues(diagnose(unclaimed))
 
-	// サーバー内全てのロールの内からコース関連ロールを抽出
-r:
-	for _, r := range allroles {
-		c := internal.CourseName(r.Name)
-		clid := []string{}
-		// 対応するコースレベルロールのIDを取得
-		// 過不足があればスキップ
-		for _, cl := range c.CourseLevelNames() {
-			name := cl.String()
-			clr := utils.SlicesFilter(allroles, func(r *discordgo.Role) bool {
-				return r.Name == name
-			})
-			if len(clr) != 1 {
-				continue r
-			}
-			clid = append(clid, clr[0].ID)
+	roles := make(map[string]*discordgo.Role)
+	for c, ls := range c2lMap {
+		roles[c] = byID[c]
+		for _, l := range ls {
+			roles[l] = byID[l]
 		}
-		// 対応するコースレベルロールが過不足なければコースとして登録
-		slog.Info("Course detected:", "COURSE_NAME", c)
-		c2lMap[r.ID] = clid
-
-		roles[r.ID] = r
-		for _, id := range clid {
-			idx := slices.IndexFunc(allroles, func(r *discordgo.Role) bool {
-				return r.ID == id
-			})
-			roles[id] = allroles[idx]
+	}
+	repo, err := internal.NewRoleIDRepository(c2lMap)
+	if err != nil {
+		slog.Error("failed to create role id repository", "err", err)
+		return
+	}
+
+	// 構築したロール情報に差し替える
+	m.guildsync.Lock()
+	defer m.guildsync.Unlock()
+	m.RoleIDRepository = repo
+	m.roles = roles
+	m.discovered = discovered
+}
+
+// ロール情報を同期し、コースのカテゴリとチャンネルを更新する
+func (m *courseManager) refresh(s *discordgo.Session) {
+	m.syncRoles(s)
+	m.syncChannels(s)
+}
+
+func (m *courseManager) ManagedRoleIDs(s *discordgo.Session) []string {
+	m.guildsync.RLock()
+	synced := m.RoleIDRepository != nil
+	m.guildsync.RUnlock()
+	if !synced {
+		m.syncRoles(s)
+	}
+
+	m.guildsync.RLock()
+	defer m.guildsync.RUnlock()
+	ids := []string{}
+	if m.RoleIDRepository == nil {
+		return ids
+	}
+	for id := range m.roles {
+		if m.FindID(id) != nil {
+			ids = append(ids, id)
 		}
 	}
+	slices.Sort(ids)
+	return ids
+}
 
+// ロールの変更が続く間は待機し、最後の変更からREBUILD_DELAY後にロール情報を同期する
+func (m *courseManager) scheduleRefresh(s *discordgo.Session) {
+	m.rebuildSync.Lock()
+	defer m.rebuildSync.Unlock()
+	if m.rebuildTimer != nil {
+		m.rebuildTimer.Stop()
+	}
+	m.rebuildTimer = time.AfterFunc(REBUILD_DELAY, func() {
+		m.refresh(s)
+	})
+}
+
+// 変更されたロールがコース関連ロールであれば、ロール情報を直ちに更新する
+func (m *courseManager) updateRole(role *discordgo.Role) {
+	m.guildsync.Lock()
+	defer m.guildsync.Unlock()
+	if m.roles[role.ID] != nil {
+		m.roles[role.ID] = role
+	}
+}
+
+// 削除されたロールがコース関連ロールであれば、そのコースを直ちにコースの一覧から除く
+func (m *courseManager) removeRole(roleID string) {
+	m.guildsync.Lock()
+	defer m.guildsync.Unlock()
+	if m.RoleIDRepository == nil {
+		return
+	}
+	id := m.FindID(roleID)
+	if id == nil {
+		return
+	}
+	removed := id.GetCourseRoleID().String()
+	c2lMap := make(map[string][]string)
+	for cid := range m.roles {
+		c, ok := m.FindID(cid).(*internal.CourseRoleID)
+		if !ok || cid == removed {
+			continue
+		}
+		c2lMap[cid] = utils.SlicesMap(c.GetCourseLevelIDs(), (*internal.CourseLevelRoleID).String)
+	}
 	repo, err := internal.NewRoleIDRepository(c2lMap)
 	if err != nil {
-		slog.Error("failed to create role id repository:", err)
+		slog.Error("failed to create role id repository", "err", err)
 		return
 	}
+	for _, l := range id.GetCourseLevelIDs() {
+		delete(m.roles, l.String())
+	}
+	delete(m.roles, removed)
+	delete(m.discovered, removed)
 	m.RoleIDRepository = repo
-	m.roles = roles
+
+	// コースロール自体が削除されたコースの定義は破棄する
+	// コースレベルロールのみが削除された場合は定義を残し、/course doctor で報告する
+	if roleID != removed {
+		slog.Warn("Course level role deleted", "COURSE", removed, "ROLE", roleID)
+		return
+	}
+	if err := m.undefineCourse(removed); err != nil {
+		slog.Error("Failed to save course definitions", "err", err)
+	}
 }
 
 func (m *courseManager) ReadyHandler(s *discordgo.Session, u *discordgo.Ready) {
-	m.syncRoles(s)
+	// 切断中のロールの変更を取りこぼしている可能性があるため、受講者の一覧を取得し直す
+	m.resetEnrollment()
+	m.scheduleRefresh(s)
 }
 func (m *courseManager) GuildCreateHandler(s *discordgo.Session, u *discordgo.GuildCreate) {
-	m.syncRoles(s)
+	m.scheduleRefresh(s)
 }
 func (m *courseManager) GuildRoleCreateHandler(s *discordgo.Session, u *discordgo.GuildRoleCreate) {
-	m.syncRoles(s)
+	if u.GuildID != m.guildID {
+		return
+	}
+	m.scheduleRefresh(s)
 }
 func (m *courseManager) GulidRoleUpdateHandler(s *discordgo.Session, u *discordgo.GuildRoleUpdate) {
-	m.syncRoles(s)
+	if u.GuildID != m.guildID {
+		return
+	}
+	m.updateRole(u.Role)
+	m.scheduleRefresh(s)
 }
 func (m *courseManager) GuildRoleDeleteHandler(s *discordgo.Session, u *discordgo.GuildRoleDelete) {
-	m.syncRoles(s)
+	if u.GuildID != m.guildID {
+		return
+	}
+	m.removeRole(u.RoleID)
+	m.scheduleRefresh(s)
 }
 
 func FilterMemberRoles(member *discordgo.Member, list []*internal.CourseLevelRoleID) []*internal.CourseLevelRoleID {
@@ -190,17 +413,24 @@ func FilterMemberRoles(member *discordgo.Member, list []*internal.CourseLevelRol
 }
 
 func (m *courseManager) MemberRoleUpdateHandler(s *discordgo.Session, u *discordgo.GuildMemberUpdate) {
-	m.guildsync.RLock()
-	defer m.guildsync.RUnlock()
+	if m.filter.Skip(u.Member) != utils.NotSkipped {
+		// ボットやメンバー認証を通過していないメンバーのロールは操作しない
+		return
+	}
+	m.loadEnrollment(s)
 
-	// ユーザー更新中かどうか取得
-	m.usersSync.RLock()
-	updating := m.updatingUsers[u.User.ID]
-	m.usersSync.RUnlock()
+	transitions := m.handleRoleUpdate(s, u)
+	// 受講履歴の保存と通知はguildsyncのロックを解放してから行う
+	m.recordTransitions(s, u.User.ID, transitions)
+}
 
-	if updating {
-		// 他のタスクで更新中のユーザーはスキップ
-		return
+// コース関連ロールの変更に応じてロールを操作し、受講履歴に記録する変更を返す
+func (m *courseManager) handleRoleUpdate(s *discordgo.Session, u *discordgo.GuildMemberUpdate) []transition {
+	m.guildsync.RLock()
+	defer m.guildsync.RUnlock()
+	if m.RoleIDRepository == nil {
+		// ロール情報の同期前(起動直後)は何もしない
+		return nil
 	}
 
 	roles := u.Member.Roles
@@ -216,17 +446,21 @@ func (m *courseManager) MemberRoleUpdateHandler(s *discordgo.Session, u *discord
 	added := m.FilterIDs(utils.SlicesDifference(roles, rolesBefore))
 	removed := m.FilterIDs(utils.SlicesDifference(rolesBefore, roles))
 
+	// 他のタスクによる更新も含めて受講履歴と受講者の一覧に記録する
+	transitions := m.transitions(u.User.ID, added, removed)
+	m.trackEnrollment(u.User.ID, added, removed)
+
 	// ユーザー更新中に設定
-	m.usersSync.Lock()
-	m.updatingUsers[u.User.ID] = true
-	m.usersSync.Unlock()
-	defer func() {
-		m.usersSync.Lock()
-		delete(m.updatingUsers, u.User.ID)
-		m.usersSync.Unlock()
-	}()
+	if !m.lockMember(u.User.ID) {
+		// 他のタスクで更新中のユーザーは、更新が終わってから現在のロールを検査する
+		go m.recheckMember(s, u.User.ID)
+		return transitions
+	}
+	defer m.unlockMember(u.User.ID)
 
 	// 追加されたロール
+	// 同じ更新で取り消したコースロール(取り消した登録は受講履歴に記録しない)
+	reverted := []string{}
 	for _, id := range added {
 		course := id.GetCourseRoleID()
 		levels := id.GetCourseLevelIDs()
@@ -236,26 +470,49 @@ func (m *courseManager) MemberRoleUpdateHandler(s *discordgo.Session, u *discord
 		case *internal.CourseRoleID:
 			// コースロールが追加された時
 
+			if m.enforcePrerequisites(s, u.Member, course.String(), true) {
+				// 受講条件を満たさず取り消した
+				m.unenroll(course.String(), u.User.ID)
+				reverted = append(reverted, course.String())
+				continue
+			}
+			if m.enforceMaxEnrollments(s, u.Member, course.String(), len(reverted)) {
+				// 同時に受講できるコース数の上限を超えたため取り消した
+				m.unenroll(course.String(), u.User.ID)
+				reverted = append(reverted, course.String())
+				continue
+			}
+			if m.isFull(course.String(), u.User.ID) {
+				// 満員の時は追加を取り消して待機リストに登録する
+				m.waitlist(s, u.Member, course.String())
+				reverted = append(reverted, course.String())
+				continue
+			}
 			if len(dups) == 0 {
 				// コースレベルロールの初期値はアプレンティス
-				cname := m.getCourseName(course)
-				initialCourseLevel := cname.With(internal.Apprentice)
+				initialCourseLevel := levels[internal.LevelIndex(internal.Apprentice)]
 
-				s.GuildMemberRoleAdd(u.GuildID, u.User.ID, m.reverseNameToRoleID(&initialCourseLevel))
-			} else {
-				// コースレベルロールが既にある時はとりあえず1つにする
-				for _, cl := range dups[1:] {
-					s.GuildMemberRoleRemove(u.GuildID, u.User.ID, cl.String())
+				m.markBotChange(u.User.ID, initialCourseLevel.String(), systemChange)
+				if err := s.GuildMemberRoleAdd(u.GuildID, u.User.ID, initialCourseLevel.String()); err != nil {
+					m.takeBotChange(u.User.ID, initialCourseLevel.String())
 				}
+			} else {
+				// コースレベルロールが既にある時は解決方針に従って1つにする
+				_, resolved := m.resolveConflict(s, u.Member, course, nil)
+				transitions = append(transitions, resolved...)
 			}
 		case *internal.CourseLevelRoleID:
 			// コースレベルロールが追加された時
 
-			// 他のコースレベルロールを削除
-			for _, cl := range dups {
-				if !internal.Equal(cl, id) || !hasCourse {
+			if !hasCourse {
+				// コースロールがない時は全て削除する
+				for _, cl := range dups {
 					s.GuildMemberRoleRemove(u.GuildID, u.User.ID, cl.String())
 				}
+			} else {
+				// 他のコースレベルロールがある時は解決方針に従って1つにする
+				_, resolved := m.resolveConflict(s, u.Member, course, id)
+				transitions = append(transitions, resolved...)
 			}
 		}
 	}
@@ -276,22 +533,48 @@ func (m *courseManager) MemberRoleUpdateHandler(s *discordgo.Session, u *discord
 					s.GuildMemberRoleRemove(u.GuildID, u.User.ID, cl.String())
 				}
 			}
+			// 空きができたので待機中のメンバーを登録する
+			go m.promoteWaitlist(s, course.String())
 		case *internal.CourseLevelRoleID:
 			// コースレベルロールが削除された時
 
 			if len(dups) == 0 && hasCourse {
 				// コースレベルロールが0になる時は復元する
+				m.markBotChange(u.User.ID, id.String(), revertChange)
 				s.GuildMemberRoleAdd(u.GuildID, u.User.ID, id.String())
 			} else if len(dups) > 1 {
-				// コースレベルロールが複数ある時はとりあえず1つにする
-				// またはコースロールがない時は完全に削除する
-				for i, cl := range dups {
-					if i == 0 || !hasCourse {
-						continue
+				if !hasCourse {
+					// コースロールがない時は完全に削除する
+					for _, cl := range dups {
+						s.GuildMemberRoleRemove(u.GuildID, u.User.ID, cl.String())
 					}
-					s.GuildMemberRoleRemove(u.GuildID, u.User.ID, cl.String())
+				} else {
+					// コースレベルロールが複数ある時は解決方針に従って1つにする
+					_, resolved := m.resolveConflict(s, u.Member, course, nil)
+					transitions = append(transitions, resolved...)
 				}
 			}
 		}
 	}
+	return slices.DeleteFunc(transitions, func(t transition) bool {
+		return t.event.Kind == internal.Enrolled && slices.Contains(reverted, t.event.CourseID)
+	})
+}
+
+func (m *courseManager) MemberAddHandler(s *discordgo.Session, u *discordgo.GuildMemberAdd) {
+	if u.GuildID != m.guildID || len(u.Member.Roles) == 0 {
+		return
+	}
+	// 参加時に持っているロールは全て追加されたものとして扱う
+	m.MemberRoleUpdateHandler(s, &discordgo.GuildMemberUpdate{Member: u.Member})
+}
+
+func (m *courseManager) MemberRemoveHandler(s *discordgo.Session, u *discordgo.GuildMemberRemove) {
+	if u.GuildID != m.guildID {
+		return
+	}
+	// 待機リストと受講者の一覧から除き、退出により空いた枠に待機中のメンバーを登録する
+	m.dequeueAll(u.User.ID)
+	m.unenrollAll(u.User.ID)
+	go m.promoteAllWaitlists(s)
 }
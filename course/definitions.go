@@ -0,0 +1,193 @@
+package course
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"slices"
+	"strings"
+
+	"github.com/bwmarrin/discordgo"
+	"github.com/gw31415/pgautorole/course/internal"
+	"github.com/gw31415/pgautorole/internal/command"
+)
+
+// コースロールIDからコースの定義へのマップ
+type CourseDefinitions map[string]*CourseDefinition
+
+// ロールIDで固定したコースの定義
+// ロール名が変更されても同じコースとして扱う
+type CourseDefinition struct {
+	// レベルの低い順のコースレベルロールID
+	LevelRoleIDs []string `json:"level_role_ids"`
+	// 受講者(コースロールを持つメンバー)の上限(0の場合は無制限)
+	Capacity int `json:"capacity,omitempty"`
+	// 受講条件
+	Prerequisites []Prerequisite `json:"prerequisites,omitempty"`
+	// 受講条件を満たさない場合の対応
+	Enforcement Enforcement `json:"enforcement,omitempty"`
+	// 受講状況の変更を通知するチャンネルID
+	NotifyChannelID string `json:"notify_channel_id,omitempty"`
+	// 受講状況の変更をリードのロールを持つメンバーにDMで通知するかどうか
+	NotifyLeads bool `json:"notify_leads,omitempty"`
+	// リードへの管理の委任(委任していなければnil)
+	Delegation *Delegation `json:"delegation,omitempty"`
+	// アーカイブの記録(アーカイブしていなければnil)
+	Archive *ArchiveRecord `json:"archive,omitempty"`
+}
+
+// 定義済みのコースのうち、アーカイブしておらず全てのロールが存在するものを返す
+func (m *courseManager) definedCourses(byID map[string]*discordgo.Role) map[string][]string {
+	c2lMap := make(map[string][]string)
+	m.definitions.View(func(defs *CourseDefinitions) {
+		for id, def := range *defs {
+			if def.Archive != nil {
+				continue
+			}
+			missing := byID[id] == nil || len(def.LevelRoleIDs) != len(internal.Levels()) || slices.ContainsFunc(def.LevelRoleIDs, func(id string) bool {
+				return byID[id] == nil
+			})
+			if missing {
+				slog.Warn("Course definition skipped because some roles are missing", "COURSE", id)
+				continue
+			}
+			c2lMap[id] = slices.Clone(def.LevelRoleIDs)
+		}
+	})
+	return c2lMap
+}
+
+// 定義済みのコースのうち、ロールが削除されたものを説明する
+func (m *courseManager) brokenDefinitions(byID map[string]*discordgo.Role) []string {
+	lines := []string{}
+	m.definitions.View(func(defs *CourseDefinitions) {
+		for id, def := range *defs {
+			if def.Archive != nil {
+				continue
+			}
+			name := id
+			missing := []string{}
+			if r := byID[id]; r != nil {
+				name = r.Name
+			} else {
+				missing = append(missing, "コースロール")
+			}
+			for i, l := range internal.Levels() {
+				if i >= len(def.LevelRoleIDs) || byID[def.LevelRoleIDs[i]] == nil {
+					missing = append(missing, string(l))
+				}
+			}
+			if len(missing) > 0 {
+				lines = append(lines, fmt.Sprintf("登録済みのコース %q: ロールが削除されています (%s)", name, strings.Join(missing, ", ")))
+			}
+		}
+	})
+	slices.Sort(lines)
+	return lines
+}
+
+// コースをロールIDで定義し、名前によらず同じコースとして扱うようにする
+func (m *courseManager) defineCourse(courseID string, levelIDs []string) error {
+	return m.definitions.Update(func(defs *CourseDefinitions) error {
+		if def := (*defs)[courseID]; def != nil {
+			def.LevelRoleIDs = slices.Clone(levelIDs)
+			return nil
+		}
+		(*defs)[courseID] = &CourseDefinition{LevelRoleIDs: slices.Clone(levelIDs)}
+		return nil
+	})
+}
+
+// コースの定義を破棄する
+func (m *courseManager) undefineCourse(courseID string) error {
+	return m.definitions.Update(func(defs *CourseDefinitions) error {
+		delete(*defs, courseID)
+		return nil
+	})
+}
+
+// 定義済みのコースの設定を取得する(定義されていない場合はnil)
+func (m *courseManager) definition(courseID string) *CourseDefinition {
+	var def *CourseDefinition
+	m.definitions.View(func(defs *CourseDefinitions) {
+		if d := (*defs)[courseID]; d != nil {
+			copied := *d
+			copied.LevelRoleIDs = slices.Clone(d.LevelRoleIDs)
+			copied.Prerequisites = slices.Clone(d.Prerequisites)
+			def = &copied
+		}
+	})
+	return def
+}
+
+// 定義済みのコースの設定を変更する
+func (m *courseManager) updateDefinition(courseID string, f func(def *CourseDefinition)) error {
+	return m.definitions.Update(func(defs *CourseDefinitions) error {
+		def := (*defs)[courseID]
+		if def == nil {
+			return errors.New("コースが登録されていません(`/course adopt` で登録してください)")
+		}
+		f(def)
+		return nil
+	})
+}
+
+// 名前で検出されたコースを定義済みのコースとして登録し、登録したコース名を返す
+// nameが空の場合は名前で検出された全てのコースを登録する
+func (m *courseManager) adoptCourses(name internal.CourseName) ([]string, error) {
+	m.guildsync.Lock()
+	defer m.guildsync.Unlock()
+
+	if m.RoleIDRepository == nil {
+		return nil, fmt.Errorf("ロール情報が同期されていません")
+	}
+	adopted := []string{}
+	for id := range m.discovered {
+		if name != "" && m.roles[id].Name != string(name) {
+			continue
+		}
+		course, ok := m.FindID(id).(*internal.CourseRoleID)
+		if !ok {
+			continue
+		}
+		levelIDs := []string{}
+		for _, l := range course.GetCourseLevelIDs() {
+			levelIDs = append(levelIDs, l.String())
+		}
+		if err := m.defineCourse(id, levelIDs); err != nil {
+			return adopted, err
+		}
+		delete(m.discovered, id)
+		slog.Info("Course adopted", "COURSE", id, "COURSE_NAME", m.roles[id].Name)
+		adopted = append(adopted, m.roles[id].Name)
+	}
+	if name != "" && len(adopted) == 0 {
+		return nil, fmt.Errorf("名前で検出されたコース %q が見つかりません", name)
+	}
+	slices.Sort(adopted)
+	return adopted, nil
+}
+
+func (m *courseManager) registerDefinitionCommands(r *command.Router) {
+	r.Subcommand(courseCommand, &discordgo.ApplicationCommandOption{
+		Name:        "adopt",
+		Description: "名前で検出されたコースをロールIDで登録し、名前の変更に追従させる",
+		Options: []*discordgo.ApplicationCommandOption{{
+			Type:        discordgo.ApplicationCommandOptionString,
+			Name:        "name",
+			Description: "コース名(省略時は名前で検出された全てのコース)",
+		}},
+	}, func(s *discordgo.Session, i *discordgo.InteractionCreate, opts command.Options) {
+		name := internal.CourseName(opts.String("name"))
+		command.Deferred(s, i, func() string {
+			adopted, err := m.adoptCourses(name)
+			if err != nil {
+				return "コースの登録に失敗しました: " + err.Error()
+			}
+			if len(adopted) == 0 {
+				return "登録するコースはありません。"
+			}
+			return "コースを登録しました: " + strings.Join(adopted, ", ")
+		})
+	})
+}
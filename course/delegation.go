@@ -0,0 +1,333 @@
+package course
+
+import (
+	"cmp"
+	"fmt"
+	"log/slog"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+	"github.com/gw31415/pgautorole/course/internal"
+	"github.com/gw31415/pgautorole/internal/command"
+	"github.com/gw31415/pgautorole/internal/utils"
+)
+
+// コースの管理をリードに委任した記録
+type Delegation struct {
+	// 委任したユーザーID
+	By string `json:"by"`
+	// 委任した日時
+	At time.Time `json:"at"`
+}
+
+// 監査記録の操作の種類
+type AuditAction string
+
+const (
+	// コースの管理をリードに委任した
+	AuditDelegated AuditAction = "delegate"
+	// コースの管理の委任を取り消した
+	AuditRevoked AuditAction = "revoke"
+	// リードがメンバーをコースに登録した
+	AuditEnrolled AuditAction = "enroll"
+	// リードがメンバーをコースから外した
+	AuditRemoved AuditAction = "remove"
+	// リードがメンバーのレベルを変更した
+	AuditLevelChanged AuditAction = "level"
+)
+
+// 委任に関する操作の記録
+type AuditRecord struct {
+	At time.Time `json:"at"`
+	// 操作したユーザーID
+	ActorID  string      `json:"actor_id"`
+	Action   AuditAction `json:"action"`
+	CourseID string      `json:"course_id"`
+	// 操作の対象のユーザーID(委任の操作では空)
+	TargetID string         `json:"target_id,omitempty"`
+	Level    internal.Level `json:"level,omitempty"`
+	// 操作を拒否した理由(実行した操作では空)
+	Refused string `json:"refused,omitempty"`
+}
+
+// 委任に関する操作の記録(古い順)
+type AuditLog []AuditRecord
+
+// 監査記録を表示する件数
+const AUDIT_DISPLAY_LIMIT = 20
+
+// 委任に関する操作を記録する
+func (m *courseManager) audit(r AuditRecord) {
+	r.At = time.Now()
+	err := m.auditLog.Update(func(log *AuditLog) error {
+		*log = append(*log, r)
+		return nil
+	})
+	if err != nil {
+		slog.Error("Failed to save audit log", "err", err)
+	}
+	slog.Info("Delegated action recorded", "ACTOR", r.ActorID, "ACTION", r.Action, "COURSE", r.CourseID, "TARGET", r.TargetID, "LEVEL", r.Level, "REFUSED", r.Refused)
+}
+
+// メンバーがコースのリードのロールを持っているかどうか
+func (m *courseManager) isCourseLead(roles []string, course *internal.CourseRoleID) bool {
+	m.guildsync.RLock()
+	defer m.guildsync.RUnlock()
+
+	if m.RoleIDRepository == nil {
+		return false
+	}
+	lead := course.GetCourseLevelIDs()[internal.LevelIndex(internal.Lead)]
+	for _, id := range m.FilterIDs(roles) {
+		if level, ok := id.(*internal.CourseLevelRoleID); ok && internal.Equal(level, lead) {
+			return true
+		}
+	}
+	return false
+}
+
+// 委任された操作を実行できるか確認し、対象のコースを返す
+// コースが見つかった場合は、実行できない場合もコースを返す
+func (m *courseManager) delegatedCourse(invoker *discordgo.Member, name internal.CourseName) (*internal.CourseRoleID, error) {
+	course := m.findCourse(name)
+	if course == nil {
+		return nil, fmt.Errorf("コース %q が見つかりません", name)
+	}
+	if def := m.definition(course.String()); def == nil || def.Delegation == nil {
+		return course, fmt.Errorf("コース %q の管理は委任されていません", name)
+	}
+	if !m.isCourseLead(invoker.Roles, course) {
+		return course, fmt.Errorf("コース %q のリードではありません", name)
+	}
+	return course, nil
+}
+
+// リードに委任された操作で変更できるレベル(リードへの変更はできない)
+var delegatedLevelChoices = slices.DeleteFunc(slices.Clone(levelChoices), func(c *discordgo.ApplicationCommandOptionChoice) bool {
+	return c.Value == string(internal.Lead)
+})
+
+// 委任の操作の説明文
+func describeAudit(r AuditRecord, course string) string {
+	line := fmt.Sprintf("- %s <@%s> %s: ", r.At.Local().Format(time.DateTime), r.ActorID, course)
+	switch r.Action {
+	case AuditDelegated:
+		return line + "リードに委任"
+	case AuditRevoked:
+		return line + "委任を取り消し"
+	case AuditEnrolled:
+		line += fmt.Sprintf("<@%s> を登録", r.TargetID)
+	case AuditRemoved:
+		line += fmt.Sprintf("<@%s> を解除", r.TargetID)
+	case AuditLevelChanged:
+		line += fmt.Sprintf("<@%s> を%sに変更", r.TargetID, r.Level)
+	default:
+		line += string(r.Action)
+	}
+	if r.Refused != "" {
+		line += "(拒否: " + r.Refused + ")"
+	}
+	return line
+}
+
+// 監査記録の直近の操作(コースIDが空の場合は全てのコース)
+func (m *courseManager) auditHistory(courseID string) string {
+	records := []AuditRecord{}
+	m.auditLog.View(func(log *AuditLog) {
+		for _, r := range *log {
+			if courseID == "" || r.CourseID == courseID {
+				records = append(records, r)
+			}
+		}
+	})
+	if len(records) == 0 {
+		return "委任に関する操作の記録はありません。"
+	}
+	records = records[max(0, len(records)-AUDIT_DISPLAY_LIMIT):]
+
+	m.guildsync.RLock()
+	defer m.guildsync.RUnlock()
+	lines := []string{fmt.Sprintf("委任に関する操作の記録(直近%d件)", len(records))}
+	for _, r := range records {
+		name := cmp.Or(m.archivedName(r.CourseID), r.CourseID)
+		if role := m.roles[r.CourseID]; role != nil {
+			name = role.Name
+		}
+		lines = append(lines, describeAudit(r, name))
+	}
+	return strings.Join(lines, "\n")
+}
+
+// リード向けのコマンド
+// 実行者の権限は問わず、コースのリードであるかどうかを実行時に確認する
+var leadCommand = &discordgo.ApplicationCommand{
+	Name:        "lead",
+	Description: "リードによるコースの管理",
+}
+
+func (m *courseManager) registerDelegationCommands(r *command.Router) {
+	r.Subcommand(courseCommand, &discordgo.ApplicationCommandOption{
+		Name:        "delegate",
+		Description: "コースの受講者とレベルの管理をリードに委任",
+		Options: []*discordgo.ApplicationCommandOption{courseNameOption, {
+			Type:        discordgo.ApplicationCommandOptionBoolean,
+			Name:        "enabled",
+			Description: "委任するかどうか",
+			Required:    true,
+		}},
+	}, func(s *discordgo.Session, i *discordgo.InteractionCreate, opts command.Options) {
+		name := internal.CourseName(opts.String("name"))
+		enabled := opts.Bool("enabled")
+		course := m.findCourse(name)
+		if course == nil {
+			command.Respond(s, i, fmt.Sprintf("コース %q が見つかりません。", name))
+			return
+		}
+		err := m.updateDefinition(course.String(), func(def *CourseDefinition) {
+			def.Delegation = nil
+			if enabled {
+				def.Delegation = &Delegation{By: i.Member.User.ID, At: time.Now()}
+			}
+		})
+		if err != nil {
+			command.Respond(s, i, "委任の設定に失敗しました: "+err.Error())
+			return
+		}
+		if enabled {
+			m.audit(AuditRecord{ActorID: i.Member.User.ID, Action: AuditDelegated, CourseID: course.String()})
+			command.Respond(s, i, fmt.Sprintf("コース %q の管理をリードに委任しました。", name))
+			return
+		}
+		m.audit(AuditRecord{ActorID: i.Member.User.ID, Action: AuditRevoked, CourseID: course.String()})
+		command.Respond(s, i, fmt.Sprintf("コース %q の管理の委任を取り消しました。", name))
+	})
+	r.Subcommand(courseCommand, &discordgo.ApplicationCommandOption{
+		Name:        "audit",
+		Description: "委任に関する操作の記録を表示",
+		Options: []*discordgo.ApplicationCommandOption{{
+			Type:        discordgo.ApplicationCommandOptionString,
+			Name:        "name",
+			Description: "コース名(省略時は全てのコース)",
+		}},
+	}, func(s *discordgo.Session, i *discordgo.InteractionCreate, opts command.Options) {
+		name := internal.CourseName(opts.String("name"))
+		courseID := ""
+		if name != "" {
+			course := m.findCourse(name)
+			if course == nil {
+				command.Respond(s, i, fmt.Sprintf("コース %q が見つかりません。", name))
+				return
+			}
+			courseID = course.String()
+		}
+		command.Respond(s, i, m.auditHistory(courseID))
+	})
+
+	userOption := &discordgo.ApplicationCommandOption{
+		Type:        discordgo.ApplicationCommandOptionUser,
+		Name:        "user",
+		Description: "対象のメンバー",
+		Required:    true,
+	}
+	// 委任された操作を確認して実行する
+	delegated := func(action AuditAction, to func(opts command.Options) internal.Level) command.Handler {
+		return func(s *discordgo.Session, i *discordgo.InteractionCreate, opts command.Options) {
+			name := internal.CourseName(opts.String("name"))
+			target := opts.Member("user")
+			to := to(opts)
+			targetID := ""
+			if target != nil && target.User != nil {
+				targetID = target.User.ID
+			}
+			// 拒否した操作も監査記録に残す
+			refuse := func(courseID string, reason string) {
+				m.audit(AuditRecord{ActorID: i.Member.User.ID, Action: action, CourseID: courseID, TargetID: targetID, Level: to, Refused: reason})
+				command.Respond(s, i, reason+"。")
+			}
+			course, err := m.delegatedCourse(i.Member, name)
+			if err != nil {
+				if course == nil {
+					command.Respond(s, i, err.Error()+"。")
+					return
+				}
+				refuse(course.String(), err.Error())
+				return
+			}
+			if target == nil || target.User == nil {
+				command.Respond(s, i, "メンバーが見つかりません。")
+				return
+			}
+			if target.User.Bot {
+				command.Respond(s, i, "botは対象にできません。")
+				return
+			}
+			levelIDs := utils.SlicesMap(course.GetCourseLevelIDs(), (*internal.CourseLevelRoleID).String)
+			change := internal.RosterChange{
+				UserID: target.User.ID,
+				Course: name,
+				From:   internal.HighestLevel(target.Roles, levelIDs),
+				To:     to,
+			}
+			switch {
+			case target.User.ID == i.Member.User.ID:
+				refuse(course.String(), "自分自身は変更できません")
+				return
+			case change.From == internal.Lead:
+				refuse(course.String(), "リードのメンバーは変更できません")
+				return
+			case change.To == internal.Lead:
+				refuse(course.String(), "リードには変更できません")
+				return
+			}
+			enrolled := slices.Contains(target.Roles, course.String())
+			switch {
+			case action == AuditEnrolled && enrolled:
+				command.Respond(s, i, fmt.Sprintf("<@%s> は既にコース %q に登録されています。", target.User.ID, name))
+				return
+			case action != AuditEnrolled && !enrolled:
+				command.Respond(s, i, fmt.Sprintf("<@%s> はコース %q に登録されていません。", target.User.ID, name))
+				return
+			case change.From == change.To:
+				command.Respond(s, i, "変更はありません。")
+				return
+			}
+			// ロールの変更はbotの権限で行う
+			if err := m.applyRosterChange(s, change); err != nil {
+				slog.Error("Failed to apply delegated change", "ACTOR", i.Member.User.ID, "USER", target.User.ID, "COURSE", course.String(), "err", err)
+				command.Respond(s, i, "変更に失敗しました: "+err.Error())
+				return
+			}
+			m.audit(AuditRecord{ActorID: i.Member.User.ID, Action: action, CourseID: course.String(), TargetID: target.User.ID, Level: change.To})
+			command.Respond(s, i, describeRosterChange(change))
+		}
+	}
+	r.Subcommand(leadCommand, &discordgo.ApplicationCommandOption{
+		Name:        "enroll",
+		Description: "メンバーをコースに登録",
+		Options:     []*discordgo.ApplicationCommandOption{userOption, courseNameOption},
+	}, delegated(AuditEnrolled, func(opts command.Options) internal.Level {
+		return internal.Apprentice
+	}))
+	r.Subcommand(leadCommand, &discordgo.ApplicationCommandOption{
+		Name:        "remove",
+		Description: "メンバーをコースから外す",
+		Options:     []*discordgo.ApplicationCommandOption{userOption, courseNameOption},
+	}, delegated(AuditRemoved, func(opts command.Options) internal.Level {
+		return ""
+	}))
+	r.Subcommand(leadCommand, &discordgo.ApplicationCommandOption{
+		Name:        "level",
+		Description: "メンバーのコースレベルを変更",
+		Options: []*discordgo.ApplicationCommandOption{userOption, courseNameOption, {
+			Type:        discordgo.ApplicationCommandOptionString,
+			Name:        "level",
+			Description: "変更後のレベル",
+			Required:    true,
+			Choices:     delegatedLevelChoices,
+		}},
+	}, delegated(AuditLevelChanged, func(opts command.Options) internal.Level {
+		return internal.Level(opts.String("level"))
+	}))
+}
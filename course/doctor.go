@@ -0,0 +1,86 @@
+package course
+
+import (
+	"expvar"
+	"fmt"
+	"log/slog"
+	"strings"
+
+	"github.com/bwmarrin/discordgo"
+	"github.com/gw31415/pgautorole/course/internal"
+	"github.com/gw31415/pgautorole/internal/command"
+	"github.com/gw31415/pgautorole/internal/utils"
+)
+
+// コースとして認識されなかったロール群の数
+var nearMissGroups = expvar.NewInt("course_near_miss_groups")
+
+// ロールをIDと名前の組に変換
+func internalRoles(roles []*discordgo.Role) []internal.Role {
+	return utils.SlicesMap(roles, func(r *discordgo.Role) internal.Role {
+		return internal.Role{ID: r.ID, Name: r.Name}
+	})
+}
+
+// ロールからコースとして認識されなかったロール群を診断する
+func diagnose(roles []*discordgo.Role) []internal.Issue {
+	return internal.Diagnose(internalRoles(roles))
+}
+
+// 診断結果をログに出力し、メトリクスを更新する
+func reportIssues(issues []internal.Issue) {
+	for _, issue := range issues {
+		slog.Warn("Near-miss course group", "KIND", issue.Kind, "COURSE_NAME", issue.Course, "LEVELS", issue.Levels, "ROLES", issue.RoleIDs)
+	}
+	nearMissGroups.Set(int64(len(issues)))
+}
+
+// 診断結果の説明文
+func describeIssue(issue internal.Issue) string {
+	levels := strings.Join(utils.SlicesMap(issue.Levels, func(l internal.Level) string {
+		return string(l)
+	}), ", ")
+	switch issue.Kind {
+	case internal.MissingLevels:
+		return fmt.Sprintf("コース %q: コースレベルロールが不足しています (%s)", issue.Course, levels)
+	case internal.DuplicatedLevels:
+		return fmt.Sprintf("コース %q: コースレベルロールが重複しています (%s)", issue.Course, levels)
+	case internal.DuplicatedCourse:
+		return fmt.Sprintf("コース %q: コースロールが重複しています", issue.Course)
+	case internal.OrphanLevels:
+		return fmt.Sprintf("コース %q: コースロールが存在しません (%s)", issue.Course, levels)
+	}
+	return fmt.Sprintf("コース %q: %s", issue.Course, issue.Kind)
+}
+
+func (m *courseManager) registerDoctorCommands(r *command.Router) {
+	r.Subcommand(courseCommand, &discordgo.ApplicationCommandOption{
+		Name:        "doctor",
+		Description: "コースとして認識されていないロール群を診断",
+	}, func(s *discordgo.Session, i *discordgo.InteractionCreate, opts command.Options) {
+		command.Deferred(s, i, func() string {
+			roles, err := s.GuildRoles(m.guildID)
+			if err != nil {
+				return "ロールの取得に失敗しました: " + err.Error()
+			}
+			byID := make(map[string]*discordgo.Role)
+			for _, r := range roles {
+				byID[r.ID] = r
+			}
+			problems := m.brokenDefinitions(byID)
+			// 定期的な同期と同じく、定義済み・アーカイブ済みのコースのロールは診断しない
+			_, unclaimed := m.claimRoles(roles, byID)
+			for _, issue := range diagnose(unclaimed) {
+				problems = append(problems, describeIssue(issue))
+			}
+			if len(problems) == 0 {
+				return "問題は見つかりませんでした。"
+			}
+			lines := []string{fmt.Sprintf("%d件の問題が見つかりました。", len(problems))}
+			for _, p := range problems {
+				lines = append(lines, "- "+p)
+			}
+			return strings.Join(lines, "\n")
+		})
+	})
+}
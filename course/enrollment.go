@@ -0,0 +1,49 @@
+package course
+
+import (
+	"fmt"
+	"log/slog"
+	"slices"
+
+	"github.com/bwmarrin/discordgo"
+	"github.com/gw31415/pgautorole/course/internal"
+	"github.com/gw31415/pgautorole/internal/utils"
+)
+
+// メンバーが持つコースロールの数
+// guildsyncのロックを取得した状態で呼び出す
+func (m *courseManager) countEnrollments(member *discordgo.Member) int {
+	return utils.SlicesCount(m.FilterIDs(member.Roles), func(id internal.CourseRelatedRoleID) bool {
+		_, ok := id.(*internal.CourseRoleID)
+		return ok
+	})
+}
+
+// 同時に受講できるコース数の上限を超えていれば、追加されたコースロールを取り消す
+// revertedは同じ更新で既に取り消したコースロールの数
+// 取り消した場合はtrueを返す
+// guildsyncのロックを取得した状態で呼び出す
+func (m *courseManager) enforceMaxEnrollments(s *discordgo.Session, member *discordgo.Member, courseID string, reverted int) bool {
+	if m.maxEnrollments <= 0 || slices.ContainsFunc(member.Roles, func(id string) bool {
+		return slices.Contains(m.exemptRoleIDs, id)
+	}) {
+		return false
+	}
+	count := m.countEnrollments(member) - reverted
+	if count <= m.maxEnrollments {
+		return false
+	}
+	m.markBotChange(member.User.ID, courseID, revertChange)
+	if err := s.GuildMemberRoleRemove(m.guildID, member.User.ID, courseID); err != nil {
+		slog.Error("Failed to revert course role", "USER", member.User.ID, "COURSE", courseID, "err", err)
+		m.takeBotChange(member.User.ID, courseID)
+		return false
+	}
+	name := m.roles[courseID].Name
+	slog.Info("Course enrollment exceeded the limit", "USER", member.User.ID, "USER_NAME", member.User.GlobalName, "COURSE", courseID, "COUNT", count, "MAX", m.maxEnrollments)
+	msg := fmt.Sprintf("同時に受講できるコースは%d件までのため、コース「%s」の登録を取り消しました。他のコースから外れてから再度登録してください。", m.maxEnrollments, name)
+	if err := utils.SendDirectMessage(s, member.User.ID, msg); err != nil {
+		slog.Warn("Failed to notify member", "USER", member.User.ID, "err", err)
+	}
+	return true
+}
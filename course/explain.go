@@ -0,0 +1,122 @@
+package course
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+	"github.com/gw31415/pgautorole/course/internal"
+	"github.com/gw31415/pgautorole/internal/utils"
+)
+
+// メンバーのコースの受講状況
+type memberCourse struct {
+	name   string
+	id     *internal.CourseRoleID
+	levels []internal.Level
+	// コースロールを持っているかどうか
+	enrolled bool
+}
+
+// メンバー本人向けに、コース関連ロールの状態とbotが行う操作を説明する
+func (m *courseManager) ExplainToMember(member *discordgo.Member) string {
+	switch m.filter.Skip(member) {
+	case utils.SkippedBot:
+		return "ボットのためコース関連ロールは自動処理の対象外です。"
+	case utils.SkippedPending:
+		return "メンバー認証を通過していないため、コース関連ロールは自動処理の対象外です。"
+	}
+
+	m.guildsync.RLock()
+	defer m.guildsync.RUnlock()
+	if m.RoleIDRepository == nil {
+		return "コースの情報を取得中です。しばらくしてからもう一度お試しください。"
+	}
+
+	courses := map[string]*memberCourse{}
+	levels := internal.Levels()
+	for _, id := range m.FilterIDs(member.Roles) {
+		course := id.GetCourseRoleID()
+		c := courses[course.String()]
+		if c == nil {
+			c = &memberCourse{name: m.roles[course.String()].Name, id: course}
+			courses[course.String()] = c
+		}
+		switch id := id.(type) {
+		case *internal.CourseRoleID:
+			c.enrolled = true
+		case *internal.CourseLevelRoleID:
+			idx := slices.IndexFunc(id.GetCourseLevelIDs(), func(l *internal.CourseLevelRoleID) bool {
+				return internal.Equal(l, id)
+			})
+			if idx >= 0 && idx < len(levels) {
+				c.levels = append(c.levels, levels[idx])
+			}
+		}
+	}
+	if len(courses) == 0 {
+		return "受講中のコースはありません。"
+	}
+	sorted := []*memberCourse{}
+	for _, c := range courses {
+		sorted = append(sorted, c)
+	}
+	slices.SortFunc(sorted, func(a, b *memberCourse) int {
+		return strings.Compare(a.name, b.name)
+	})
+
+	var events []internal.Event
+	m.history.View(func(h *CourseHistory) {
+		events = slices.Clone((*h)[member.User.ID])
+	})
+
+	b := &strings.Builder{}
+	for _, c := range sorted {
+		if !c.enrolled {
+			fmt.Fprintf(b, "- 「%s」: コースロールがないため、レベルのロール(%s)は外されます。\n", c.name, joinLevels(c.levels))
+			continue
+		}
+		switch len(c.levels) {
+		case 0:
+			fmt.Fprintf(b, "- 「%s」: レベルがないため、%sが付与されます。\n", c.name, internal.Apprentice)
+		case 1:
+			fmt.Fprintf(b, "- 「%s」: %s\n", c.name, c.levels[0])
+		default:
+			// 定期検査と同じく、今回付与されたレベルがないものとして解決方針を適用する
+			keep, ok := m.conflictPolicy.Resolve(c.levels, "", internal.LatestLevel(events, c.id.String(), c.levels))
+			if ok {
+				fmt.Fprintf(b, "- 「%s」: レベルを複数(%s)持っているため、%sを残して1つに整理されます。\n", c.name, joinLevels(c.levels), keep)
+			} else {
+				fmt.Fprintf(b, "- 「%s」: レベルを複数(%s)持っていますが、自動では整理されません。運営に確認してください。\n", c.name, joinLevels(c.levels))
+			}
+		}
+		if def := m.definition(c.id.String()); def != nil {
+			if unmet := m.unmetPrerequisites(member, c.id.String(), def, false); len(unmet) > 0 {
+				switch def.PrerequisiteEnforcement() {
+				case EnforceRevert:
+					fmt.Fprintf(b, "  - 受講条件(%s)を満たしていないため、コースロールは外されます。\n", m.describePrerequisites(unmet))
+				default:
+					fmt.Fprintf(b, "  - 受講条件(%s)を満たしていません。\n", m.describePrerequisites(unmet))
+				}
+			}
+		}
+		// レベルが戻された理由として、直近の重複の解消を示す
+		for i := len(events) - 1; i >= 0; i-- {
+			if e := events[i]; e.CourseID == c.id.String() && e.Kind == internal.ConflictResolved {
+				fmt.Fprintf(b, "  - %s にレベルが重複したため、%sを残して他のレベルを外しました。\n", e.At.Local().Format(time.DateOnly), e.Level)
+				break
+			}
+		}
+	}
+	if m.maxEnrollments > 0 {
+		fmt.Fprintf(b, "同時に受講できるコースは%d個までです(現在%d個)。\n", m.maxEnrollments, m.countEnrollments(member))
+	}
+	return b.String()
+}
+
+// レベルを読点区切りで連結
+func joinLevels(levels []internal.Level) string {
+	return strings.Join(utils.SlicesMap(levels, func(l internal.Level) string { return string(l) }), "、")
+}
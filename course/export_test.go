@@ -0,0 +1,12 @@
+package course
+
+import "github.com/gw31415/pgautorole/course/internal"
+
+// テストから通知の本文を作成するための公開
+type Notice = notice
+
+func NewNotice(userID string, e internal.Event) Notice {
+	return notice{userID, e}
+}
+
+var FormatNotices = formatNotices
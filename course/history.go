@@ -0,0 +1,290 @@
+package course
+
+import (
+	"bytes"
+	"cmp"
+	"encoding/csv"
+	"fmt"
+	"log/slog"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+	"github.com/gw31415/pgautorole/course/internal"
+	"github.com/gw31415/pgautorole/internal/command"
+	"github.com/gw31415/pgautorole/internal/utils"
+)
+
+// ユーザーIDからコースの受講履歴へのマップ
+type CourseHistory map[string][]internal.Event
+
+// botが行ったロールの変更の種類
+type botChangeKind int
+
+const (
+	// 付与・剥奪を取り消すための変更(受講履歴に記録しない)
+	revertChange botChangeKind = iota + 1
+	// 受講状況の整合性を保つための変更(受講履歴に記録するが通知しない)
+	systemChange
+)
+
+// botが行ったロールの変更
+type botChange struct {
+	kind botChangeKind
+	at   time.Time
+}
+
+// botが行ったロールの変更を、そのイベントを受け取るまで保持する期間
+const BOT_CHANGE_TTL = time.Minute
+
+// botがロールを変更することを記録する
+// 変更のイベントより先に記録されるよう、ロールを変更する前に呼び出す
+func (m *courseManager) markBotChange(userID, roleID string, kind botChangeKind) {
+	m.botSync.Lock()
+	defer m.botSync.Unlock()
+	now := time.Now()
+	for key, c := range m.botChanges {
+		if now.Sub(c.at) >= BOT_CHANGE_TTL {
+			delete(m.botChanges, key)
+		}
+	}
+	m.botChanges[userID+"/"+roleID] = botChange{kind, now}
+}
+
+// botが行ったロールの変更であれば記録を取り出し、その種類を返す(botの変更でなければ0)
+func (m *courseManager) takeBotChange(userID, roleID string) botChangeKind {
+	m.botSync.Lock()
+	defer m.botSync.Unlock()
+	key := userID + "/" + roleID
+	c, ok := m.botChanges[key]
+	if !ok {
+		return 0
+	}
+	delete(m.botChanges, key)
+	if time.Since(c.at) >= BOT_CHANGE_TTL {
+		return 0
+	}
+	return c.kind
+}
+
+// 受講履歴に記録する変更
+type transition struct {
+	event internal.Event
+	// botが整合性を保つために行った変更(通知しない)
+	system bool
+}
+
+// コース関連ロールの追加・削除から受講履歴に記録する変更を求める
+// botが取り消しのために行った変更は記録しない
+// guildsyncのロックを取得した状態で呼び出す
+func (m *courseManager) transitions(userID string, added, removed []internal.CourseRelatedRoleID) []transition {
+	now := time.Now()
+	transitions := []transition{}
+	for _, id := range added {
+		kind := m.takeBotChange(userID, id.String())
+		if kind == revertChange {
+			continue
+		}
+		course := id.GetCourseRoleID().String()
+		switch id := id.(type) {
+		case *internal.CourseRoleID:
+			transitions = append(transitions, transition{internal.Event{At: now, CourseID: course, Kind: internal.Enrolled}, kind == systemChange})
+		case *internal.CourseLevelRoleID:
+			idx := slices.IndexFunc(id.GetCourseLevelIDs(), func(l *internal.CourseLevelRoleID) bool {
+				return internal.Equal(l, id)
+			})
+			if idx < 0 || idx >= len(internal.Levels()) {
+				continue
+			}
+			transitions = append(transitions, transition{internal.Event{At: now, CourseID: course, Kind: internal.LevelChanged, Level: internal.Levels()[idx]}, kind == systemChange})
+		}
+	}
+	for _, id := range removed {
+		kind := m.takeBotChange(userID, id.String())
+		if kind == revertChange {
+			continue
+		}
+		if course, ok := id.(*internal.CourseRoleID); ok {
+			transitions = append(transitions, transition{internal.Event{At: now, CourseID: course.String(), Kind: internal.Left}, kind == systemChange})
+		}
+	}
+	return transitions
+}
+
+// 受講履歴を記録し、botが整合性を保つために行った変更以外を通知する
+// 受講履歴の保存中にロール情報の更新を妨げないよう、guildsyncのロックを取得していない状態で呼び出す
+func (m *courseManager) recordTransitions(s *discordgo.Session, userID string, transitions []transition) {
+	if len(transitions) == 0 {
+		return
+	}
+	events := []internal.Event{}
+	notices := []internal.Event{}
+	for _, t := range transitions {
+		events = append(events, t.event)
+		if !t.system {
+			notices = append(notices, t.event)
+		}
+	}
+	err := m.history.Update(func(h *CourseHistory) error {
+		(*h)[userID] = append((*h)[userID], events...)
+		return nil
+	})
+	if err != nil {
+		slog.Error("Failed to save course history", "err", err)
+	}
+	m.notify(s, userID, notices)
+}
+
+// 受講履歴の説明文
+func describeEvent(e internal.Event) string {
+	switch e.Kind {
+	case internal.Enrolled:
+		return "登録"
+	case internal.Left:
+		return "離脱"
+	case internal.LevelChanged:
+		return "レベル: " + string(e.Level)
+	case internal.Archived:
+		return "修了(" + cmp.Or(string(e.Level), "レベルなし") + ")"
+	case internal.ConflictResolved:
+		return "重複の解消(" + string(e.Level) + "を残す)"
+	}
+	return string(e.Kind)
+}
+
+// メンバーの受講履歴
+func (m *courseManager) memberHistory(userID string) string {
+	var events []internal.Event
+	m.history.View(func(h *CourseHistory) {
+		events = slices.Clone((*h)[userID])
+	})
+	if len(events) == 0 {
+		return fmt.Sprintf("<@%s> の受講履歴はありません。", userID)
+	}
+
+	m.guildsync.RLock()
+	defer m.guildsync.RUnlock()
+	lines := []string{fmt.Sprintf("<@%s> の受講履歴", userID)}
+	for _, e := range events {
+		name := cmp.Or(m.archivedName(e.CourseID), e.CourseID)
+		if r := m.roles[e.CourseID]; r != nil {
+			name = r.Name
+		}
+		lines = append(lines, fmt.Sprintf("- %s %s: %s", e.At.Local().Format(time.DateOnly), name, describeEvent(e)))
+	}
+	return strings.Join(lines, "\n")
+}
+
+// コースのレベルごとの統計
+type levelStats struct {
+	Level internal.Level
+	// 現在このレベルのメンバー数
+	Active int
+	// アプレンティスからこのレベルになるまでの期間の中央値
+	Median time.Duration
+	// 中央値の算出に用いたメンバー数
+	Samples int
+}
+
+// コースのレベルごとの統計を集計する
+func (m *courseManager) courseStats(s *discordgo.Session, course *internal.CourseRoleID) ([]levelStats, error) {
+	levelIDs := utils.SlicesMap(course.GetCourseLevelIDs(), (*internal.CourseLevelRoleID).String)
+	active := map[internal.Level]int{}
+	err := utils.ForEachMemberPage(s, m.guildID, func(members []*discordgo.Member) {
+		for _, member := range members {
+			if slices.Contains(member.Roles, course.String()) {
+				active[internal.HighestLevel(member.Roles, levelIDs)]++
+			}
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	stats := []levelStats{}
+	m.history.View(func(h *CourseHistory) {
+		for _, l := range internal.Levels() {
+			st := levelStats{Level: l, Active: active[l]}
+			if l != internal.Apprentice {
+				durations := internal.LevelDurations(*h, course.String(), internal.Apprentice, l)
+				st.Median, st.Samples = internal.MedianDuration(durations), len(durations)
+			}
+			stats = append(stats, st)
+		}
+	})
+	return stats, nil
+}
+
+// 期間を日数で表示
+func formatDays(d time.Duration) string {
+	return strconv.FormatFloat(d.Hours()/24, 'f', 1, 64)
+}
+
+// 統計をCSVに変換
+func statsCSV(stats []levelStats) []byte {
+	var b bytes.Buffer
+	w := csv.NewWriter(&b)
+	w.Write([]string{"level", "active_members", "median_days_from_apprentice", "samples"})
+	for _, st := range stats {
+		w.Write([]string{string(st.Level), strconv.Itoa(st.Active), formatDays(st.Median), strconv.Itoa(st.Samples)})
+	}
+	w.Flush()
+	return b.Bytes()
+}
+
+func (m *courseManager) registerHistoryCommands(r *command.Router) {
+	r.Subcommand(courseCommand, &discordgo.ApplicationCommandOption{
+		Name:        "history",
+		Description: "メンバーのコースの受講履歴を表示",
+		Options: []*discordgo.ApplicationCommandOption{{
+			Type:        discordgo.ApplicationCommandOptionUser,
+			Name:        "user",
+			Description: "対象のメンバー",
+			Required:    true,
+		}},
+	}, func(s *discordgo.Session, i *discordgo.InteractionCreate, opts command.Options) {
+		command.Deferred(s, i, func() string {
+			return m.memberHistory(opts.ID("user"))
+		})
+	})
+	r.Subcommand(courseCommand, &discordgo.ApplicationCommandOption{
+		Name:        "stats",
+		Description: "コースのレベルごとの統計を表示",
+		Options: []*discordgo.ApplicationCommandOption{courseNameOption, {
+			Type:        discordgo.ApplicationCommandOptionBoolean,
+			Name:        "csv",
+			Description: "CSVファイルとして出力する",
+		}},
+	}, func(s *discordgo.Session, i *discordgo.InteractionCreate, opts command.Options) {
+		name := internal.CourseName(opts.String("name"))
+		asCSV := opts.Bool("csv")
+		command.DeferredFile(s, i, func() (string, *discordgo.File) {
+			course := m.findCourse(name)
+			if course == nil {
+				return fmt.Sprintf("コース %q が見つかりません。", name), nil
+			}
+			stats, err := m.courseStats(s, course)
+			if err != nil {
+				return "統計の集計に失敗しました: " + err.Error(), nil
+			}
+			if asCSV {
+				return fmt.Sprintf("コース %q の統計", name), &discordgo.File{
+					Name:        "stats.csv",
+					ContentType: "text/csv",
+					Reader:      bytes.NewReader(statsCSV(stats)),
+				}
+			}
+			lines := []string{fmt.Sprintf("コース %q の統計", name)}
+			for _, st := range stats {
+				line := fmt.Sprintf("- %s: %d人", st.Level, st.Active)
+				if st.Samples > 0 {
+					line += fmt.Sprintf("(アプレンティスからの期間の中央値: %s日, %d人)", formatDays(st.Median), st.Samples)
+				}
+				lines = append(lines, line)
+			}
+			return strings.Join(lines, "\n"), nil
+		})
+	})
+}
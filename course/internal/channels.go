@@ -0,0 +1,200 @@
+package internal
+
+import (
+	"encoding/json"
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+// 権限名から権限の値へのマップ
+var permissions = map[string]int64{
+	"ViewChannel":            discordgo.PermissionViewChannel,
+	"SendMessages":           discordgo.PermissionSendMessages,
+	"SendMessagesInThreads":  discordgo.PermissionSendMessagesInThreads,
+	"CreatePublicThreads":    discordgo.PermissionCreatePublicThreads,
+	"CreatePrivateThreads":   discordgo.PermissionCreatePrivateThreads,
+	"ManageMessages":         discordgo.PermissionManageMessages,
+	"ManageThreads":          discordgo.PermissionManageThreads,
+	"ManageChannels":         discordgo.PermissionManageChannels,
+	"ReadMessageHistory":     discordgo.PermissionReadMessageHistory,
+	"EmbedLinks":             discordgo.PermissionEmbedLinks,
+	"AttachFiles":            discordgo.PermissionAttachFiles,
+	"AddReactions":           discordgo.PermissionAddReactions,
+	"MentionEveryone":        discordgo.PermissionMentionEveryone,
+	"UseApplicationCommands": discordgo.PermissionUseSlashCommands,
+	"Connect":                discordgo.PermissionVoiceConnect,
+	"Speak":                  discordgo.PermissionVoiceSpeak,
+	"Stream":                 discordgo.PermissionVoiceStreamVideo,
+	"MuteMembers":            discordgo.PermissionVoiceMuteMembers,
+	"DeafenMembers":          discordgo.PermissionVoiceDeafenMembers,
+	"MoveMembers":            discordgo.PermissionVoiceMoveMembers,
+	"PrioritySpeaker":        discordgo.PermissionVoicePrioritySpeaker,
+}
+
+// 権限名の一覧を権限の値に変換
+func parsePermissions(names []string) (int64, error) {
+	var v int64
+	for _, name := range names {
+		p, ok := permissions[name]
+		if !ok {
+			return 0, fmt.Errorf("unknown permission %q", name)
+		}
+		v |= p
+	}
+	return v, nil
+}
+
+// 権限の上書き設定
+type OverwriteSpec struct {
+	// 許可する権限名
+	Allow []string `json:"allow,omitempty"`
+	// 拒否する権限名
+	Deny []string `json:"deny,omitempty"`
+}
+
+// 上書き対象のキー: "everyone", "course", またはレベル名
+type Overwrites map[string]OverwriteSpec
+
+// 上書き対象のキーを検証
+func (o Overwrites) validate() error {
+	for key, spec := range o {
+		if key != "everyone" && key != "course" && LevelIndex(Level(key)) < 0 {
+			return fmt.Errorf("unknown overwrite target %q", key)
+		}
+		if _, err := parsePermissions(spec.Allow); err != nil {
+			return err
+		}
+		if _, err := parsePermissions(spec.Deny); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// 他の上書き設定で上書きした設定を生成
+// 同じ対象の設定はotherが優先される
+func (o Overwrites) Merge(other Overwrites) Overwrites {
+	merged := Overwrites{}
+	for key, spec := range o {
+		merged[key] = spec
+	}
+	for key, spec := range other {
+		merged[key] = spec
+	}
+	return merged
+}
+
+// コースのロールIDを当てはめて権限の上書きを生成
+// levelIDsはレベルの低い順のコースレベルロールID
+func (o Overwrites) Build(everyoneID, courseID string, levelIDs []string) []*discordgo.PermissionOverwrite {
+	overwrites := []*discordgo.PermissionOverwrite{}
+	for key, spec := range o {
+		id := ""
+		switch key {
+		case "everyone":
+			id = everyoneID
+		case "course":
+			id = courseID
+		default:
+			if idx := LevelIndex(Level(key)); idx >= 0 && idx < len(levelIDs) {
+				id = levelIDs[idx]
+			}
+		}
+		if id == "" {
+			continue
+		}
+		allow, _ := parsePermissions(spec.Allow)
+		deny, _ := parsePermissions(spec.Deny)
+		overwrites = append(overwrites, &discordgo.PermissionOverwrite{
+			ID:    id,
+			Type:  discordgo.PermissionOverwriteTypeRole,
+			Allow: allow,
+			Deny:  deny,
+		})
+	}
+	SortOverwrites(overwrites)
+	return overwrites
+}
+
+// 比較できるよう権限の上書きをID順に並べる
+func SortOverwrites(overwrites []*discordgo.PermissionOverwrite) {
+	slices.SortFunc(overwrites, func(a, b *discordgo.PermissionOverwrite) int {
+		return strings.Compare(a.ID, b.ID)
+	})
+}
+
+// 権限の上書きが等しいかどうか(順序は問わない)
+func EqualOverwrites(a, b []*discordgo.PermissionOverwrite) bool {
+	a, b = slices.Clone(a), slices.Clone(b)
+	SortOverwrites(a)
+	SortOverwrites(b)
+	return slices.EqualFunc(a, b, func(x, y *discordgo.PermissionOverwrite) bool {
+		return *x == *y
+	})
+}
+
+// チャンネルの設定
+type ChannelSpec struct {
+	// チャンネル名
+	Name string `json:"name"`
+	// "text" または "voice"
+	Type string `json:"type,omitempty"`
+	// 権限の上書き
+	Overwrites Overwrites `json:"overwrites,omitempty"`
+}
+
+// チャンネルの種類
+func (c *ChannelSpec) ChannelType() discordgo.ChannelType {
+	if c.Type == "voice" {
+		return discordgo.ChannelTypeGuildVoice
+	}
+	return discordgo.ChannelTypeGuildText
+}
+
+// Discordが保存するチャンネル名に正規化する
+// テキストチャンネルの名前は小文字になり、空白はハイフンに置き換えられる
+func NormalizeChannelName(name string, t discordgo.ChannelType) string {
+	if t != discordgo.ChannelTypeGuildText {
+		return name
+	}
+	return strings.Join(strings.Fields(strings.ToLower(name)), "-")
+}
+
+// コースごとのカテゴリとチャンネルの設定
+type ChannelTemplate struct {
+	// カテゴリの権限の上書き
+	Overwrites Overwrites `json:"overwrites,omitempty"`
+	// カテゴリ内のチャンネル
+	Channels []ChannelSpec `json:"channels"`
+}
+
+// JSONからカテゴリとチャンネルの設定を解析
+func ParseChannelTemplate(b []byte) (*ChannelTemplate, error) {
+	t := &ChannelTemplate{}
+	if err := json.Unmarshal(b, t); err != nil {
+		return nil, err
+	}
+	if err := t.Overwrites.validate(); err != nil {
+		return nil, err
+	}
+	names := map[string]bool{}
+	for _, c := range t.Channels {
+		if c.Name == "" {
+			return nil, fmt.Errorf("channel name is required")
+		}
+		if names[c.Name] {
+			return nil, fmt.Errorf("duplicated channel %q", c.Name)
+		}
+		names[c.Name] = true
+		if c.Type != "" && c.Type != "text" && c.Type != "voice" {
+			return nil, fmt.Errorf("unknown channel type %q", c.Type)
+		}
+		if err := c.Overwrites.validate(); err != nil {
+			return nil, err
+		}
+	}
+	return t, nil
+}
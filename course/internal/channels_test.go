@@ -0,0 +1,93 @@
+package internal_test
+
+import (
+	"testing"
+
+	"github.com/bwmarrin/discordgo"
+	"github.com/gw31415/pgautorole/course/internal"
+)
+
+const channelTemplate = `{
+	"overwrites": {
+		"everyone": {"deny": ["ViewChannel"]},
+		"course": {"allow": ["ViewChannel"]}
+	},
+	"channels": [
+		{"name": "general", "overwrites": {"リード": {"allow": ["ManageMessages"]}}},
+		{"name": "announcements", "overwrites": {"アプレンティス": {"deny": ["SendMessages"]}}},
+		{"name": "voice", "type": "voice"}
+	]
+}`
+
+func TestParseChannelTemplate(t *testing.T) {
+	t.Run("Valid", func(t *testing.T) {
+		tmpl, err := internal.ParseChannelTemplate([]byte(channelTemplate))
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if len(tmpl.Channels) != 3 {
+			t.Fatalf("unexpected length: %v", len(tmpl.Channels))
+		}
+		if tmpl.Channels[2].ChannelType() != discordgo.ChannelTypeGuildVoice {
+			t.Fatalf("unexpected channel type")
+		}
+	})
+	t.Run("Invalid", func(t *testing.T) {
+		srcs := []string{
+			`{"overwrites": {"staff": {}}, "channels": []}`,
+			`{"overwrites": {"course": {"allow": ["Fly"]}}, "channels": []}`,
+			`{"channels": [{"name": ""}]}`,
+			`{"channels": [{"name": "a"}, {"name": "a"}]}`,
+			`{"channels": [{"name": "a", "type": "forum"}]}`,
+		}
+		for _, src := range srcs {
+			if _, err := internal.ParseChannelTemplate([]byte(src)); err == nil {
+				t.Fatalf("unexpected nil error for %s", src)
+			}
+		}
+	})
+}
+
+func TestNormalizeChannelName(t *testing.T) {
+	cases := []struct {
+		name string
+		typ  discordgo.ChannelType
+		want string
+	}{
+		{"General Chat", discordgo.ChannelTypeGuildText, "general-chat"},
+		{" 質問  部屋 ", discordgo.ChannelTypeGuildText, "質問-部屋"},
+		{"General Chat", discordgo.ChannelTypeGuildVoice, "General Chat"},
+		{"Go コース", discordgo.ChannelTypeGuildCategory, "Go コース"},
+	}
+	for _, c := range cases {
+		if got := internal.NormalizeChannelName(c.name, c.typ); got != c.want {
+			t.Fatalf("unexpected name for %q: %q", c.name, got)
+		}
+	}
+}
+
+func TestBuildOverwrites(t *testing.T) {
+	tmpl, err := internal.ParseChannelTemplate([]byte(channelTemplate))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	levels := []string{"apprentice", "assistant", "normal", "lead"}
+
+	category := tmpl.Overwrites.Build("everyone", "course", levels)
+	expected := []*discordgo.PermissionOverwrite{
+		{ID: "course", Type: discordgo.PermissionOverwriteTypeRole, Allow: discordgo.PermissionViewChannel},
+		{ID: "everyone", Type: discordgo.PermissionOverwriteTypeRole, Deny: discordgo.PermissionViewChannel},
+	}
+	if !internal.EqualOverwrites(category, expected) {
+		t.Fatalf("unexpected overwrites: %v", category)
+	}
+
+	general := tmpl.Overwrites.Merge(tmpl.Channels[0].Overwrites).Build("everyone", "course", levels)
+	if len(general) != 3 || general[2].ID != "lead" || general[2].Allow != discordgo.PermissionManageMessages {
+		t.Fatalf("unexpected overwrites: %v", general)
+	}
+	announcements := tmpl.Channels[1].Overwrites.Build("everyone", "course", levels)
+	if len(announcements) != 1 || announcements[0].ID != "apprentice" || announcements[0].Deny != discordgo.PermissionSendMessages {
+		t.Fatalf("unexpected overwrites: %v", announcements)
+	}
+}
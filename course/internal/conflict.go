@@ -0,0 +1,82 @@
+package internal
+
+import (
+	"fmt"
+	"slices"
+)
+
+// コースレベルロールが重複した場合の解決方針
+type ConflictPolicy string
+
+const (
+	// 今回の更新で付与されたレベルを残す(なければ解決しない)
+	KeepActor ConflictPolicy = "actor"
+	// 最も高いレベルを残す
+	KeepHighest ConflictPolicy = "highest"
+	// 最も低いレベルを残す
+	KeepLowest ConflictPolicy = "lowest"
+	// 最後に付与されたレベルを残す
+	KeepLatest ConflictPolicy = "latest"
+	// 解決せず記録のみ
+	ReportOnly ConflictPolicy = "report"
+)
+
+// 解決方針を解析(空の場合はKeepLatest)
+func ParseConflictPolicy(s string) (ConflictPolicy, error) {
+	if s == "" {
+		return KeepLatest, nil
+	}
+	p := ConflictPolicy(s)
+	switch p {
+	case KeepActor, KeepHighest, KeepLowest, KeepLatest, ReportOnly:
+		return p, nil
+	}
+	return "", fmt.Errorf("unknown conflict policy %q", s)
+}
+
+// 重複したコースレベルのうち残すレベルを決める
+// heldは持っているレベル、addedは今回の更新で付与されたレベル(なければ空)、
+// latestは受講履歴上最後に付与されたレベル(不明なら空)
+// 解決しない場合はfalseを返す
+func (p ConflictPolicy) Resolve(held []Level, added, latest Level) (Level, bool) {
+	if len(held) == 0 || p == ReportOnly {
+		return "", false
+	}
+	sorted := slices.Clone(held)
+	slices.SortFunc(sorted, func(a, b Level) int {
+		return LevelIndex(a) - LevelIndex(b)
+	})
+	highest, lowest := sorted[len(sorted)-1], sorted[0]
+
+	switch p {
+	case KeepHighest:
+		return highest, true
+	case KeepLowest:
+		return lowest, true
+	case KeepActor:
+		if slices.Contains(held, added) {
+			return added, true
+		}
+		return "", false
+	}
+	// KeepLatest、または今回付与されたレベルがない場合
+	if slices.Contains(held, added) {
+		return added, true
+	}
+	if slices.Contains(held, latest) {
+		return latest, true
+	}
+	// 付与された順序が不明な場合は最も高いレベルを残す
+	return highest, true
+}
+
+// 受講履歴上、heldのうち最後に付与されたレベルを取得(不明なら空)
+func LatestLevel(events []Event, courseID string, held []Level) Level {
+	latest := Level("")
+	for _, e := range events {
+		if e.CourseID == courseID && e.Kind == LevelChanged && slices.Contains(held, e.Level) {
+			latest = e.Level
+		}
+	}
+	return latest
+}
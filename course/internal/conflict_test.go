@@ -0,0 +1,52 @@
+package internal_test
+
+import (
+	"testing"
+
+	"github.com/gw31415/pgautorole/course/internal"
+)
+
+func TestParseConflictPolicy(t *testing.T) {
+	if p, err := internal.ParseConflictPolicy(""); err != nil || p != internal.KeepLatest {
+		t.Fatalf("unexpected default policy: %v, %v", p, err)
+	}
+	if _, err := internal.ParseConflictPolicy("random"); err == nil {
+		t.Fatalf("unexpected nil error")
+	}
+}
+
+func TestResolveConflict(t *testing.T) {
+	held := []internal.Level{internal.Lead, internal.Apprentice, internal.Normal}
+	cases := []struct {
+		policy        internal.ConflictPolicy
+		added, latest internal.Level
+		expected      internal.Level
+		ok            bool
+	}{
+		{internal.KeepHighest, internal.Apprentice, "", internal.Lead, true},
+		{internal.KeepLowest, internal.Lead, "", internal.Apprentice, true},
+		{internal.KeepActor, internal.Normal, internal.Lead, internal.Normal, true},
+		{internal.KeepActor, "", internal.Apprentice, "", false},
+		{internal.KeepLatest, "", internal.Normal, internal.Normal, true},
+		{internal.KeepLatest, "", "", internal.Lead, true},
+		{internal.ReportOnly, internal.Normal, "", "", false},
+	}
+	for _, c := range cases {
+		keep, ok := c.policy.Resolve(held, c.added, c.latest)
+		if keep != c.expected || ok != c.ok {
+			t.Errorf("unexpected result for %s: %s, %v", c.policy, keep, ok)
+		}
+	}
+}
+
+func TestLatestLevel(t *testing.T) {
+	events := []internal.Event{
+		{CourseID: "go", Kind: internal.LevelChanged, Level: internal.Normal},
+		{CourseID: "go", Kind: internal.LevelChanged, Level: internal.Lead},
+		{CourseID: "web", Kind: internal.LevelChanged, Level: internal.Apprentice},
+	}
+	held := []internal.Level{internal.Normal, internal.Apprentice}
+	if l := internal.LatestLevel(events, "go", held); l != internal.Normal {
+		t.Fatalf("unexpected latest level: %s", l)
+	}
+}
@@ -1,6 +1,7 @@
 package internal
 
 import (
+	"slices"
 	"strings"
 
 	"github.com/gw31415/pgautorole/internal/utils"
@@ -27,6 +28,17 @@ var levels = []Level{
 	Lead,
 }
 
+// 全てのレベルを低い順に取得
+func Levels() []Level {
+	return slices.Clone(levels)
+}
+
+// レベルの順位(低い順に0から)を取得
+// 不明なレベルの場合は-1を返す
+func LevelIndex(l Level) int {
+	return slices.Index(levels, l)
+}
+
 // コース
 type CourseName string
 
@@ -71,3 +83,21 @@ func ParseCourseLevel(s string) *CourseLevelName {
 func (cl *CourseLevelName) String() string {
 	return string(cl.Course) + "-" + string(cl.Level)
 }
+
+// メンバーのロールのうち、コースで最も高いレベルを取得
+// levelIDsはレベルの低い順のコースレベルロールID
+// コースレベルロールを持たない場合は空文字列を返す
+func HighestLevel(roles []string, levelIDs []string) Level {
+	for i := len(levelIDs) - 1; i >= 0; i-- {
+		if i < len(levels) && slices.Contains(roles, levelIDs[i]) {
+			return levels[i]
+		}
+	}
+	return ""
+}
+
+// メンバーのロールがコースで指定したレベル以上かどうか
+func HasLevelAtLeast(roles []string, levelIDs []string, min Level) bool {
+	highest := HighestLevel(roles, levelIDs)
+	return highest != "" && LevelIndex(highest) >= LevelIndex(min)
+}
@@ -48,3 +48,26 @@ func TestParseCourseLevel(t *testing.T) {
 		t.Errorf("unexpected level: %s", cl.Level)
 	}
 }
+
+func TestHasLevelAtLeast(t *testing.T) {
+	levelIDs := []string{"apprentice", "assistant", "normal", "lead"}
+	cases := []struct {
+		roles    []string
+		min      internal.Level
+		expected bool
+	}{
+		{[]string{"normal"}, internal.Normal, true},
+		{[]string{"lead"}, internal.Normal, true},
+		{[]string{"assistant"}, internal.Normal, false},
+		{[]string{"other"}, internal.Apprentice, false},
+		{[]string{"apprentice", "lead"}, internal.Lead, true},
+	}
+	for _, c := range cases {
+		if internal.HasLevelAtLeast(c.roles, levelIDs, c.min) != c.expected {
+			t.Errorf("unexpected result for %v >= %s", c.roles, c.min)
+		}
+	}
+	if internal.HighestLevel([]string{"assistant", "apprentice"}, levelIDs) != internal.Assistant {
+		t.Errorf("unexpected highest level")
+	}
+}
@@ -0,0 +1,29 @@
+package internal
+
+// ロール名からコースを検出し、コースロールIDからレベルの低い順のコースレベルロールIDへのマップを返す
+// コースロールと全てのコースレベルロールが過不足なく一つずつ存在するものをコースとする
+func DetectCourses(roles []Role) map[string][]string {
+	byName := make(map[string][]string, len(roles))
+	for _, r := range roles {
+		byName[r.Name] = append(byName[r.Name], r.ID)
+	}
+
+	c2lMap := make(map[string][]string)
+r:
+	for _, r := range roles {
+		if len(byName[r.Name]) != 1 {
+			continue
+		}
+		c := CourseName(r.Name)
+		clid := []string{}
+		for _, cl := range c.CourseLevelNames() {
+			ids := byName[cl.String()]
+			if len(ids) != 1 {
+				continue r
+			}
+			clid = append(clid, ids[0])
+		}
+		c2lMap[r.ID] = clid
+	}
+	return c2lMap
+}
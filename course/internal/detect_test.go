@@ -0,0 +1,52 @@
+package internal_test
+
+import (
+	"fmt"
+	"slices"
+	"testing"
+
+	"github.com/gw31415/pgautorole/course/internal"
+)
+
+// コース数分のコース関連ロールと、同数のコースと無関係なロールを生成
+func courseRoles(courses int) []internal.Role {
+	roles := []internal.Role{}
+	for i := range courses {
+		name := internal.CourseName(fmt.Sprintf("Course%d", i))
+		roles = append(roles, internal.Role{ID: string(name), Name: string(name)})
+		for _, cl := range name.CourseLevelNames() {
+			roles = append(roles, internal.Role{ID: cl.String(), Name: cl.String()})
+		}
+		roles = append(roles, internal.Role{ID: fmt.Sprintf("other%d", i), Name: fmt.Sprintf("Other%d", i)})
+	}
+	return roles
+}
+
+func TestDetectCourses(t *testing.T) {
+	roles := courseRoles(2)
+	// コースロールが重複しているコースは検出しない
+	roles = append(roles, internal.Role{ID: "dup1", Name: "Dup"}, internal.Role{ID: "dup2", Name: "Dup"})
+	name := internal.CourseName("Dup")
+	for _, cl := range name.CourseLevelNames() {
+		roles = append(roles, internal.Role{ID: cl.String(), Name: cl.String()})
+	}
+	// コースレベルロールが不足しているコースは検出しない
+	roles = append(roles, internal.Role{ID: "go", Name: "Go"}, internal.Role{ID: "go-1", Name: "Go-アプレンティス"})
+
+	c2lMap := internal.DetectCourses(roles)
+	if len(c2lMap) != 2 {
+		t.Fatalf("unexpected courses: %v", c2lMap)
+	}
+	expected := []string{"Course0-アプレンティス", "Course0-アシスタント", "Course0-ノーマル", "Course0-リード"}
+	if !slices.Equal(c2lMap["Course0"], expected) {
+		t.Fatalf("unexpected levels: %v", c2lMap["Course0"])
+	}
+}
+
+func BenchmarkDetectCourses(b *testing.B) {
+	roles := courseRoles(1000)
+	b.ResetTimer()
+	for range b.N {
+		internal.DetectCourses(roles)
+	}
+}
@@ -0,0 +1,92 @@
+package internal
+
+import (
+	"slices"
+	"strings"
+)
+
+// ロールのIDと名前
+type Role struct {
+	ID   string
+	Name string
+}
+
+// コースになりきれなかったロール群の問題の種類
+type IssueKind string
+
+const (
+	// コースロールはあるが、一部のコースレベルロールが存在しない
+	MissingLevels IssueKind = "missing_levels"
+	// 同じ名前のコースレベルロールが複数存在する
+	DuplicatedLevels IssueKind = "duplicated_levels"
+	// 同じ名前のコースロールが複数存在する
+	DuplicatedCourse IssueKind = "duplicated_course"
+	// コースレベルロールに対応するコースロールが存在しない
+	OrphanLevels IssueKind = "orphan_levels"
+)
+
+// コースになりきれなかったロール群の問題
+type Issue struct {
+	Kind IssueKind
+	// 該当するコース名
+	Course CourseName
+	// 不足・重複しているレベル(OrphanLevelsの場合は存在するレベル)
+	Levels []Level
+	// 問題に関係するロールID
+	RoleIDs []string
+}
+
+// コースレベルロールが1つ以上あるにも関わらずコースとして認識されないロール群を診断する
+func Diagnose(roles []Role) []Issue {
+	byName := make(map[string][]string)
+	for _, r := range roles {
+		byName[r.Name] = append(byName[r.Name], r.ID)
+	}
+
+	// コースレベルロールの名前からコース名の候補を集める
+	candidates := []CourseName{}
+	for _, r := range roles {
+		if cl := ParseCourseLevel(r.Name); cl != nil && !slices.Contains(candidates, cl.Course) {
+			candidates = append(candidates, cl.Course)
+		}
+	}
+	slices.SortFunc(candidates, func(a, b CourseName) int {
+		return strings.Compare(string(a), string(b))
+	})
+
+	issues := []Issue{}
+	for _, c := range candidates {
+		courseIDs := byName[string(c)]
+		missing, duplicated, present := []Level{}, []Level{}, []Level{}
+		duplicatedIDs, presentIDs := []string{}, []string{}
+		for _, cl := range c.CourseLevelNames() {
+			ids := byName[cl.String()]
+			switch {
+			case len(ids) == 0:
+				missing = append(missing, cl.Level)
+			case len(ids) > 1:
+				duplicated = append(duplicated, cl.Level)
+				duplicatedIDs = append(duplicatedIDs, ids...)
+			}
+			if len(ids) > 0 {
+				present = append(present, cl.Level)
+				presentIDs = append(presentIDs, ids...)
+			}
+		}
+
+		if len(courseIDs) == 0 {
+			issues = append(issues, Issue{OrphanLevels, c, present, presentIDs})
+			continue
+		}
+		if len(courseIDs) > 1 {
+			issues = append(issues, Issue{DuplicatedCourse, c, nil, courseIDs})
+		}
+		if len(missing) > 0 {
+			issues = append(issues, Issue{MissingLevels, c, missing, append(slices.Clone(courseIDs), presentIDs...)})
+		}
+		if len(duplicated) > 0 {
+			issues = append(issues, Issue{DuplicatedLevels, c, duplicated, duplicatedIDs})
+		}
+	}
+	return issues
+}
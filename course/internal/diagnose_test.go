@@ -0,0 +1,63 @@
+package internal_test
+
+import (
+	"slices"
+	"testing"
+
+	"github.com/gw31415/pgautorole/course/internal"
+)
+
+func TestDiagnose(t *testing.T) {
+	roles := []internal.Role{
+		// 正常なコース
+		{ID: "ok", Name: "OK"},
+		{ID: "ok-1", Name: "OK-アプレンティス"},
+		{ID: "ok-2", Name: "OK-アシスタント"},
+		{ID: "ok-3", Name: "OK-ノーマル"},
+		{ID: "ok-4", Name: "OK-リード"},
+		// ノーマルが不足し、リードが重複している
+		{ID: "go", Name: "Go"},
+		{ID: "go-1", Name: "Go-アプレンティス"},
+		{ID: "go-2", Name: "Go-アシスタント"},
+		{ID: "go-4a", Name: "Go-リード"},
+		{ID: "go-4b", Name: "Go-リード"},
+		// コースロールが存在しない
+		{ID: "web-1", Name: "Web-アプレンティス"},
+		// コースレベルロールと関係のないロール
+		{ID: "other", Name: "Other"},
+	}
+	issues := internal.Diagnose(roles)
+	if len(issues) != 3 {
+		t.Fatalf("unexpected issues: %v", issues)
+	}
+
+	expected := []struct {
+		kind   internal.IssueKind
+		course internal.CourseName
+		levels []internal.Level
+	}{
+		{internal.MissingLevels, "Go", []internal.Level{internal.Normal}},
+		{internal.DuplicatedLevels, "Go", []internal.Level{internal.Lead}},
+		{internal.OrphanLevels, "Web", []internal.Level{internal.Apprentice}},
+	}
+	for i, e := range expected {
+		if issues[i].Kind != e.kind || issues[i].Course != e.course || !slices.Equal(issues[i].Levels, e.levels) {
+			t.Fatalf("unexpected issue %d: %v", i, issues[i])
+		}
+	}
+	if !slices.Contains(issues[1].RoleIDs, "go-4b") {
+		t.Fatalf("unexpected role ids: %v", issues[1].RoleIDs)
+	}
+}
+
+func TestDiagnoseDuplicatedCourse(t *testing.T) {
+	roles := []internal.Role{{ID: "a", Name: "A"}, {ID: "b", Name: "A"}}
+	name := internal.CourseName("A")
+	for _, cl := range name.CourseLevelNames() {
+		roles = append(roles, internal.Role{ID: cl.String(), Name: cl.String()})
+	}
+	issues := internal.Diagnose(roles)
+	if len(issues) != 1 || issues[0].Kind != internal.DuplicatedCourse {
+		t.Fatalf("unexpected issues: %v", issues)
+	}
+}
@@ -0,0 +1,90 @@
+package internal
+
+import (
+	"slices"
+	"time"
+)
+
+// コースの受講履歴の種類
+type EventKind string
+
+const (
+	// コースに登録した
+	Enrolled EventKind = "enrolled"
+	// コースから外れた
+	Left EventKind = "left"
+	// レベルが変わった
+	LevelChanged EventKind = "level"
+	// コースがアーカイブされ修了した
+	Archived EventKind = "archived"
+	// 重複したコースレベルロールを解決した
+	ConflictResolved EventKind = "conflict"
+)
+
+// コースの受講履歴
+type Event struct {
+	// 発生日時
+	At time.Time `json:"at"`
+	// コースロールID
+	CourseID string `json:"course_id"`
+	// 種類
+	Kind EventKind `json:"kind"`
+	// 変更後のレベル(LevelChangedの場合)、修了時のレベル(Archivedの場合)、残したレベル(ConflictResolvedの場合)
+	Level Level `json:"level,omitempty"`
+}
+
+// 各メンバーがfromのレベルになってから初めてtoのレベルになるまでの期間を集計する
+// eventsはメンバーごとの受講履歴
+func LevelDurations(events map[string][]Event, courseID string, from, to Level) []time.Duration {
+	durations := []time.Duration{}
+	for _, es := range events {
+		var reached *time.Time
+		for _, e := range es {
+			if e.CourseID != courseID || e.Kind != LevelChanged {
+				continue
+			}
+			if e.Level == from && reached == nil {
+				at := e.At
+				reached = &at
+			}
+			if e.Level == to && reached != nil {
+				durations = append(durations, e.At.Sub(*reached))
+				break
+			}
+		}
+	}
+	return durations
+}
+
+// メンバーの受講履歴から、現在の在籍が始まった(最後にコースに登録した)日時を求める
+// 登録が記録されていないか、最後にコースから外れている場合はfalseを返す
+func EnrolledAt(events []Event, courseID string) (time.Time, bool) {
+	var at time.Time
+	enrolled := false
+	for _, e := range events {
+		if e.CourseID != courseID {
+			continue
+		}
+		switch e.Kind {
+		case Enrolled:
+			at, enrolled = e.At, true
+		case Left, Archived:
+			enrolled = false
+		}
+	}
+	return at, enrolled
+}
+
+// 期間の中央値(空の場合は0)
+func MedianDuration(durations []time.Duration) time.Duration {
+	if len(durations) == 0 {
+		return 0
+	}
+	sorted := slices.Clone(durations)
+	slices.Sort(sorted)
+	mid := len(sorted) / 2
+	if len(sorted)%2 == 0 {
+		return (sorted[mid-1] + sorted[mid]) / 2
+	}
+	return sorted[mid]
+}
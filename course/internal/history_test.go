@@ -0,0 +1,66 @@
+package internal_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/gw31415/pgautorole/course/internal"
+)
+
+func TestLevelDurations(t *testing.T) {
+	base := time.Date(2024, 4, 1, 0, 0, 0, 0, time.UTC)
+	day := 24 * time.Hour
+	level := func(d int, course string, l internal.Level) internal.Event {
+		return internal.Event{At: base.Add(time.Duration(d) * day), CourseID: course, Kind: internal.LevelChanged, Level: l}
+	}
+	events := map[string][]internal.Event{
+		"a": {level(0, "go", internal.Apprentice), level(10, "go", internal.Normal), level(30, "go", internal.Lead)},
+		"b": {level(5, "go", internal.Apprentice), level(15, "go", internal.Lead), level(20, "go", internal.Lead)},
+		// Leadに到達していない
+		"c": {level(0, "go", internal.Apprentice), level(3, "go", internal.Normal)},
+		// 別のコース
+		"d": {level(0, "web", internal.Apprentice), level(1, "web", internal.Lead)},
+		// Apprenticeを経ずにLeadになった
+		"e": {level(0, "go", internal.Lead)},
+	}
+	durations := internal.LevelDurations(events, "go", internal.Apprentice, internal.Lead)
+	if len(durations) != 2 {
+		t.Fatalf("unexpected durations: %v", durations)
+	}
+	if m := internal.MedianDuration(durations); m != 20*day {
+		t.Fatalf("unexpected median: %v", m)
+	}
+}
+
+func TestEnrolledAt(t *testing.T) {
+	base := time.Date(2024, 4, 1, 0, 0, 0, 0, time.UTC)
+	event := func(d int, course string, kind internal.EventKind) internal.Event {
+		return internal.Event{At: base.AddDate(0, 0, d), CourseID: course, Kind: kind}
+	}
+	events := []internal.Event{
+		event(0, "go", internal.Enrolled),
+		event(1, "web", internal.Enrolled),
+		event(5, "go", internal.Left),
+		event(9, "go", internal.Enrolled),
+		event(10, "go", internal.LevelChanged),
+		event(12, "web", internal.Left),
+	}
+	if at, ok := internal.EnrolledAt(events, "go"); !ok || !at.Equal(base.AddDate(0, 0, 9)) {
+		t.Fatalf("unexpected enrolled at: %v, %v", at, ok)
+	}
+	if _, ok := internal.EnrolledAt(events, "web"); ok {
+		t.Fatal("expected not enrolled after leaving")
+	}
+	if _, ok := internal.EnrolledAt(events, "rust"); ok {
+		t.Fatal("expected not enrolled without history")
+	}
+}
+
+func TestMedianDuration(t *testing.T) {
+	if internal.MedianDuration(nil) != 0 {
+		t.Fatalf("unexpected median of empty durations")
+	}
+	if m := internal.MedianDuration([]time.Duration{3, 1, 2}); m != 2 {
+		t.Fatalf("unexpected median: %v", m)
+	}
+}
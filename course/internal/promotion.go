@@ -0,0 +1,100 @@
+package internal
+
+import (
+	"encoding/json"
+	"fmt"
+	"slices"
+	"time"
+
+	"github.com/gw31415/pgautorole/internal/utils"
+)
+
+// 全てのコースに適用するルールのコース指定
+const AllCourses = "*"
+
+// 在籍期間に基づくレベルの昇格ルール
+type PromotionRule struct {
+	// 対象のコース名またはコースロールID(AllCoursesの場合は全てのコース)
+	Course string `json:"course"`
+	// 昇格前のレベル
+	From Level `json:"from"`
+	// 昇格後のレベル
+	To Level `json:"to"`
+	// 昇格前のレベルでの在籍期間
+	After string `json:"after"`
+	// これらのロールを持つメンバーは昇格しない
+	Unless []string `json:"unless,omitempty"`
+
+	// 解析済みの在籍期間
+	after time.Duration
+}
+
+// ルールを検証し、在籍期間を解析する
+func (r *PromotionRule) validate() error {
+	if r.Course == "" {
+		return fmt.Errorf("course is required")
+	}
+	if LevelIndex(r.From) < 0 || LevelIndex(r.To) < 0 {
+		return fmt.Errorf("course %s: unknown level", r.Course)
+	}
+	if LevelIndex(r.To) <= LevelIndex(r.From) {
+		return fmt.Errorf("course %s: %s is not higher than %s", r.Course, r.To, r.From)
+	}
+	d, err := utils.ParseDuration(r.After)
+	if err != nil {
+		return fmt.Errorf("course %s: %w", r.Course, err)
+	}
+	if d <= 0 {
+		return fmt.Errorf("course %s: after is required", r.Course)
+	}
+	r.after = d
+	return nil
+}
+
+// コースにルールが適用されるかどうか
+func (r *PromotionRule) Matches(courseID, courseName string) bool {
+	return r.Course == AllCourses || r.Course == courseID || r.Course == courseName
+}
+
+// メンバーが昇格の対象かどうか
+// levelSinceは現在のレベルになった日時
+func (r *PromotionRule) Due(level Level, levelSince time.Time, roles []string, now time.Time) bool {
+	if level != r.From || levelSince.IsZero() {
+		return false
+	}
+	if slices.ContainsFunc(roles, func(id string) bool {
+		return slices.Contains(r.Unless, id)
+	}) {
+		return false
+	}
+	return !now.Before(levelSince.Add(r.after))
+}
+
+// JSONから昇格ルールを解析
+func ParsePromotionRules(b []byte) ([]*PromotionRule, error) {
+	rules := []*PromotionRule{}
+	if err := json.Unmarshal(b, &rules); err != nil {
+		return nil, err
+	}
+	for _, r := range rules {
+		if err := r.validate(); err != nil {
+			return nil, err
+		}
+	}
+	return rules, nil
+}
+
+// 受講履歴から現在のレベルになった日時を取得
+// 最後のレベルの変更が現在のレベルと一致しない場合はfalseを返す
+func LevelSince(events []Event, courseID string, level Level) (time.Time, bool) {
+	var last *Event
+	for i, e := range events {
+		if e.CourseID == courseID && e.Kind == LevelChanged {
+			last = &events[i]
+		}
+	}
+	if last == nil || last.Level != level {
+		return time.Time{}, false
+	}
+	return last.At, true
+}
@@ -0,0 +1,80 @@
+package internal_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/gw31415/pgautorole/course/internal"
+)
+
+func TestParsePromotionRules(t *testing.T) {
+	t.Run("Valid", func(t *testing.T) {
+		rules, err := internal.ParsePromotionRules([]byte(`[
+			{"course": "*", "from": "アプレンティス", "to": "アシスタント", "after": "30d", "unless": ["flagged"]},
+			{"course": "Go", "from": "アシスタント", "to": "ノーマル", "after": "8w"}
+		]`))
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if len(rules) != 2 {
+			t.Fatalf("unexpected length: %v", len(rules))
+		}
+		if !rules[0].Matches("123", "Web") || rules[1].Matches("123", "Web") || !rules[1].Matches("123", "Go") {
+			t.Fatalf("unexpected match")
+		}
+	})
+	t.Run("Invalid", func(t *testing.T) {
+		srcs := []string{
+			`[{"from": "アプレンティス", "to": "アシスタント", "after": "1d"}]`,
+			`[{"course": "*", "from": "見習い", "to": "アシスタント", "after": "1d"}]`,
+			`[{"course": "*", "from": "リード", "to": "ノーマル", "after": "1d"}]`,
+			`[{"course": "*", "from": "アプレンティス", "to": "アシスタント"}]`,
+			`[{"course": "*", "from": "アプレンティス", "to": "アシスタント", "after": "soon"}]`,
+		}
+		for _, src := range srcs {
+			if _, err := internal.ParsePromotionRules([]byte(src)); err == nil {
+				t.Fatalf("unexpected nil error for %s", src)
+			}
+		}
+	})
+}
+
+func TestPromotionDue(t *testing.T) {
+	rules, err := internal.ParsePromotionRules([]byte(`[{"course": "*", "from": "アプレンティス", "to": "アシスタント", "after": "30d", "unless": ["flagged"]}]`))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	r := rules[0]
+	now := time.Date(2024, 5, 1, 0, 0, 0, 0, time.UTC)
+	since := now.Add(-31 * 24 * time.Hour)
+	if !r.Due(internal.Apprentice, since, nil, now) {
+		t.Fatalf("expected due")
+	}
+	if r.Due(internal.Apprentice, now.Add(-29*24*time.Hour), nil, now) {
+		t.Fatalf("unexpected due before the tenure")
+	}
+	if r.Due(internal.Assistant, since, nil, now) {
+		t.Fatalf("unexpected due for another level")
+	}
+	if r.Due(internal.Apprentice, since, []string{"flagged"}, now) {
+		t.Fatalf("unexpected due for a flagged member")
+	}
+	if r.Due(internal.Apprentice, time.Time{}, nil, now) {
+		t.Fatalf("unexpected due without the level history")
+	}
+}
+
+func TestLevelSince(t *testing.T) {
+	at := time.Date(2024, 4, 1, 0, 0, 0, 0, time.UTC)
+	events := []internal.Event{
+		{At: at, CourseID: "go", Kind: internal.LevelChanged, Level: internal.Apprentice},
+		{At: at.Add(time.Hour), CourseID: "go", Kind: internal.LevelChanged, Level: internal.Assistant},
+		{At: at.Add(2 * time.Hour), CourseID: "web", Kind: internal.LevelChanged, Level: internal.Apprentice},
+	}
+	if since, ok := internal.LevelSince(events, "go", internal.Assistant); !ok || !since.Equal(at.Add(time.Hour)) {
+		t.Fatalf("unexpected since: %v", since)
+	}
+	if _, ok := internal.LevelSince(events, "go", internal.Apprentice); ok {
+		t.Fatalf("unexpected since for a past level")
+	}
+}
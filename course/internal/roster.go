@@ -0,0 +1,135 @@
+package internal
+
+import (
+	"bytes"
+	"cmp"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"slices"
+	"strings"
+)
+
+// 名簿の行
+type RosterEntry struct {
+	// ユーザーIDまたはユーザー名
+	User string `json:"user"`
+	// コース名
+	Course CourseName `json:"course"`
+	// レベル(省略時は登録済みなら現在のレベル、未登録ならアプレンティス)
+	Level Level `json:"level,omitempty"`
+}
+
+// CSVまたはJSONの名簿を解析
+// JSONは行の配列、CSVは user, course, level(省略可)の列を持つヘッダ付きの表
+func ParseRoster(b []byte) ([]RosterEntry, error) {
+	entries := []RosterEntry{}
+	trimmed := bytes.TrimSpace(b)
+	if bytes.HasPrefix(trimmed, []byte("[")) {
+		if err := json.Unmarshal(trimmed, &entries); err != nil {
+			return nil, err
+		}
+	} else {
+		records, err := csv.NewReader(bytes.NewReader(trimmed)).ReadAll()
+		if err != nil {
+			return nil, err
+		}
+		if len(records) == 0 {
+			return nil, fmt.Errorf("header is required")
+		}
+		cols := map[string]int{}
+		for i, name := range records[0] {
+			cols[strings.ToLower(strings.TrimSpace(name))] = i
+		}
+		userCol, okUser := cols["user"]
+		courseCol, okCourse := cols["course"]
+		if !okUser || !okCourse {
+			return nil, fmt.Errorf("user and course columns are required")
+		}
+		levelCol, okLevel := cols["level"]
+		for _, r := range records[1:] {
+			e := RosterEntry{User: strings.TrimSpace(r[userCol]), Course: CourseName(strings.TrimSpace(r[courseCol]))}
+			if okLevel {
+				e.Level = Level(strings.TrimSpace(r[levelCol]))
+			}
+			entries = append(entries, e)
+		}
+	}
+
+	seen := map[[2]string]bool{}
+	for i, e := range entries {
+		if e.User == "" || e.Course == "" {
+			return nil, fmt.Errorf("entry %d: user and course are required", i+1)
+		}
+		if e.Level != "" && LevelIndex(e.Level) < 0 {
+			return nil, fmt.Errorf("entry %d: unknown level %q", i+1, e.Level)
+		}
+		key := [2]string{e.User, string(e.Course)}
+		if seen[key] {
+			return nil, fmt.Errorf("entry %d: duplicated entry for %s in %s", i+1, e.User, e.Course)
+		}
+		seen[key] = true
+	}
+	return entries, nil
+}
+
+// 名簿をCSVに変換
+func FormatRosterCSV(entries []RosterEntry) []byte {
+	var b bytes.Buffer
+	w := csv.NewWriter(&b)
+	w.Write([]string{"user", "course", "level"})
+	for _, e := range entries {
+		w.Write([]string{e.User, string(e.Course), string(e.Level)})
+	}
+	w.Flush()
+	return b.Bytes()
+}
+
+// ユーザーIDからコース名とレベルへのマップ
+// レベルが空の場合はレベルを問わない
+type Membership map[string]map[CourseName]Level
+
+// 名簿の反映による変更
+type RosterChange struct {
+	UserID string
+	Course CourseName
+	// 変更前後のレベル(空の場合は未登録)
+	From, To Level
+}
+
+// 名簿を反映するための変更を計画する
+// 名簿に含まれるコースについては名簿が正しいものとし、名簿にないメンバーはコースから外す
+func PlanRoster(desired, current Membership) []RosterChange {
+	courses := map[CourseName]bool{}
+	users := map[string]bool{}
+	for u, cs := range desired {
+		users[u] = true
+		for c := range cs {
+			courses[c] = true
+		}
+	}
+	for u := range current {
+		users[u] = true
+	}
+
+	changes := []RosterChange{}
+	for u := range users {
+		for c := range courses {
+			from := current[u][c]
+			to, listed := desired[u][c]
+			switch {
+			case !listed:
+				to = ""
+			case to == "":
+				to = cmp.Or(from, Apprentice)
+			}
+			if from != to {
+				changes = append(changes, RosterChange{u, c, from, to})
+			}
+		}
+	}
+	slices.SortFunc(changes, func(a, b RosterChange) int {
+		return cmp.Or(strings.Compare(string(a.Course), string(b.Course)), strings.Compare(a.UserID, b.UserID))
+	})
+	return changes
+}
@@ -0,0 +1,66 @@
+package internal_test
+
+import (
+	"slices"
+	"testing"
+
+	"github.com/gw31415/pgautorole/course/internal"
+)
+
+func TestParseRoster(t *testing.T) {
+	t.Run("CSV", func(t *testing.T) {
+		entries, err := internal.ParseRoster([]byte("user,course,level\n123,Go,リード\nalice,Go,\n"))
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		expected := []internal.RosterEntry{{"123", "Go", internal.Lead}, {"alice", "Go", ""}}
+		if !slices.Equal(entries, expected) {
+			t.Fatalf("unexpected entries: %v", entries)
+		}
+	})
+	t.Run("JSON", func(t *testing.T) {
+		entries, err := internal.ParseRoster([]byte(`[{"user": "123", "course": "Go", "level": "ノーマル"}]`))
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if len(entries) != 1 || entries[0].Level != internal.Normal {
+			t.Fatalf("unexpected entries: %v", entries)
+		}
+	})
+	t.Run("Invalid", func(t *testing.T) {
+		srcs := []string{
+			"name,course\n123,Go\n",
+			"user,course\n,Go\n",
+			"user,course,level\n123,Go,見習い\n",
+			"user,course\n123,Go\n123,Go\n",
+			`[{"user": "123"}]`,
+		}
+		for _, src := range srcs {
+			if _, err := internal.ParseRoster([]byte(src)); err == nil {
+				t.Fatalf("unexpected nil error for %s", src)
+			}
+		}
+	})
+}
+
+func TestPlanRoster(t *testing.T) {
+	desired := internal.Membership{
+		"a": {"Go": internal.Lead},
+		"b": {"Go": ""},
+		"c": {"Go": ""},
+	}
+	current := internal.Membership{
+		"a": {"Go": internal.Normal},
+		"b": {"Go": internal.Assistant},
+		"d": {"Go": internal.Apprentice, "Web": internal.Lead},
+	}
+	changes := internal.PlanRoster(desired, current)
+	expected := []internal.RosterChange{
+		{UserID: "a", Course: "Go", From: internal.Normal, To: internal.Lead},
+		{UserID: "c", Course: "Go", From: "", To: internal.Apprentice},
+		{UserID: "d", Course: "Go", From: internal.Apprentice, To: ""},
+	}
+	if !slices.Equal(changes, expected) {
+		t.Fatalf("unexpected changes: %v", changes)
+	}
+}
@@ -0,0 +1,65 @@
+package internal
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// ロールの見た目の設定
+type RoleStyle struct {
+	// "#RRGGBB" 形式の色
+	Color string `json:"color,omitempty"`
+	// メンバーを別に表示するかどうか
+	Hoist bool `json:"hoist,omitempty"`
+	// メンション可能かどうか
+	Mentionable bool `json:"mentionable,omitempty"`
+}
+
+// 色を数値で取得
+func (s *RoleStyle) ColorValue() (int, error) {
+	if s.Color == "" {
+		return 0, nil
+	}
+	v, err := strconv.ParseInt(strings.TrimPrefix(s.Color, "#"), 16, 32)
+	if err != nil || v < 0 || v > 0xFFFFFF {
+		return 0, fmt.Errorf("invalid color %q", s.Color)
+	}
+	return int(v), nil
+}
+
+// コース作成時のロールの設定
+type RoleTemplate struct {
+	// コースロールの設定
+	Course RoleStyle `json:"course"`
+	// レベルごとのコースレベルロールの設定
+	Levels map[Level]RoleStyle `json:"levels,omitempty"`
+	// 作成したロールをこのロールの直下に配置する(空の場合は最下部、botの最上位のロールより上には配置しない)
+	BelowRoleID string `json:"below_role_id,omitempty"`
+}
+
+// 指定したレベルの設定を取得
+func (t *RoleTemplate) Level(l Level) RoleStyle {
+	return t.Levels[l]
+}
+
+// JSONからロールの設定を解析
+func ParseRoleTemplate(b []byte) (*RoleTemplate, error) {
+	t := &RoleTemplate{}
+	if err := json.Unmarshal(b, t); err != nil {
+		return nil, err
+	}
+	if _, err := t.Course.ColorValue(); err != nil {
+		return nil, err
+	}
+	for l, style := range t.Levels {
+		if LevelIndex(l) < 0 {
+			return nil, fmt.Errorf("unknown level %q", l)
+		}
+		if _, err := style.ColorValue(); err != nil {
+			return nil, err
+		}
+	}
+	return t, nil
+}
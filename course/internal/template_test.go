@@ -0,0 +1,52 @@
+package internal_test
+
+import (
+	"testing"
+
+	"github.com/gw31415/pgautorole/course/internal"
+)
+
+func TestParseRoleTemplate(t *testing.T) {
+	t.Run("Valid", func(t *testing.T) {
+		tmpl, err := internal.ParseRoleTemplate([]byte(`{
+			"course": {"color": "#3498db", "hoist": true, "mentionable": true},
+			"levels": {"リード": {"color": "e67e22"}},
+			"below_role_id": "123"
+		}`))
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if c, _ := tmpl.Course.ColorValue(); c != 0x3498db {
+			t.Fatalf("unexpected color: %x", c)
+		}
+		lead := tmpl.Level(internal.Lead)
+		if c, _ := lead.ColorValue(); c != 0xe67e22 {
+			t.Fatalf("unexpected color: %x", c)
+		}
+		apprentice := tmpl.Level(internal.Apprentice)
+		if c, _ := apprentice.ColorValue(); c != 0 {
+			t.Fatalf("unexpected color: %x", c)
+		}
+	})
+	t.Run("Invalid", func(t *testing.T) {
+		srcs := []string{
+			`{"course": {"color": "blue"}}`,
+			`{"levels": {"マスター": {}}}`,
+			`{"levels": {"リード": {"color": "#1000000"}}}`,
+		}
+		for _, src := range srcs {
+			if _, err := internal.ParseRoleTemplate([]byte(src)); err == nil {
+				t.Fatalf("unexpected nil error for %s", src)
+			}
+		}
+	})
+}
+
+func TestLevelIndex(t *testing.T) {
+	if internal.LevelIndex(internal.Apprentice) != 0 || internal.LevelIndex(internal.Lead) != 3 {
+		t.Fatalf("unexpected order")
+	}
+	if internal.LevelIndex(internal.Level("unknown")) != -1 {
+		t.Fatalf("unexpected index for unknown level")
+	}
+}
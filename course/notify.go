@@ -0,0 +1,220 @@
+package course
+
+import (
+	"fmt"
+	"log/slog"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+	"github.com/gw31415/pgautorole/course/internal"
+	"github.com/gw31415/pgautorole/internal/command"
+	"github.com/gw31415/pgautorole/internal/utils"
+)
+
+// 最後の変更から通知するまでの待機時間(この間の変更はまとめて通知する)
+const NOTIFY_BATCH_DELAY = 10 * time.Second
+
+// 最初の変更から通知するまでの最大の待機時間(変更が続いても通知が遅れ続けないようにする)
+const NOTIFY_MAX_DELAY = 6 * NOTIFY_BATCH_DELAY
+
+// 通知の本文の最大バイト数(Discordのメッセージの上限に収まるようにする)
+const NOTIFY_MAX_LENGTH = 1800
+
+// 通知待ちの受講状況の変更
+type notice struct {
+	userID string
+	event  internal.Event
+}
+
+// 通知先が設定されていれば、受講状況の変更を通知待ちに追加する
+func (m *courseManager) notify(s *discordgo.Session, userID string, events []internal.Event) {
+	for _, e := range events {
+		def := m.definition(e.CourseID)
+		if def == nil || (def.NotifyChannelID == "" && !def.NotifyLeads) {
+			continue
+		}
+
+		m.notifySync.Lock()
+		courseID := e.CourseID
+		if len(m.notices[courseID]) == 0 {
+			m.noticeSince[courseID] = time.Now()
+		}
+		m.notices[courseID] = append(m.notices[courseID], notice{userID, e})
+		if t := m.noticeTimers[courseID]; t != nil {
+			t.Stop()
+		}
+		// 最初の変更からNOTIFY_MAX_DELAYを過ぎる場合は、それ以上待たずに通知する
+		delay := min(NOTIFY_BATCH_DELAY, max(NOTIFY_MAX_DELAY-time.Since(m.noticeSince[courseID]), 0))
+		m.noticeTimers[courseID] = time.AfterFunc(delay, func() {
+			m.flushNotices(s, courseID)
+		})
+		m.notifySync.Unlock()
+	}
+}
+
+// 通知待ちの変更をまとめて通知する
+func (m *courseManager) flushNotices(s *discordgo.Session, courseID string) {
+	m.notifySync.Lock()
+	notices := m.notices[courseID]
+	delete(m.notices, courseID)
+	delete(m.noticeSince, courseID)
+	delete(m.noticeTimers, courseID)
+	m.notifySync.Unlock()
+
+	def := m.definition(courseID)
+	if def == nil || len(notices) == 0 {
+		return
+	}
+	m.guildsync.RLock()
+	name, leadID := courseID, ""
+	if r := m.roles[courseID]; r != nil {
+		name = r.Name
+	}
+	if m.RoleIDRepository != nil {
+		if course, ok := m.FindID(courseID).(*internal.CourseRoleID); ok {
+			leadID = course.GetCourseLevelIDs()[internal.LevelIndex(internal.Lead)].String()
+		}
+	}
+	m.guildsync.RUnlock()
+
+	content := formatNotices(name, notices)
+	if def.NotifyChannelID != "" {
+		_, err := s.ChannelMessageSendComplex(def.NotifyChannelID, &discordgo.MessageSend{
+			Content: content,
+			// 変更のあったメンバーにメンションを飛ばさない
+			AllowedMentions: &discordgo.MessageAllowedMentions{},
+		})
+		if err != nil {
+			slog.Error("Failed to post course notification", "COURSE", courseID, "err", err)
+		}
+	}
+	if def.NotifyLeads && leadID != "" {
+		for _, userID := range m.roleMembers(s, leadID) {
+			if err := utils.SendDirectMessage(s, userID, content); err != nil {
+				slog.Warn("Failed to notify course lead", "USER", userID, "err", err)
+			}
+		}
+	}
+}
+
+// ロールを持つメンバーのユーザーIDを返す
+// 通知のたびにメンバーの一覧を取得しないよう、ステートに全てのメンバーが保持されていればAPIは呼ばない
+func (m *courseManager) roleMembers(s *discordgo.Session, roleID string) []string {
+	if userIDs, ok := m.cachedRoleMembers(s, roleID); ok {
+		return userIDs
+	}
+	userIDs := []string{}
+	err := utils.ForEachMemberPage(s, m.guildID, func(members []*discordgo.Member) {
+		for _, member := range members {
+			if slices.Contains(member.Roles, roleID) {
+				userIDs = append(userIDs, member.User.ID)
+			}
+		}
+	})
+	if err != nil {
+		slog.Error("Failed to get members", "err", err)
+	}
+	return userIDs
+}
+
+// ステートに保持されているメンバーのうち、ロールを持つメンバーのユーザーIDを返す
+// ステートに全てのメンバーが保持されていない場合はfalseを返す
+func (m *courseManager) cachedRoleMembers(s *discordgo.Session, roleID string) ([]string, bool) {
+	if !s.StateEnabled || s.State == nil {
+		return nil, false
+	}
+	g, err := s.State.Guild(m.guildID)
+	if err != nil {
+		slog.Warn("Guild is not cached, fetching members", "GUILD", m.guildID, "err", err)
+		return nil, false
+	}
+	s.State.RLock()
+	defer s.State.RUnlock()
+	if len(g.Members) < g.MemberCount {
+		slog.Warn("Guild members are not fully cached, fetching members", "GUILD", m.guildID, "CACHED", len(g.Members), "MEMBERS", g.MemberCount)
+		return nil, false
+	}
+	userIDs := []string{}
+	for _, member := range g.Members {
+		if member.User != nil && slices.Contains(member.Roles, roleID) {
+			userIDs = append(userIDs, member.User.ID)
+		}
+	}
+	return userIDs, true
+}
+
+// 通知の本文
+// メンバーごとに変更をまとめ、変更が複数ある場合は件数を見出しにする
+func formatNotices(course string, notices []notice) string {
+	users := []string{}
+	changes := map[string][]string{}
+	for _, n := range notices {
+		if _, ok := changes[n.userID]; !ok {
+			users = append(users, n.userID)
+		}
+		changes[n.userID] = append(changes[n.userID], describeEvent(n.event))
+	}
+	if len(users) == 1 {
+		return fmt.Sprintf("コース「%s」: <@%s> %s", course, users[0], strings.Join(changes[users[0]], " → "))
+	}
+	lines := []string{fmt.Sprintf("コース「%s」: %d人の受講状況が変わりました", course, len(users))}
+	length := len(lines[0])
+	for i, u := range users {
+		line := fmt.Sprintf("- <@%s> %s", u, strings.Join(changes[u], " → "))
+		// メッセージの文字数の上限を超えないよう省略する
+		if length += len(line) + 1; length > NOTIFY_MAX_LENGTH {
+			lines = append(lines, fmt.Sprintf("- 他%d人", len(users)-i))
+			break
+		}
+		lines = append(lines, line)
+	}
+	return strings.Join(lines, "\n")
+}
+
+func (m *courseManager) registerNotifyCommands(r *command.Router) {
+	r.Subcommand(courseCommand, &discordgo.ApplicationCommandOption{
+		Name:        "notify",
+		Description: "受講者の登録・離脱・レベルの変更の通知先を設定",
+		Options: []*discordgo.ApplicationCommandOption{courseNameOption, {
+			Type:         discordgo.ApplicationCommandOptionChannel,
+			Name:         "channel",
+			Description:  "通知するチャンネル(省略時はチャンネルに通知しない)",
+			ChannelTypes: []discordgo.ChannelType{discordgo.ChannelTypeGuildText},
+		}, {
+			Type:        discordgo.ApplicationCommandOptionBoolean,
+			Name:        "leads",
+			Description: "リードのロールを持つメンバーにDMで通知する",
+		}},
+	}, func(s *discordgo.Session, i *discordgo.InteractionCreate, opts command.Options) {
+		name := internal.CourseName(opts.String("name"))
+		channelID := opts.ID("channel")
+		leads := opts.Bool("leads")
+		course := m.findCourse(name)
+		if course == nil {
+			command.Respond(s, i, fmt.Sprintf("コース %q が見つかりません。", name))
+			return
+		}
+		err := m.updateDefinition(course.String(), func(def *CourseDefinition) {
+			def.NotifyChannelID = channelID
+			def.NotifyLeads = leads
+		})
+		if err != nil {
+			command.Respond(s, i, "通知先の設定に失敗しました: "+err.Error())
+			return
+		}
+		targets := []string{}
+		if channelID != "" {
+			targets = append(targets, fmt.Sprintf("<#%s>", channelID))
+		}
+		if leads {
+			targets = append(targets, "リードへのDM")
+		}
+		if len(targets) == 0 {
+			command.Respond(s, i, fmt.Sprintf("コース %q の通知を停止しました。", name))
+			return
+		}
+		command.Respond(s, i, fmt.Sprintf("コース %q の通知先を %s に設定しました。", name, strings.Join(targets, "、")))
+	})
+}
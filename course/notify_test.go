@@ -0,0 +1,55 @@
+package course_test
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/gw31415/pgautorole/course"
+	"github.com/gw31415/pgautorole/course/internal"
+)
+
+func TestFormatNotices(t *testing.T) {
+	enrolled := internal.Event{CourseID: "c0", Kind: internal.Enrolled}
+	level := internal.Event{CourseID: "c0", Kind: internal.LevelChanged, Level: internal.Assistant}
+	left := internal.Event{CourseID: "c0", Kind: internal.Left}
+
+	// 1人の変更は1行にまとめる
+	got := course.FormatNotices("Go", []course.Notice{course.NewNotice("u0", enrolled), course.NewNotice("u0", level)})
+	if want := "コース「Go」: <@u0> 登録 → レベル: アシスタント"; got != want {
+		t.Fatalf("unexpected notice: %q", got)
+	}
+
+	// 複数人の変更はメンバーごとに1行にまとめ、人数を見出しにする
+	got = course.FormatNotices("Go", []course.Notice{
+		course.NewNotice("u0", enrolled),
+		course.NewNotice("u1", left),
+		course.NewNotice("u0", level),
+	})
+	want := strings.Join([]string{
+		"コース「Go」: 2人の受講状況が変わりました",
+		"- <@u0> 登録 → レベル: アシスタント",
+		"- <@u1> 離脱",
+	}, "\n")
+	if got != want {
+		t.Fatalf("unexpected notice: %q", got)
+	}
+
+	// 上限を超える場合は残りの人数に省略する
+	notices := []course.Notice{}
+	for i := range 200 {
+		notices = append(notices, course.NewNotice(fmt.Sprintf("user%03d", i), enrolled))
+	}
+	got = course.FormatNotices("Go", notices)
+	if len(got) > course.NOTIFY_MAX_LENGTH {
+		t.Fatalf("notice too long: %d", len(got))
+	}
+	lines := strings.Split(got, "\n")
+	shown := len(lines) - 2
+	if want := fmt.Sprintf("- 他%d人", 200-shown); lines[len(lines)-1] != want {
+		t.Fatalf("unexpected last line: %q, want %q", lines[len(lines)-1], want)
+	}
+	if lines[1] != "- <@user000> 登録" || lines[shown] != fmt.Sprintf("- <@user%03d> 登録", shown-1) {
+		t.Fatalf("unexpected lines: %q", lines[:shown+1])
+	}
+}
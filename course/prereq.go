@@ -0,0 +1,240 @@
+package course
+
+import (
+	"fmt"
+	"log/slog"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+	"github.com/gw31415/pgautorole/course/internal"
+	"github.com/gw31415/pgautorole/internal/command"
+	"github.com/gw31415/pgautorole/internal/utils"
+)
+
+// 受講条件
+type Prerequisite struct {
+	// 条件となるコースのコースロールID
+	CourseID string `json:"course_id"`
+	// 必要なレベル(このレベル以上)
+	MinLevel internal.Level `json:"min_level"`
+	// 条件を追加した日時(それ以前からコースに在籍しているメンバーには適用しない)
+	AddedAt time.Time `json:"added_at,omitempty"`
+}
+
+// 受講条件を満たさない場合の対応
+type Enforcement string
+
+const (
+	// コースロールの追加を取り消す
+	EnforceRevert Enforcement = "revert"
+	// メンバーに警告する
+	EnforceWarn Enforcement = "warn"
+	// ログに記録するのみ
+	EnforceReport Enforcement = "report"
+)
+
+// 受講条件を満たさない場合の対応(省略時は取り消し)
+func (d *CourseDefinition) PrerequisiteEnforcement() Enforcement {
+	if d.Enforcement == "" {
+		return EnforceRevert
+	}
+	return d.Enforcement
+}
+
+// 受講条件を追加する前からコースに在籍しているかどうか
+// 受講履歴に登録が記録されていないメンバーは、追加日時が記録された条件より前から在籍しているものとする
+// (コースロールが付与された直後のメンバーは、まだ登録が記録されていないためこの関数で判定しない)
+func (m *courseManager) grandfathered(userID, courseID string, p Prerequisite) bool {
+	if p.AddedAt.IsZero() {
+		return false
+	}
+	var events []internal.Event
+	m.history.View(func(h *CourseHistory) {
+		events = (*h)[userID]
+	})
+	enrolledAt, ok := internal.EnrolledAt(events, courseID)
+	return !ok || enrolledAt.Before(p.AddedAt)
+}
+
+// メンバーが満たしていない受講条件を取得
+// 条件を追加する前から在籍しているメンバーには、その条件を適用しない
+// justEnrolledはコースロールが付与された直後かどうか(直後の場合は全ての条件を適用する)
+// guildsyncのロックを取得した状態で呼び出す
+func (m *courseManager) unmetPrerequisites(member *discordgo.Member, courseID string, def *CourseDefinition, justEnrolled bool) []Prerequisite {
+	unmet := []Prerequisite{}
+	for _, p := range def.Prerequisites {
+		if !justEnrolled && m.grandfathered(member.User.ID, courseID, p) {
+			continue
+		}
+		course, ok := m.FindID(p.CourseID).(*internal.CourseRoleID)
+		if !ok {
+			// 条件となるコースが見つからない場合は満たしていないものとする
+			unmet = append(unmet, p)
+			continue
+		}
+		levelIDs := utils.SlicesMap(course.GetCourseLevelIDs(), (*internal.CourseLevelRoleID).String)
+		if !internal.HasLevelAtLeast(member.Roles, levelIDs, p.MinLevel) {
+			unmet = append(unmet, p)
+		}
+	}
+	return unmet
+}
+
+// 受講条件の説明文
+// guildsyncのロックを取得した状態で呼び出す
+func (m *courseManager) describePrerequisites(prereqs []Prerequisite) string {
+	descs := utils.SlicesMap(prereqs, func(p Prerequisite) string {
+		name := p.CourseID
+		if r := m.roles[p.CourseID]; r != nil {
+			name = r.Name
+		}
+		return fmt.Sprintf("「%s」の%s以上", name, p.MinLevel)
+	})
+	return strings.Join(descs, "、")
+}
+
+// コースロールを持つメンバーが受講条件を満たしているか検査し、設定に応じて対応してメンバーに通知する
+// justEnrolledはコースロールが付与された直後かどうか(直後の場合は条件の追加前からの在籍とみなさず、取り消しは受講履歴に記録しない)
+// 取り消した場合はtrueを返す
+// guildsyncのロックを取得した状態で呼び出す
+func (m *courseManager) enforcePrerequisites(s *discordgo.Session, member *discordgo.Member, courseID string, justEnrolled bool) bool {
+	def := m.definition(courseID)
+	if def == nil || len(def.Prerequisites) == 0 {
+		return false
+	}
+	unmet := m.unmetPrerequisites(member, courseID, def, justEnrolled)
+	if len(unmet) == 0 {
+		return false
+	}
+	name := m.roles[courseID].Name
+	desc := m.describePrerequisites(unmet)
+	enforcement := def.PrerequisiteEnforcement()
+	slog.Warn("Course prerequisites not met", "USER", member.User.ID, "USER_NAME", member.User.GlobalName, "COURSE", courseID, "ENFORCEMENT", enforcement, "UNMET", desc)
+
+	msg := ""
+	switch enforcement {
+	case EnforceRevert:
+		if justEnrolled {
+			m.markBotChange(member.User.ID, courseID, revertChange)
+		}
+		if err := s.GuildMemberRoleRemove(m.guildID, member.User.ID, courseID); err != nil {
+			slog.Error("Failed to revert course role", "USER", member.User.ID, "COURSE", courseID, "err", err)
+			m.takeBotChange(member.User.ID, courseID)
+			return false
+		}
+		msg = fmt.Sprintf("コース「%s」の受講条件(%s)を満たしていないため、コースの登録を取り消しました。", name, desc)
+	case EnforceWarn:
+		msg = fmt.Sprintf("コース「%s」の受講条件(%s)を満たしていません。", name, desc)
+	}
+	if msg != "" {
+		if err := utils.SendDirectMessage(s, member.User.ID, msg); err != nil {
+			slog.Warn("Failed to notify member", "USER", member.User.ID, "err", err)
+		}
+	}
+	return enforcement == EnforceRevert
+}
+
+// レベルの選択肢
+var levelChoices = utils.SlicesMap(internal.Levels(), func(l internal.Level) *discordgo.ApplicationCommandOptionChoice {
+	return &discordgo.ApplicationCommandOptionChoice{Name: string(l), Value: string(l)}
+})
+
+func (m *courseManager) registerPrerequisiteCommands(r *command.Router) {
+	requiredOption := &discordgo.ApplicationCommandOption{
+		Type:        discordgo.ApplicationCommandOptionString,
+		Name:        "required",
+		Description: "条件となるコース名",
+		Required:    true,
+	}
+	r.Subcommand(courseCommand, &discordgo.ApplicationCommandOption{
+		Name:        "require",
+		Description: "コースの受講条件を追加・変更",
+		Options: []*discordgo.ApplicationCommandOption{courseNameOption, requiredOption, {
+			Type:        discordgo.ApplicationCommandOptionString,
+			Name:        "level",
+			Description: "必要なレベル(このレベル以上)",
+			Required:    true,
+			Choices:     levelChoices,
+		}},
+	}, func(s *discordgo.Session, i *discordgo.InteractionCreate, opts command.Options) {
+		name := internal.CourseName(opts.String("name"))
+		required := internal.CourseName(opts.String("required"))
+		level := internal.Level(opts.String("level"))
+		course, req := m.findCourse(name), m.findCourse(required)
+		if course == nil || req == nil {
+			command.Respond(s, i, "コースが見つかりません。")
+			return
+		}
+		if course.String() == req.String() {
+			command.Respond(s, i, "自身を受講条件にすることはできません。")
+			return
+		}
+		err := m.updateDefinition(course.String(), func(def *CourseDefinition) {
+			def.Prerequisites = slices.DeleteFunc(def.Prerequisites, func(p Prerequisite) bool {
+				return p.CourseID == req.String()
+			})
+			def.Prerequisites = append(def.Prerequisites, Prerequisite{req.String(), level, time.Now()})
+		})
+		if err != nil {
+			command.Respond(s, i, "受講条件の設定に失敗しました: "+err.Error())
+			return
+		}
+		command.Respond(s, i, fmt.Sprintf("コース %q の受講条件に「%s」の%s以上を設定しました。", name, required, level))
+	})
+	r.Subcommand(courseCommand, &discordgo.ApplicationCommandOption{
+		Name:        "unrequire",
+		Description: "コースの受講条件を削除",
+		Options:     []*discordgo.ApplicationCommandOption{courseNameOption, requiredOption},
+	}, func(s *discordgo.Session, i *discordgo.InteractionCreate, opts command.Options) {
+		name := internal.CourseName(opts.String("name"))
+		required := internal.CourseName(opts.String("required"))
+		course, req := m.findCourse(name), m.findCourse(required)
+		if course == nil || req == nil {
+			command.Respond(s, i, "コースが見つかりません。")
+			return
+		}
+		err := m.updateDefinition(course.String(), func(def *CourseDefinition) {
+			def.Prerequisites = slices.DeleteFunc(def.Prerequisites, func(p Prerequisite) bool {
+				return p.CourseID == req.String()
+			})
+		})
+		if err != nil {
+			command.Respond(s, i, "受講条件の削除に失敗しました: "+err.Error())
+			return
+		}
+		command.Respond(s, i, fmt.Sprintf("コース %q の受講条件から %q を削除しました。", name, required))
+	})
+	r.Subcommand(courseCommand, &discordgo.ApplicationCommandOption{
+		Name:        "enforcement",
+		Description: "受講条件を満たさない場合の対応を設定",
+		Options: []*discordgo.ApplicationCommandOption{courseNameOption, {
+			Type:        discordgo.ApplicationCommandOptionString,
+			Name:        "mode",
+			Description: "対応",
+			Required:    true,
+			Choices: []*discordgo.ApplicationCommandOptionChoice{
+				{Name: "取り消し", Value: string(EnforceRevert)},
+				{Name: "警告", Value: string(EnforceWarn)},
+				{Name: "記録のみ", Value: string(EnforceReport)},
+			},
+		}},
+	}, func(s *discordgo.Session, i *discordgo.InteractionCreate, opts command.Options) {
+		name := internal.CourseName(opts.String("name"))
+		mode := Enforcement(opts.String("mode"))
+		course := m.findCourse(name)
+		if course == nil {
+			command.Respond(s, i, fmt.Sprintf("コース %q が見つかりません。", name))
+			return
+		}
+		err := m.updateDefinition(course.String(), func(def *CourseDefinition) {
+			def.Enforcement = mode
+		})
+		if err != nil {
+			command.Respond(s, i, "対応の設定に失敗しました: "+err.Error())
+			return
+		}
+		command.Respond(s, i, fmt.Sprintf("コース %q の受講条件を満たさない場合の対応を %s に設定しました。", name, mode))
+	})
+}
@@ -0,0 +1,145 @@
+package course
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+	"github.com/gw31415/pgautorole/course/internal"
+	"github.com/gw31415/pgautorole/internal/command"
+	"github.com/gw31415/pgautorole/internal/utils"
+)
+
+// 在籍期間に基づくレベルの昇格ルール
+type PromotionRule = internal.PromotionRule
+
+// JSONファイルから昇格ルールを読み込む
+// pathが空の場合はnilを返す(自動昇格しない)
+func LoadPromotionRules(path string) ([]*PromotionRule, error) {
+	if path == "" {
+		return nil, nil
+	}
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return internal.ParsePromotionRules(b)
+}
+
+// 昇格の対象となるメンバー
+type promotion struct {
+	member   *discordgo.Member
+	course   string
+	from, to internal.Level
+	// 昇格前のレベルになった日時
+	since time.Time
+}
+
+// 昇格ルールに該当するメンバーを列挙する
+// 自動処理の対象としたメンバー数も返す
+func (m *courseManager) pendingPromotions(s *discordgo.Session) ([]promotion, int, error) {
+	if len(m.promotionRules) == 0 {
+		return nil, 0, nil
+	}
+	var history CourseHistory
+	m.history.View(func(h *CourseHistory) {
+		history = make(CourseHistory, len(*h))
+		for id, es := range *h {
+			history[id] = slices.Clone(es)
+		}
+	})
+
+	now := time.Now()
+	pending := []promotion{}
+	total := 0
+	err := utils.ForEachMemberPage(s, m.guildID, func(members []*discordgo.Member) {
+		m.guildsync.RLock()
+		defer m.guildsync.RUnlock()
+		if m.RoleIDRepository == nil {
+			return
+		}
+		for _, member := range members {
+			if m.filter.Skip(member) != utils.NotSkipped {
+				continue
+			}
+			total++
+			for _, id := range m.FilterIDs(member.Roles) {
+				course, ok := id.(*internal.CourseRoleID)
+				if !ok {
+					continue
+				}
+				levelIDs := utils.SlicesMap(course.GetCourseLevelIDs(), (*internal.CourseLevelRoleID).String)
+				level := internal.HighestLevel(member.Roles, levelIDs)
+				since, _ := internal.LevelSince(history[member.User.ID], course.String(), level)
+				for _, r := range m.promotionRules {
+					if !r.Matches(course.String(), m.roles[course.String()].Name) || !r.Due(level, since, member.Roles, now) {
+						continue
+					}
+					pending = append(pending, promotion{
+						member: member,
+						course: m.roles[course.String()].Name,
+						from:   level,
+						to:     r.To,
+						since:  since,
+					})
+					break
+				}
+			}
+		}
+	})
+	return pending, total, err
+}
+
+func (m *courseManager) PromoteMembers(s *discordgo.Session) {
+	pending, total, err := m.pendingPromotions(s)
+	if err != nil {
+		slog.Error("Failed to list pending promotions", "err", err)
+		return
+	}
+	// 昇格するメンバーが多すぎる場合は設定の誤りとみなして昇格しない
+	if !m.bulkAllowed("コースレベルの自動昇格", len(pending), total) {
+		slog.Warn("Course promotions aborted", "PENDING", len(pending), "MEMBERS", total)
+		return
+	}
+	promoted := 0
+	for _, p := range pending {
+		// 重複の解決方針によらず昇格後のレベルだけが残るよう、昇格前のレベルの削除と昇格後のレベルの追加を1回で行う
+		change := internal.RosterChange{UserID: p.member.User.ID, Course: internal.CourseName(p.course), From: p.from, To: p.to}
+		if err := m.applyRosterChange(s, change); err != nil {
+			slog.Error("Failed to promote member", "USER", p.member.User.ID, "COURSE_NAME", p.course, "err", err)
+			continue
+		}
+		slog.Info("Member promoted", "USER", p.member.User.ID, "USER_NAME", p.member.User.GlobalName, "COURSE_NAME", p.course, "FROM", p.from, "TO", p.to)
+		promoted++
+	}
+	slog.Info("Members promoted", "PROMOTED", promoted, "PENDING", len(pending))
+}
+
+func (m *courseManager) registerPromotionCommands(r *command.Router) {
+	r.Subcommand(courseCommand, &discordgo.ApplicationCommandOption{
+		Name:        "promotions",
+		Description: "昇格ルールにより次回昇格するメンバーを表示",
+	}, func(s *discordgo.Session, i *discordgo.InteractionCreate, opts command.Options) {
+		command.Deferred(s, i, func() string {
+			if len(m.promotionRules) == 0 {
+				return "昇格ルールが設定されていません。"
+			}
+			pending, _, err := m.pendingPromotions(s)
+			if err != nil {
+				return "昇格するメンバーの取得に失敗しました: " + err.Error()
+			}
+			if len(pending) == 0 {
+				return "昇格するメンバーはいません。"
+			}
+			lines := []string{fmt.Sprintf("次回昇格するメンバー(%d人)", len(pending))}
+			for _, p := range pending {
+				lines = append(lines, fmt.Sprintf("- <@%s> %s: %s → %s(%sから)", p.member.User.ID, p.course, p.from, p.to, p.since.Local().Format(time.DateOnly)))
+			}
+			return strings.Join(lines, "\n")
+		})
+	})
+}
@@ -0,0 +1,388 @@
+package course
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"slices"
+	"strings"
+
+	"github.com/bwmarrin/discordgo"
+	"github.com/gw31415/pgautorole/course/internal"
+	"github.com/gw31415/pgautorole/internal/command"
+)
+
+// コース作成時のロールの設定
+type RoleTemplate = internal.RoleTemplate
+
+// JSONファイルからコース作成時のロールの設定を読み込む
+// pathが空の場合は既定の設定を返す
+func LoadRoleTemplate(path string) (*RoleTemplate, error) {
+	if path == "" {
+		return &RoleTemplate{}, nil
+	}
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return internal.ParseRoleTemplate(b)
+}
+
+// ロールの設定からロール作成時のパラメータを生成
+func roleParams(name string, style internal.RoleStyle) *discordgo.RoleParams {
+	color, _ := style.ColorValue()
+	return &discordgo.RoleParams{
+		Name:        name,
+		Color:       &color,
+		Hoist:       &style.Hoist,
+		Mentionable: &style.Mentionable,
+	}
+}
+
+// 既存のロールからロール再作成時のパラメータを生成
+func roleParamsOf(r *discordgo.Role) *discordgo.RoleParams {
+	return &discordgo.RoleParams{
+		Name:        r.Name,
+		Color:       &r.Color,
+		Hoist:       &r.Hoist,
+		Mentionable: &r.Mentionable,
+		Permissions: &r.Permissions,
+	}
+}
+
+// コース名として使用可能か検証
+func validateCourseName(name internal.CourseName) error {
+	if strings.TrimSpace(string(name)) == "" {
+		return errors.New("コース名が空です")
+	}
+	if internal.ParseCourseLevel(string(name)) != nil {
+		return fmt.Errorf("コース名 %q はコースレベルのロール名と区別できません", name)
+	}
+	return nil
+}
+
+// コース名に対応する全てのロール名(コースロール, 高いレベルから順にコースレベルロール)
+func courseRoleNames(name internal.CourseName) []string {
+	names := []string{string(name)}
+	cls := name.CourseLevelNames()
+	for i := len(cls) - 1; i >= 0; i-- {
+		names = append(names, cls[i].String())
+	}
+	return names
+}
+
+// 既存のロールに指定した名前のものがあればエラーを返す
+func checkNameConflicts(roles []*discordgo.Role, names []string, ignoreIDs ...string) error {
+	for _, r := range roles {
+		if slices.Contains(names, r.Name) && !slices.Contains(ignoreIDs, r.ID) {
+			return fmt.Errorf("ロール %q が既に存在します", r.Name)
+		}
+	}
+	return nil
+}
+
+// コースの全てのロールを作成
+// 途中で失敗した場合は作成済みのロールを削除する
+func (m *courseManager) createCourse(s *discordgo.Session, name internal.CourseName) error {
+	if err := validateCourseName(name); err != nil {
+		return err
+	}
+	roles, err := s.GuildRoles(m.guildID)
+	if err != nil {
+		return err
+	}
+	names := courseRoleNames(name)
+	if err := checkNameConflicts(roles, names); err != nil {
+		return err
+	}
+
+	created := []*discordgo.Role{}
+	rollback := func() {
+		for _, r := range created {
+			if err := s.GuildRoleDelete(m.guildID, r.ID); err != nil {
+				slog.Error("Failed to roll back created role", "ROLE", r.ID, "err", err)
+			}
+		}
+	}
+
+	// ロール名と同じく、コースロールの後に高いレベルから順に作成する
+	params := []*discordgo.RoleParams{roleParams(names[0], m.template.Course)}
+	levels := internal.Levels()
+	slices.Reverse(levels)
+	for i, l := range levels {
+		params = append(params, roleParams(names[i+1], m.template.Level(l)))
+	}
+	for _, p := range params {
+		r, err := s.GuildRoleCreate(m.guildID, p)
+		if err != nil {
+			rollback()
+			return fmt.Errorf("ロール %q の作成に失敗しました: %w", p.Name, err)
+		}
+		slog.Info("Role created", "ROLE", r.ID, "ROLE_NAME", r.Name)
+		created = append(created, r)
+	}
+
+	if err := m.placeRoles(s, created); err != nil {
+		rollback()
+		return fmt.Errorf("ロールの並べ替えに失敗しました: %w", err)
+	}
+
+	// 作成したロールのIDでコースを定義する
+	levelIDs := []string{}
+	for i := len(created) - 1; i > 0; i-- {
+		levelIDs = append(levelIDs, created[i].ID)
+	}
+	if err := m.defineCourse(created[0].ID, levelIDs); err != nil {
+		slog.Error("Failed to save course definition", "COURSE", created[0].ID, "err", err)
+	}
+	return nil
+}
+
+// ロールを上から順に並べ、テンプレートで指定したロールの直下に配置する
+func (m *courseManager) placeRoles(s *discordgo.Session, group []*discordgo.Role) error {
+	roles, err := s.GuildRoles(m.guildID)
+	if err != nil {
+		return err
+	}
+	// 位置の低い順に並べ、@everyone(サーバーIDと同じID)とグループのロールを除く
+	slices.SortFunc(roles, func(a, b *discordgo.Role) int {
+		return a.Position - b.Position
+	})
+	groupIDs := []string{}
+	for _, r := range group {
+		groupIDs = append(groupIDs, r.ID)
+	}
+	rest := slices.DeleteFunc(slices.Clone(roles), func(r *discordgo.Role) bool {
+		return r.ID == m.guildID || slices.Contains(groupIDs, r.ID)
+	})
+
+	// 挿入位置(既定は最下部)
+	insertAt := 0
+	if m.template.BelowRoleID != "" {
+		idx := slices.IndexFunc(rest, func(r *discordgo.Role) bool {
+			return r.ID == m.template.BelowRoleID
+		})
+		if idx < 0 {
+			return fmt.Errorf("role %s not found", m.template.BelowRoleID)
+		}
+		insertAt = idx
+	}
+	// botの最上位のロール以上に配置すると操作できなくなるため、その直下までに制限する
+	bot, err := s.User("@me")
+	if err != nil {
+		return err
+	}
+	member, err := s.GuildMember(m.guildID, bot.ID)
+	if err != nil {
+		return err
+	}
+	highest := -1
+	for i, r := range rest {
+		if slices.Contains(member.Roles, r.ID) {
+			highest = i
+		}
+	}
+	if insertAt > max(highest, 0) {
+		slog.Warn("Course roles placed below the bot's highest role", "BELOW_ROLE_ID", m.template.BelowRoleID)
+		insertAt = max(highest, 0)
+	}
+	ascending := slices.Clone(group)
+	slices.Reverse(ascending)
+	ordered := slices.Insert(rest, insertAt, ascending...)
+
+	// 位置が変わるロールのみ送信する
+	changed := []*discordgo.Role{}
+	for i, r := range ordered {
+		if r.Position != i+1 {
+			changed = append(changed, &discordgo.Role{ID: r.ID, Position: i + 1})
+		}
+	}
+	if len(changed) == 0 {
+		return nil
+	}
+	_, err = s.GuildRoleReorder(m.guildID, changed)
+	return err
+}
+
+// コース名からコースロールを検索
+func (m *courseManager) findCourse(name internal.CourseName) *internal.CourseRoleID {
+	m.guildsync.RLock()
+	defer m.guildsync.RUnlock()
+
+	if m.RoleIDRepository == nil {
+		return nil
+	}
+	for id, r := range m.roles {
+		if r.Name != string(name) {
+			continue
+		}
+		if c, ok := m.FindID(id).(*internal.CourseRoleID); ok {
+			return c
+		}
+	}
+	return nil
+}
+
+// コースの全てのロールのID(コースロール, 高いレベルから順にコースレベルロール)
+func courseRoleIDs(course *internal.CourseRoleID) []string {
+	ids := []string{course.String()}
+	levels := course.GetCourseLevelIDs()
+	for i := len(levels) - 1; i >= 0; i-- {
+		ids = append(ids, levels[i].String())
+	}
+	return ids
+}
+
+// コースの全てのロールを削除
+// 途中で失敗した場合は削除済みのロールを同じ設定で再作成する(メンバーへの付与は復元されない)
+func (m *courseManager) deleteCourse(s *discordgo.Session, name internal.CourseName) error {
+	course := m.findCourse(name)
+	if course == nil {
+		return fmt.Errorf("コース %q が見つかりません", name)
+	}
+	m.guildsync.RLock()
+	targets := []*discordgo.Role{}
+	for _, id := range courseRoleIDs(course) {
+		if r := m.roles[id]; r != nil {
+			copied := *r
+			targets = append(targets, &copied)
+		}
+	}
+	m.guildsync.RUnlock()
+
+	deleted := []*discordgo.Role{}
+	for _, r := range targets {
+		if err := s.GuildRoleDelete(m.guildID, r.ID); err != nil {
+			restored := []*discordgo.Role{}
+			for _, d := range deleted {
+				nr, err := s.GuildRoleCreate(m.guildID, roleParamsOf(d))
+				if err != nil {
+					slog.Error("Failed to restore deleted role", "ROLE_NAME", d.Name, "err", err)
+					continue
+				}
+				restored = append(restored, nr)
+			}
+			if len(restored) > 0 {
+				if err := m.placeRoles(s, restored); err != nil {
+					slog.Error("Failed to reorder restored roles", "err", err)
+				}
+			}
+			return fmt.Errorf("ロール %q の削除に失敗しました(削除済みのロールは再作成しましたが、メンバーへの付与は復元されません): %w", r.Name, err)
+		}
+		slog.Info("Role deleted", "ROLE", r.ID, "ROLE_NAME", r.Name)
+		deleted = append(deleted, r)
+	}
+	if err := m.undefineCourse(course.String()); err != nil {
+		slog.Error("Failed to save course definition", "COURSE", course.String(), "err", err)
+	}
+	return nil
+}
+
+// コースの全てのロールの名前を変更
+// 途中で失敗した場合は変更済みのロールの名前を元に戻す
+func (m *courseManager) renameCourse(s *discordgo.Session, name, newName internal.CourseName) error {
+	if err := validateCourseName(newName); err != nil {
+		return err
+	}
+	course := m.findCourse(name)
+	if course == nil {
+		return fmt.Errorf("コース %q が見つかりません", name)
+	}
+	ids := courseRoleIDs(course)
+	roles, err := s.GuildRoles(m.guildID)
+	if err != nil {
+		return err
+	}
+	newNames := courseRoleNames(newName)
+	if err := checkNameConflicts(roles, newNames, ids...); err != nil {
+		return err
+	}
+	// 元に戻す際は、テンプレートから求めた名前ではなく実際のロールの名前を用いる
+	oldNames := make([]string, len(ids))
+	for i, id := range ids {
+		idx := slices.IndexFunc(roles, func(r *discordgo.Role) bool {
+			return r.ID == id
+		})
+		if idx < 0 {
+			return fmt.Errorf("ロール %s が見つかりません", id)
+		}
+		oldNames[i] = roles[idx].Name
+	}
+
+	for i, id := range ids {
+		if _, err := s.GuildRoleEdit(m.guildID, id, &discordgo.RoleParams{Name: newNames[i]}); err != nil {
+			for j := 0; j < i; j++ {
+				if _, err := s.GuildRoleEdit(m.guildID, ids[j], &discordgo.RoleParams{Name: oldNames[j]}); err != nil {
+					slog.Error("Failed to roll back role name", "ROLE", ids[j], "err", err)
+				}
+			}
+			return fmt.Errorf("ロール %q の名前の変更に失敗しました: %w", oldNames[i], err)
+		}
+		slog.Info("Role renamed", "ROLE", id, "FROM", oldNames[i], "TO", newNames[i])
+	}
+	return nil
+}
+
+// /course コマンド
+var courseCommand = &discordgo.ApplicationCommand{
+	Name:                     "course",
+	Description:              "コースの管理",
+	DefaultMemberPermissions: command.Permission(discordgo.PermissionManageRoles),
+}
+
+// コース名の引数
+var courseNameOption = &discordgo.ApplicationCommandOption{
+	Type:        discordgo.ApplicationCommandOptionString,
+	Name:        "name",
+	Description: "コース名",
+	Required:    true,
+}
+
+func (m *courseManager) registerProvisionCommands(r *command.Router) {
+	r.Subcommand(courseCommand, &discordgo.ApplicationCommandOption{
+		Name:        "create",
+		Description: "コースロールと全てのコースレベルロールを作成",
+		Options:     []*discordgo.ApplicationCommandOption{courseNameOption},
+	}, func(s *discordgo.Session, i *discordgo.InteractionCreate, opts command.Options) {
+		name := internal.CourseName(opts.String("name"))
+		command.Deferred(s, i, func() string {
+			if err := m.createCourse(s, name); err != nil {
+				return "コースの作成に失敗しました: " + err.Error()
+			}
+			return fmt.Sprintf("コース %q を作成しました。", name)
+		})
+	})
+	r.Subcommand(courseCommand, &discordgo.ApplicationCommandOption{
+		Name:        "delete",
+		Description: "コースロールと全てのコースレベルロールを削除",
+		Options:     []*discordgo.ApplicationCommandOption{courseNameOption},
+	}, func(s *discordgo.Session, i *discordgo.InteractionCreate, opts command.Options) {
+		name := internal.CourseName(opts.String("name"))
+		command.Deferred(s, i, func() string {
+			if err := m.deleteCourse(s, name); err != nil {
+				return "コースの削除に失敗しました: " + err.Error()
+			}
+			return fmt.Sprintf("コース %q を削除しました。", name)
+		})
+	})
+	r.Subcommand(courseCommand, &discordgo.ApplicationCommandOption{
+		Name:        "rename",
+		Description: "コースロールと全てのコースレベルロールの名前を変更",
+		Options: []*discordgo.ApplicationCommandOption{courseNameOption, {
+			Type:        discordgo.ApplicationCommandOptionString,
+			Name:        "new_name",
+			Description: "新しいコース名",
+			Required:    true,
+		}},
+	}, func(s *discordgo.Session, i *discordgo.InteractionCreate, opts command.Options) {
+		name := internal.CourseName(opts.String("name"))
+		newName := internal.CourseName(opts.String("new_name"))
+		command.Deferred(s, i, func() string {
+			if err := m.renameCourse(s, name, newName); err != nil {
+				return "コース名の変更に失敗しました: " + err.Error()
+			}
+			return fmt.Sprintf("コース %q を %q に変更しました。", name, newName)
+		})
+	})
+}
@@ -0,0 +1,348 @@
+package course
+
+import (
+	"fmt"
+	"log/slog"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+	"github.com/gw31415/pgautorole/course/internal"
+	"github.com/gw31415/pgautorole/internal/command"
+	"github.com/gw31415/pgautorole/internal/utils"
+)
+
+// 修復の種類
+type RepairKind string
+
+const (
+	// コースレベルロールがないためアプレンティスを付与した
+	RepairMissingLevel RepairKind = "missing_level"
+	// 重複したコースレベルロールを1つにした
+	RepairDuplicateLevels RepairKind = "duplicate_levels"
+	// コースロールがないためコースレベルロールを削除した
+	RepairOrphanLevels RepairKind = "orphan_levels"
+	// 受講条件を満たさないためコースロールを削除した
+	RepairPrerequisite RepairKind = "prerequisite"
+)
+
+// 修復の説明
+var repairDescriptions = map[RepairKind]string{
+	RepairMissingLevel:    "コースレベルロールを付与",
+	RepairDuplicateLevels: "重複したコースレベルロールを削除",
+	RepairOrphanLevels:    "コースロールのないコースレベルロールを削除",
+	RepairPrerequisite:    "受講条件を満たさないためコースロールを削除",
+}
+
+// メンバーのコース関連ロールの修復
+type Fix struct {
+	UserID string
+	Course string
+	Kind   RepairKind
+	// 付与・削除したレベル
+	Levels []internal.Level
+}
+
+// コース関連ロールの修復結果
+type RepairReport struct {
+	Started, Finished time.Time
+	// 検査したメンバー数
+	Checked int
+	// 他の処理で更新中のため検査しなかったメンバー数
+	Busy int
+	// 自動処理の対象外のメンバー数
+	Skipped utils.SkipCounts
+	// 修復が必要なメンバー数
+	Planned int
+	// 修復が必要なメンバーが多すぎるため修復しなかったかどうか
+	Aborted bool
+	// 修復内容
+	Fixes []Fix
+	// メンバーの取得に失敗した場合のエラー
+	Err error
+}
+
+// 種類ごとの修復数
+func (r *RepairReport) Counts() map[RepairKind]int {
+	counts := map[RepairKind]int{}
+	for _, f := range r.Fixes {
+		counts[f.Kind]++
+	}
+	return counts
+}
+
+// ログに出力する属性
+func (r *RepairReport) LogAttrs() []any {
+	counts := r.Counts()
+	attrs := []any{"CHECKED", r.Checked, "BUSY", r.Busy, "PLANNED", r.Planned, "ABORTED", r.Aborted, "FIXES", len(r.Fixes), "DURATION", r.Finished.Sub(r.Started)}
+	for _, kind := range []RepairKind{RepairMissingLevel, RepairDuplicateLevels, RepairOrphanLevels, RepairPrerequisite} {
+		attrs = append(attrs, strings.ToUpper(string(kind)), counts[kind])
+	}
+	return append(attrs, r.Skipped.LogAttrs()...)
+}
+
+func (r *RepairReport) String() string {
+	b := strings.Builder{}
+	if r.Aborted {
+		fmt.Fprintf(&b, "%d人を検査しましたが、修復が必要なメンバー(%d人)が多すぎるため修復しませんでした。", r.Checked, r.Planned)
+	} else {
+		fmt.Fprintf(&b, "%d人を検査し、%d件を修復しました。", r.Checked, len(r.Fixes))
+	}
+	if r.Busy > 0 {
+		fmt.Fprintf(&b, "(更新中の%d人は検査していません)", r.Busy)
+	}
+	if r.Err != nil {
+		fmt.Fprintf(&b, "\nメンバーの取得に失敗しました: %v", r.Err)
+	}
+	for _, f := range r.Fixes {
+		fmt.Fprintf(&b, "\n- <@%s> %s: %s", f.UserID, f.Course, repairDescriptions[f.Kind])
+		if len(f.Levels) > 0 {
+			fmt.Fprintf(&b, "(%s)", strings.Join(utils.SlicesMap(f.Levels, func(l internal.Level) string {
+				return string(l)
+			}), ", "))
+		}
+	}
+	return b.String()
+}
+
+// メンバーを更新中に設定する(既に更新中の場合はfalseを返す)
+func (m *courseManager) lockMember(userID string) bool {
+	m.usersSync.Lock()
+	defer m.usersSync.Unlock()
+	if m.updatingUsers[userID] {
+		return false
+	}
+	m.updatingUsers[userID] = true
+	return true
+}
+
+// メンバーの更新中の設定を解除する
+func (m *courseManager) unlockMember(userID string) {
+	m.usersSync.Lock()
+	defer m.usersSync.Unlock()
+	delete(m.updatingUsers, userID)
+}
+
+// 他のタスクによる更新が終わるのを確認する間隔
+const RECHECK_INTERVAL = 500 * time.Millisecond
+
+// 他のタスクによる更新が終わるのを待つ最大の時間
+const RECHECK_TIMEOUT = 30 * time.Second
+
+// 他のタスクで更新中のため処理できなかったメンバーを、更新が終わってから検査・修復する
+// guildsyncのロックを取得していない状態で呼び出す
+func (m *courseManager) recheckMember(s *discordgo.Session, userID string) {
+	m.usersSync.Lock()
+	if m.recheckingUsers[userID] {
+		// 既に待っている場合は、その検査で現在のロールを確認する
+		m.usersSync.Unlock()
+		return
+	}
+	m.recheckingUsers[userID] = true
+	m.usersSync.Unlock()
+
+	deadline := time.Now().Add(RECHECK_TIMEOUT)
+	for !m.lockMember(userID) {
+		if time.Now().After(deadline) {
+			slog.Warn("Gave up rechecking busy member", "USER", userID)
+			m.usersSync.Lock()
+			delete(m.recheckingUsers, userID)
+			m.usersSync.Unlock()
+			return
+		}
+		time.Sleep(RECHECK_INTERVAL)
+	}
+	defer m.unlockMember(userID)
+	// ロックを取得した後の変更は、新たな検査で確認する
+	m.usersSync.Lock()
+	delete(m.recheckingUsers, userID)
+	m.usersSync.Unlock()
+
+	member, err := s.GuildMember(m.guildID, userID)
+	if err != nil {
+		// 既にサーバーにいない
+		return
+	}
+	if m.filter.Skip(member) != utils.NotSkipped {
+		return
+	}
+	m.guildsync.RLock()
+	if m.RoleIDRepository == nil {
+		m.guildsync.RUnlock()
+		return
+	}
+	fixes, transitions := m.repairMember(s, member)
+	m.guildsync.RUnlock()
+	m.recordTransitions(s, userID, transitions)
+	for _, f := range fixes {
+		slog.Info("Busy member rechecked", "USER", userID, "COURSE_NAME", f.Course, "KIND", f.Kind, "LEVELS", f.Levels)
+	}
+}
+
+func (m *courseManager) ReconcileCourseRoles(s *discordgo.Session) *RepairReport {
+	m.syncRoles(s)
+
+	slog.Info("Reconciling members' course roles...")
+	report := &RepairReport{Started: time.Now(), Skipped: utils.SkipCounts{}}
+	members := []*discordgo.Member{}
+	report.Err = utils.ForEachMemberPage(s, m.guildID, func(page []*discordgo.Member) {
+		slog.Debug("Paging members", "COUNT", len(page))
+		m.guildsync.RLock()
+		defer m.guildsync.RUnlock()
+		for _, member := range page {
+			if report.Skipped.Skip(m.filter, member) {
+				continue
+			}
+			report.Checked++
+			members = append(members, member)
+			if m.RoleIDRepository != nil && m.needsRepair(member) {
+				report.Planned++
+			}
+		}
+	})
+	if report.Err != nil {
+		slog.Error("Failed to get members", "err", report.Err)
+	}
+
+	// 修復するメンバーが多すぎる場合は設定の誤りとみなして修復しない
+	if !m.bulkAllowed("コース関連ロールの定期検査", report.Planned, report.Checked) {
+		report.Aborted = true
+		report.Finished = time.Now()
+		slog.Warn("Course roles reconciliation aborted", report.LogAttrs()...)
+		return report
+	}
+	// ロールを変更しない受講条件の警告も通知するため、全てのメンバーを検査する
+	for _, member := range members {
+		// ハンドラと同時に更新しないよう、更新中のメンバーは飛ばす
+		if !m.lockMember(member.User.ID) {
+			report.Busy++
+			continue
+		}
+		var transitions []transition
+		m.guildsync.RLock()
+		if m.RoleIDRepository != nil {
+			var fixes []Fix
+			fixes, transitions = m.repairMember(s, member)
+			report.Fixes = append(report.Fixes, fixes...)
+		}
+		m.guildsync.RUnlock()
+		m.recordTransitions(s, member.User.ID, transitions)
+		m.unlockMember(member.User.ID)
+	}
+	report.Finished = time.Now()
+	slog.Info("Members' course roles reconciled", report.LogAttrs()...)
+	return report
+}
+
+// メンバーのコース関連ロールの修復でロールを変更するかどうか(repairMemberの修復内容をロールを変更せずに判定する)
+// guildsyncのロックを取得した状態で呼び出す
+func (m *courseManager) needsRepair(member *discordgo.Member) bool {
+	var events []internal.Event
+	m.history.View(func(h *CourseHistory) {
+		events = slices.Clone((*h)[member.User.ID])
+	})
+	levels := internal.Levels()
+	for _, id := range m.FilterIDs(member.Roles) {
+		course := id.GetCourseRoleID()
+		courseID := course.String()
+		dups := FilterMemberRoles(member, course.GetCourseLevelIDs())
+		hasCourse := slices.Contains(member.Roles, courseID)
+		if hasCourse {
+			def := m.definition(courseID)
+			if def != nil && def.PrerequisiteEnforcement() == EnforceRevert && len(m.unmetPrerequisites(member, courseID, def, false)) > 0 {
+				return true
+			}
+		}
+		switch {
+		case !hasCourse && len(dups) > 0, hasCourse && len(dups) == 0:
+			return true
+		case hasCourse && len(dups) > 1:
+			held := []internal.Level{}
+			for i, cl := range course.GetCourseLevelIDs() {
+				if i < len(levels) && slices.Contains(dups, cl) {
+					held = append(held, levels[i])
+				}
+			}
+			if _, ok := m.conflictPolicy.Resolve(held, "", internal.LatestLevel(events, courseID, held)); ok {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// メンバーのコース関連ロールを修復する
+// 受講履歴に記録する変更も返すため、guildsyncのロックを解放してからrecordTransitionsで保存する
+// guildsyncのロックとメンバーのロックを取得した状態で呼び出す
+func (m *courseManager) repairMember(s *discordgo.Session, member *discordgo.Member) ([]Fix, []transition) {
+	courseIDs := []string{}
+	for _, id := range m.FilterIDs(member.Roles) {
+		if c := id.GetCourseRoleID().String(); !slices.Contains(courseIDs, c) {
+			courseIDs = append(courseIDs, c)
+		}
+	}
+
+	fixes := []Fix{}
+	transitions := []transition{}
+	levels := internal.Levels()
+	for _, courseID := range courseIDs {
+		course, ok := m.FindID(courseID).(*internal.CourseRoleID)
+		if !ok {
+			continue
+		}
+		name := m.roles[courseID].Name
+		fix := func(kind RepairKind, levels ...internal.Level) {
+			fixes = append(fixes, Fix{member.User.ID, name, kind, levels})
+		}
+		levelIDs := course.GetCourseLevelIDs()
+		dups := FilterMemberRoles(member, levelIDs)
+		hasCourse := slices.Contains(member.Roles, courseID)
+
+		if hasCourse && m.enforcePrerequisites(s, member, courseID, false) {
+			fix(RepairPrerequisite)
+			hasCourse = false
+		}
+		switch {
+		case !hasCourse && len(dups) > 0:
+			removed := []internal.Level{}
+			for _, cl := range dups {
+				if err := s.GuildMemberRoleRemove(m.guildID, member.User.ID, cl.String()); err != nil {
+					slog.Error("Failed to remove orphan course level role", "USER", member.User.ID, "ROLE", cl.String(), "err", err)
+					continue
+				}
+				removed = append(removed, levels[slices.Index(levelIDs, cl)])
+			}
+			if len(removed) > 0 {
+				fix(RepairOrphanLevels, removed...)
+			}
+		case hasCourse && len(dups) == 0:
+			initial := levelIDs[internal.LevelIndex(internal.Apprentice)]
+			m.markBotChange(member.User.ID, initial.String(), systemChange)
+			if err := s.GuildMemberRoleAdd(m.guildID, member.User.ID, initial.String()); err != nil {
+				m.takeBotChange(member.User.ID, initial.String())
+				slog.Error("Failed to add missing course level role", "USER", member.User.ID, "ROLE", initial.String(), "err", err)
+				continue
+			}
+			fix(RepairMissingLevel, internal.Apprentice)
+		case hasCourse && len(dups) > 1:
+			removed, resolved := m.resolveConflict(s, member, course, nil)
+			if len(removed) > 0 {
+				fix(RepairDuplicateLevels, removed...)
+			}
+			transitions = append(transitions, resolved...)
+		}
+	}
+	return fixes, transitions
+}
+
+func (m *courseManager) registerRepairCommands(r *command.Router) {
+	r.Subcommand(courseCommand, &discordgo.ApplicationCommandOption{
+		Name:        "repair",
+		Description: "全メンバーのコース関連ロールを検査し、修復",
+	}, func(s *discordgo.Session, i *discordgo.InteractionCreate, opts command.Options) {
+		command.Deferred(s, i, func() string {
+			return m.ReconcileCourseRoles(s).String()
+		})
+	})
+}
@@ -0,0 +1,191 @@
+package course_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+	"github.com/gw31415/pgautorole/course"
+	"github.com/gw31415/pgautorole/course/internal"
+	"github.com/gw31415/pgautorole/internal/store"
+)
+
+// ロールとメンバーの一覧を返し、メンバーのロールの変更を記録するトランスポート
+type fakeDiscord struct {
+	roles   []*discordgo.Role
+	members []*discordgo.Member
+	mu      sync.Mutex
+	// メンバーのロールの変更(+ユーザーID/ロールID または -ユーザーID/ロールID)
+	changes []string
+}
+
+func (f *fakeDiscord) RoundTrip(req *http.Request) (*http.Response, error) {
+	var body any
+	path := strings.Split(strings.Trim(req.URL.Path, "/"), "/")
+	switch {
+	case req.Method == http.MethodGet && strings.HasSuffix(req.URL.Path, "/roles"):
+		body = f.roles
+	case req.Method == http.MethodGet && strings.HasSuffix(req.URL.Path, "/members"):
+		body = []*discordgo.Member{}
+		if req.URL.Query().Get("after") == "" {
+			body = f.members
+		}
+	case req.Method == http.MethodPut || req.Method == http.MethodDelete:
+		op := "+"
+		if req.Method == http.MethodDelete {
+			op = "-"
+		}
+		f.mu.Lock()
+		f.changes = append(f.changes, op+path[len(path)-3]+"/"+path[len(path)-1])
+		f.mu.Unlock()
+	case strings.HasSuffix(req.URL.Path, "/users/@me/channels"):
+		// DMのチャンネル
+		body = &discordgo.Channel{ID: "dm"}
+	default:
+		body = map[string]string{"id": "message"}
+	}
+	res := &http.Response{StatusCode: http.StatusNoContent, Body: http.NoBody, Header: http.Header{}, Request: req}
+	if body != nil {
+		b, _ := json.Marshal(body)
+		res.StatusCode = http.StatusOK
+		res.Body = io.NopCloser(bytes.NewReader(b))
+	}
+	return res, nil
+}
+
+// コースロールID(c0, c1, ...)とコースレベルロールID(c0-0, c0-1, ...)を持つコースのロールを生成
+func courseRoles(courses int) []*discordgo.Role {
+	roles := []*discordgo.Role{}
+	for i := range courses {
+		name := internal.CourseName(fmt.Sprintf("Course%d", i))
+		roles = append(roles, &discordgo.Role{ID: fmt.Sprintf("c%d", i), Name: string(name)})
+		for j, cl := range name.CourseLevelNames() {
+			roles = append(roles, &discordgo.Role{ID: fmt.Sprintf("c%d-%d", i, j), Name: cl.String()})
+		}
+	}
+	return roles
+}
+
+func TestReconcileCourseRoles(t *testing.T) {
+	cases := []struct {
+		name    string
+		roles   []string
+		changes []string
+		kinds   []course.RepairKind
+	}{
+		{"Healthy", []string{"c0", "c0-2"}, nil, nil},
+		{"MissingLevel", []string{"c0"}, []string{"+u/c0-0"}, []course.RepairKind{course.RepairMissingLevel}},
+		{"DuplicateLevels", []string{"c0", "c0-0", "c0-2"}, []string{"-u/c0-0"}, []course.RepairKind{course.RepairDuplicateLevels}},
+		{"OrphanLevels", []string{"c0-1", "c0-3"}, []string{"-u/c0-1", "-u/c0-3"}, []course.RepairKind{course.RepairOrphanLevels}},
+		// 受講条件(c0のノーマル以上)を満たさない場合はコースロールを外し、残ったコースレベルロールも外す
+		{"Prerequisite", []string{"c0", "c0-1", "c1", "c1-0"}, []string{"-u/c1", "-u/c1-0"}, []course.RepairKind{course.RepairPrerequisite, course.RepairOrphanLevels}},
+		{"PrerequisiteMet", []string{"c0", "c0-2", "c1", "c1-0"}, nil, nil},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			f := &fakeDiscord{
+				roles:   courseRoles(2),
+				members: []*discordgo.Member{{User: &discordgo.User{ID: "u"}, Roles: c.roles}},
+			}
+			s, err := discordgo.New("Bot token")
+			if err != nil {
+				t.Fatal(err)
+			}
+			s.Client = &http.Client{Transport: f}
+			definitions := store.Memory(course.CourseDefinitions{
+				"c1": {
+					LevelRoleIDs:  []string{"c1-0", "c1-1", "c1-2", "c1-3"},
+					Prerequisites: []course.Prerequisite{{CourseID: "c0", MinLevel: internal.Normal}},
+				},
+			})
+			m := course.NewCourseManager("g", course.Options{
+				Definitions:    definitions,
+				ConflictPolicy: internal.KeepHighest,
+			})
+
+			report := m.ReconcileCourseRoles(s)
+			if report.Err != nil {
+				t.Fatalf("unexpected error: %v", report.Err)
+			}
+			if report.Checked != 1 {
+				t.Fatalf("unexpected checked: %v", report.Checked)
+			}
+			if !slices.Equal(f.changes, c.changes) {
+				t.Fatalf("unexpected changes: %v", f.changes)
+			}
+			kinds := []course.RepairKind{}
+			for _, fix := range report.Fixes {
+				kinds = append(kinds, fix.Kind)
+			}
+			if !slices.Equal(kinds, c.kinds) {
+				t.Fatalf("unexpected fixes: %v", report.Fixes)
+			}
+		})
+	}
+}
+
+func TestReconcileCourseRolesAborted(t *testing.T) {
+	f := &fakeDiscord{
+		roles: courseRoles(1),
+		members: []*discordgo.Member{
+			{User: &discordgo.User{ID: "u0"}, Roles: []string{"c0"}},
+			{User: &discordgo.User{ID: "u1"}, Roles: []string{"c0", "c0-2"}},
+		},
+	}
+	s, err := discordgo.New("Bot token")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Client = &http.Client{Transport: f}
+	var planned, total int
+	m := course.NewCourseManager("g", course.Options{
+		AllowBulk: func(operation string, changes, members int) bool {
+			planned, total = changes, members
+			return false
+		},
+	})
+
+	report := m.ReconcileCourseRoles(s)
+	if !report.Aborted || planned != 1 || total != 2 {
+		t.Fatalf("unexpected report: %+v (planned %d, total %d)", report, planned, total)
+	}
+	if len(f.changes) != 0 {
+		t.Fatalf("unexpected changes: %v", f.changes)
+	}
+}
+
+func TestPrerequisiteOnEnrollment(t *testing.T) {
+	f := &fakeDiscord{roles: courseRoles(2)}
+	s, err := discordgo.New("Bot token")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Client = &http.Client{Transport: f}
+	definitions := store.Memory(course.CourseDefinitions{
+		"c1": {
+			LevelRoleIDs: []string{"c1-0", "c1-1", "c1-2", "c1-3"},
+			// /course require で追加した条件
+			Prerequisites: []course.Prerequisite{{CourseID: "c0", MinLevel: internal.Normal, AddedAt: time.Now().Add(-time.Hour)}},
+		},
+	})
+	m := course.NewCourseManager("g", course.Options{Definitions: definitions})
+	// ロール情報を同期する
+	m.ReconcileCourseRoles(s)
+
+	// 受講履歴に登録が記録される前でも、条件の追加後に付与されたコースロールは取り消す
+	m.MemberRoleUpdateHandler(s, &discordgo.GuildMemberUpdate{
+		Member:       &discordgo.Member{GuildID: "g", User: &discordgo.User{ID: "u"}, Roles: []string{"c0", "c0-1", "c1"}},
+		BeforeUpdate: &discordgo.Member{GuildID: "g", User: &discordgo.User{ID: "u"}, Roles: []string{"c0", "c0-1"}},
+	})
+	if !slices.Equal(f.changes, []string{"-u/c1"}) {
+		t.Fatalf("unexpected changes: %v", f.changes)
+	}
+}
@@ -0,0 +1,270 @@
+package course
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"slices"
+	"strings"
+
+	"github.com/bwmarrin/discordgo"
+	"github.com/gw31415/pgautorole/breaker"
+	"github.com/gw31415/pgautorole/course/internal"
+	"github.com/gw31415/pgautorole/internal/command"
+	"github.com/gw31415/pgautorole/internal/utils"
+)
+
+// サーバーのメンバーのコースの受講状況
+type guildMembership struct {
+	// ユーザーIDからコース名とレベルへのマップ
+	courses internal.Membership
+	// ユーザー名からユーザーIDへのマップ
+	userIDs map[string]string
+	// ユーザーIDからユーザー名へのマップ
+	usernames map[string]string
+}
+
+// コースロールを持つメンバーのレベルを集計する
+func (m *courseManager) currentMembership(s *discordgo.Session) (*guildMembership, error) {
+	gm := &guildMembership{internal.Membership{}, map[string]string{}, map[string]string{}}
+	err := utils.ForEachMemberPage(s, m.guildID, func(members []*discordgo.Member) {
+		m.guildsync.RLock()
+		defer m.guildsync.RUnlock()
+		if m.RoleIDRepository == nil {
+			return
+		}
+		for _, member := range members {
+			gm.userIDs[member.User.Username] = member.User.ID
+			gm.usernames[member.User.ID] = member.User.Username
+			for _, id := range m.FilterIDs(member.Roles) {
+				course, ok := id.(*internal.CourseRoleID)
+				if !ok {
+					continue
+				}
+				levelIDs := utils.SlicesMap(course.GetCourseLevelIDs(), (*internal.CourseLevelRoleID).String)
+				if gm.courses[member.User.ID] == nil {
+					gm.courses[member.User.ID] = map[internal.CourseName]internal.Level{}
+				}
+				name := internal.CourseName(m.roles[course.String()].Name)
+				gm.courses[member.User.ID][name] = internal.HighestLevel(member.Roles, levelIDs)
+			}
+		}
+	})
+	return gm, err
+}
+
+// 名簿を反映するための変更を計画する
+// 反映できない行は問題として返す
+func (m *courseManager) planRoster(s *discordgo.Session, entries []internal.RosterEntry) ([]internal.RosterChange, []string, error) {
+	gm, err := m.currentMembership(s)
+	if err != nil {
+		return nil, nil, err
+	}
+	problems := []string{}
+	desired := internal.Membership{}
+	for _, e := range entries {
+		if m.findCourse(e.Course) == nil {
+			problems = append(problems, fmt.Sprintf("コース %q が見つかりません", e.Course))
+			continue
+		}
+		userID := e.User
+		if _, ok := gm.usernames[userID]; !ok {
+			if userID, ok = gm.userIDs[e.User]; !ok {
+				problems = append(problems, fmt.Sprintf("メンバー %q が見つかりません", e.User))
+				continue
+			}
+		}
+		if desired[userID] == nil {
+			desired[userID] = map[internal.CourseName]internal.Level{}
+		}
+		desired[userID][e.Course] = e.Level
+	}
+	slices.Sort(problems)
+	return internal.PlanRoster(desired, gm.courses), slices.Compact(problems), nil
+}
+
+// 名簿の変更を反映する
+// ハンドラによるアプレンティスの付与や重複の解決と競合しないよう、メンバーを更新中にして変更後のロールを1回で設定する
+// 受講条件・上限などはMemberRoleUpdateHandlerで通常の付与と同じく適用される
+// optionsはロールを変更するリクエストに渡す
+func (m *courseManager) applyRosterChange(s *discordgo.Session, c internal.RosterChange, options ...discordgo.RequestOption) error {
+	course := m.findCourse(c.Course)
+	if course == nil {
+		return fmt.Errorf("コース %q が見つかりません", c.Course)
+	}
+	if !m.lockMember(c.UserID) {
+		return fmt.Errorf("メンバーのロールを更新中です。しばらくしてから再度お試しください")
+	}
+	defer m.unlockMember(c.UserID)
+
+	member, err := s.GuildMember(m.guildID, c.UserID)
+	if err != nil {
+		return err
+	}
+	levelIDs := utils.SlicesMap(course.GetCourseLevelIDs(), (*internal.CourseLevelRoleID).String)
+	// コースに関連するロールを全て外してから、変更後のロールを加える
+	roles := slices.DeleteFunc(slices.Clone(member.Roles), func(id string) bool {
+		return id == course.String() || slices.Contains(levelIDs, id)
+	})
+	if c.To != "" {
+		roles = append(roles, course.String(), levelIDs[internal.LevelIndex(c.To)])
+	}
+	_, err = s.GuildMemberEdit(m.guildID, c.UserID, &discordgo.GuildMemberParams{Roles: &roles}, options...)
+	return err
+}
+
+// 変更の説明文
+func describeRosterChange(c internal.RosterChange) string {
+	switch {
+	case c.From == "":
+		return fmt.Sprintf("<@%s> %s: 登録(%s)", c.UserID, c.Course, c.To)
+	case c.To == "":
+		return fmt.Sprintf("<@%s> %s: 解除(%s)", c.UserID, c.Course, c.From)
+	}
+	return fmt.Sprintf("<@%s> %s: %s → %s", c.UserID, c.Course, c.From, c.To)
+}
+
+// 名簿を読み込み、変更を計画または反映する
+func (m *courseManager) importRoster(s *discordgo.Session, data []byte, apply bool) string {
+	entries, err := internal.ParseRoster(data)
+	if err != nil {
+		return "名簿の解析に失敗しました: " + err.Error()
+	}
+	changes, problems, err := m.planRoster(s, entries)
+	if err != nil {
+		return "メンバーの取得に失敗しました: " + err.Error()
+	}
+
+	lines := []string{}
+	if apply && len(problems) > 0 {
+		// 見つからないメンバーやコースの行を無視して反映すると、名簿にあるメンバーをコースから外してしまう
+		lines = append(lines, fmt.Sprintf("名簿に%d件の問題があるため反映しませんでした。名簿を修正してから再度お試しください。", len(problems)))
+		for _, p := range problems {
+			lines = append(lines, "- "+p)
+		}
+		return strings.Join(lines, "\n")
+	}
+	if apply {
+		failed := 0
+		for _, c := range changes {
+			// 運営者が内容を確認して反映した名簿は、途中で停止しないよう変更数の上限を適用しない
+			if err := m.applyRosterChange(s, c, breaker.OperatorRequest); err != nil {
+				slog.Error("Failed to apply roster change", "USER", c.UserID, "COURSE_NAME", c.Course, "err", err)
+				lines = append(lines, "- 失敗: "+describeRosterChange(c))
+				failed++
+				continue
+			}
+			slog.Info("Roster change applied", "USER", c.UserID, "COURSE_NAME", c.Course, "FROM", c.From, "TO", c.To)
+			lines = append(lines, "- "+describeRosterChange(c))
+		}
+		lines = slices.Insert(lines, 0, fmt.Sprintf("%d件の変更を反映しました(失敗: %d件)。", len(changes)-failed, failed))
+	} else {
+		lines = append(lines, fmt.Sprintf("%d件の変更があります(`mode: apply` で反映します)。", len(changes)))
+		for _, c := range changes {
+			lines = append(lines, "- "+describeRosterChange(c))
+		}
+	}
+	if len(problems) > 0 {
+		lines = append(lines, fmt.Sprintf("次の%d件の問題を解決するまで反映できません。", len(problems)))
+		for _, p := range problems {
+			lines = append(lines, "- "+p)
+		}
+	}
+	return strings.Join(lines, "\n")
+}
+
+// 現在の受講状況を名簿として出力する
+func (m *courseManager) exportRoster(s *discordgo.Session, name internal.CourseName) ([]internal.RosterEntry, error) {
+	gm, err := m.currentMembership(s)
+	if err != nil {
+		return nil, err
+	}
+	entries := []internal.RosterEntry{}
+	for userID, courses := range gm.courses {
+		for c, l := range courses {
+			if name == "" || c == name {
+				entries = append(entries, internal.RosterEntry{User: userID, Course: c, Level: l})
+			}
+		}
+	}
+	slices.SortFunc(entries, func(a, b internal.RosterEntry) int {
+		if a.Course != b.Course {
+			return strings.Compare(string(a.Course), string(b.Course))
+		}
+		return strings.Compare(a.User, b.User)
+	})
+	return entries, nil
+}
+
+// 名簿の形式の選択肢
+var rosterFormatChoices = []*discordgo.ApplicationCommandOptionChoice{
+	{Name: "CSV", Value: "csv"},
+	{Name: "JSON", Value: "json"},
+}
+
+func (m *courseManager) registerRosterCommands(r *command.Router) {
+	r.Subcommand(courseCommand, &discordgo.ApplicationCommandOption{
+		Name:        "import",
+		Description: "名簿(CSV/JSON)からコースの受講状況を反映",
+		Options: []*discordgo.ApplicationCommandOption{{
+			Type:        discordgo.ApplicationCommandOptionAttachment,
+			Name:        "file",
+			Description: "名簿(user, course, levelの列を持つCSV、または同じ項目を持つJSON)",
+			Required:    true,
+		}, {
+			Type:        discordgo.ApplicationCommandOptionString,
+			Name:        "mode",
+			Description: "変更を確認するか反映するか(省略時は確認)",
+			Choices: []*discordgo.ApplicationCommandOptionChoice{
+				{Name: "確認", Value: "plan"},
+				{Name: "反映", Value: "apply"},
+			},
+		}},
+	}, func(s *discordgo.Session, i *discordgo.InteractionCreate, opts command.Options) {
+		attachment := opts.Attachment("file")
+		apply := opts.String("mode") == "apply"
+		command.Deferred(s, i, func() string {
+			if attachment == nil {
+				return "名簿が添付されていません。"
+			}
+			data, err := command.DownloadAttachment(s, attachment)
+			if err != nil {
+				return "名簿の取得に失敗しました: " + err.Error()
+			}
+			return m.importRoster(s, data, apply)
+		})
+	})
+	r.Subcommand(courseCommand, &discordgo.ApplicationCommandOption{
+		Name:        "export",
+		Description: "コースの受講状況を名簿として出力",
+		Options: []*discordgo.ApplicationCommandOption{{
+			Type:        discordgo.ApplicationCommandOptionString,
+			Name:        "name",
+			Description: "コース名(省略時は全てのコース)",
+		}, {
+			Type:        discordgo.ApplicationCommandOptionString,
+			Name:        "format",
+			Description: "形式(省略時はCSV)",
+			Choices:     rosterFormatChoices,
+		}},
+	}, func(s *discordgo.Session, i *discordgo.InteractionCreate, opts command.Options) {
+		name := internal.CourseName(opts.String("name"))
+		format := opts.String("format")
+		command.DeferredFile(s, i, func() (string, *discordgo.File) {
+			entries, err := m.exportRoster(s, name)
+			if err != nil {
+				return "メンバーの取得に失敗しました: " + err.Error(), nil
+			}
+			file := &discordgo.File{Name: "roster.csv", ContentType: "text/csv", Reader: bytes.NewReader(internal.FormatRosterCSV(entries))}
+			if format == "json" {
+				b, err := json.MarshalIndent(entries, "", "  ")
+				if err != nil {
+					return "名簿の出力に失敗しました: " + err.Error(), nil
+				}
+				file = &discordgo.File{Name: "roster.json", ContentType: "application/json", Reader: bytes.NewReader(b)}
+			}
+			return fmt.Sprintf("%d件の受講状況を出力しました。", len(entries)), file
+		})
+	})
+}
@@ -0,0 +1,321 @@
+package expiry
+
+import (
+	"fmt"
+	"log/slog"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+	"github.com/gw31415/pgautorole/internal/command"
+	"github.com/gw31415/pgautorole/internal/store"
+	"github.com/gw31415/pgautorole/internal/utils"
+)
+
+// 期限付きロールマネージャ
+type ExpiryManager interface {
+	// 期限付きロールの付与を記録し、期限切れのロールの再付与を取り消すハンドラ
+	MemberRoleUpdateHandler(s *discordgo.Session, m *discordgo.GuildMemberUpdate)
+	// 期限切れのロールを剥奪
+	RefreshExpiredRoles(s *discordgo.Session)
+	// スラッシュコマンドを登録
+	RegisterCommands(r *command.Router)
+}
+
+// ロールIDからユーザーIDごとの付与記録へのマップ
+type Grants map[string]map[string]*Grant
+
+// 期限付きロールの付与記録
+type Grant struct {
+	// ロールが付与された日時
+	GrantedAt time.Time `json:"granted_at"`
+	// 期限切れによりロールを剥奪した日時
+	ExpiredAt *time.Time `json:"expired_at,omitempty"`
+}
+
+type expiryManager struct {
+	// サーバーID
+	guildID string
+	// 有効期限の設定
+	rules []*Rule
+	// 付与記録
+	grants *store.Store[Grants]
+	// 定期更新で変更するメンバー数と対象のメンバー数から、更新を行ってよいかを判定する(nilの場合は常に行う)
+	allowBulk func(changes, total int) bool
+}
+
+// 期限付きロールマネージャを生成
+func NewExpiryManager(guildID string, rules []*Rule, grants *store.Store[Grants], allowBulk func(changes, total int) bool) ExpiryManager {
+	return &expiryManager{
+		guildID:   guildID,
+		rules:     rules,
+		grants:    grants,
+		allowBulk: allowBulk,
+	}
+}
+
+// ロールIDから設定を取得
+func (e *expiryManager) findRule(roleID string) *Rule {
+	idx := slices.IndexFunc(e.rules, func(r *Rule) bool {
+		return r.RoleID == roleID
+	})
+	if idx < 0 {
+		return nil
+	}
+	return e.rules[idx]
+}
+
+// 付与記録を取得
+func (e *expiryManager) getGrant(roleID, userID string) *Grant {
+	var grant *Grant
+	e.grants.View(func(g *Grants) {
+		if gg := (*g)[roleID][userID]; gg != nil {
+			copied := *gg
+			grant = &copied
+		}
+	})
+	return grant
+}
+
+// 付与記録を更新(nilの場合は削除)
+func (g Grants) set(roleID, userID string, grant *Grant) {
+	if g[roleID] == nil {
+		g[roleID] = make(map[string]*Grant)
+	}
+	if grant == nil {
+		delete(g[roleID], userID)
+	} else {
+		g[roleID][userID] = grant
+	}
+}
+
+// 期限切れによりロールを剥奪したことを記録
+func (g Grants) markExpired(roleID, userID string, now time.Time) {
+	grant := &Grant{}
+	if gg := g[roleID][userID]; gg != nil {
+		copied := *gg
+		grant = &copied
+	}
+	grant.ExpiredAt = &now
+	g.set(roleID, userID, grant)
+}
+
+// 付与記録をまとめて更新し、1回で保存する
+func (e *expiryManager) updateGrants(f func(g Grants)) {
+	err := e.grants.Update(func(g *Grants) error {
+		if *g == nil {
+			*g = Grants{}
+		}
+		f(*g)
+		return nil
+	})
+	if err != nil {
+		slog.Error("Failed to save role grants", "err", err)
+	}
+}
+
+// 付与記録を更新
+func (e *expiryManager) setGrant(roleID, userID string, grant *Grant) {
+	e.updateGrants(func(g Grants) {
+		g.set(roleID, userID, grant)
+	})
+}
+
+// メンバーのロールが期限切れかどうか
+func isExpired(r *Rule, grant *Grant, member *discordgo.Member, now time.Time) bool {
+	grantedAt := time.Time{}
+	if grant != nil {
+		grantedAt = grant.GrantedAt
+	}
+	expiresAt, ok := r.ExpiresAt(member.JoinedAt, grantedAt)
+	return ok && !now.Before(expiresAt)
+}
+
+// 期限切れのロールを剥奪
+func (e *expiryManager) expire(s *discordgo.Session, r *Rule, member *discordgo.Member) bool {
+	slog.Info("Remove expired role", "USER", member.User.ID, "ROLE", r.RoleID)
+	if err := s.GuildMemberRoleRemove(e.guildID, member.User.ID, r.RoleID); err != nil {
+		slog.Error("Failed to remove expired role", "err", err)
+		return false
+	}
+	return true
+}
+
+func (e *expiryManager) MemberRoleUpdateHandler(s *discordgo.Session, m *discordgo.GuildMemberUpdate) {
+	// イベントが発生したサーバーが異なる場合は無視
+	if m.GuildID != e.guildID {
+		return
+	}
+
+	rolesBefore := []string{}
+	if m.BeforeUpdate != nil {
+		rolesBefore = m.BeforeUpdate.Roles
+	}
+	added := utils.SlicesDifference(m.Member.Roles, rolesBefore)
+
+	now := time.Now()
+	for _, roleID := range added {
+		r := e.findRule(roleID)
+		if r == nil {
+			continue
+		}
+		grant := e.getGrant(roleID, m.User.ID)
+		if r.Protect && grant != nil && grant.ExpiredAt != nil {
+			// 期限切れ後の手動での再付与を取り消す
+			slog.Info("Refuse expired role", "USER", m.User.ID, "ROLE", roleID)
+			s.GuildMemberRoleRemove(e.guildID, m.User.ID, roleID)
+			continue
+		}
+		// 変更前のロールが不明な場合は付与されたかどうか分からないため、記録がない場合のみ記録する
+		if r.Anchor == AnchorGrant && (m.BeforeUpdate != nil || grant == nil) {
+			// 付与日時を記録し、新たな有効期間を開始する
+			grant = &Grant{GrantedAt: now}
+			e.setGrant(roleID, m.User.ID, grant)
+		}
+		if isExpired(r, grant, m.Member, now) && e.expire(s, r, m.Member) {
+			e.updateGrants(func(g Grants) {
+				g.markExpired(roleID, m.User.ID, now)
+			})
+		}
+	}
+}
+
+// 一括処理で剥奪する期限切れのロール
+type expiration struct {
+	rule   *Rule
+	member *discordgo.Member
+}
+
+func (e *expiryManager) RefreshExpiredRoles(s *discordgo.Session) {
+	if len(e.rules) == 0 {
+		return
+	}
+
+	// 付与記録の変更はまとめて最後に保存する
+	now := time.Now()
+	discovered := Grants{}
+	targets := []expiration{}
+	total := 0
+	err := utils.ForEachMemberPage(s, e.guildID, func(members []*discordgo.Member) {
+		total += len(members)
+		for _, member := range members {
+			for _, r := range e.rules {
+				if !slices.Contains(member.Roles, r.RoleID) {
+					continue
+				}
+				grant := e.getGrant(r.RoleID, member.User.ID)
+				if r.Anchor == AnchorGrant && grant == nil {
+					// 付与日時が不明な場合は初めて確認した日時を付与日時とする
+					grant = &Grant{GrantedAt: now}
+					discovered.set(r.RoleID, member.User.ID, grant)
+				}
+				if isExpired(r, grant, member, now) {
+					targets = append(targets, expiration{r, member})
+				}
+			}
+		}
+	})
+	if err != nil {
+		slog.Error("Failed to get members", "err", err)
+		return
+	}
+
+	// 剥奪するメンバーが多すぎる場合は設定の誤りとみなして剥奪しない(付与記録は保存する)
+	users := map[string]bool{}
+	for _, t := range targets {
+		users[t.member.User.ID] = true
+	}
+	if e.allowBulk != nil && !e.allowBulk(len(users), total) {
+		slog.Warn("Expired roles refresh aborted", "CHANGES", len(users), "MEMBERS", total)
+		targets = nil
+	}
+
+	expired := []expiration{}
+	for _, t := range targets {
+		if e.expire(s, t.rule, t.member) {
+			expired = append(expired, t)
+		}
+	}
+	if len(expired) == 0 && len(discovered) == 0 {
+		return
+	}
+	e.updateGrants(func(g Grants) {
+		for roleID, users := range discovered {
+			for userID, grant := range users {
+				g.set(roleID, userID, grant)
+			}
+		}
+		for _, t := range expired {
+			g.markExpired(t.rule.RoleID, t.member.User.ID, now)
+		}
+	})
+	slog.Info("Expired roles refreshed", "EXPIRED", len(expired), "FAILED", len(targets)-len(expired))
+}
+
+// /expiry コマンド
+var expiryCommand = &discordgo.ApplicationCommand{
+	Name:                     "expiry",
+	Description:              "期限付きロールの管理",
+	DefaultMemberPermissions: command.Permission(discordgo.PermissionManageRoles),
+}
+
+func (e *expiryManager) RegisterCommands(r *command.Router) {
+	r.Subcommand(expiryCommand, &discordgo.ApplicationCommandOption{
+		Name:        "status",
+		Description: "期限付きロールの設定と付与状況を表示",
+	}, func(s *discordgo.Session, i *discordgo.InteractionCreate, opts command.Options) {
+		command.Respond(s, i, e.status())
+	})
+	r.Subcommand(expiryCommand, &discordgo.ApplicationCommandOption{
+		Name:        "reset",
+		Description: "メンバーの期限付きロールの記録を消去し、再付与できるようにする",
+		Options: []*discordgo.ApplicationCommandOption{{
+			Type:        discordgo.ApplicationCommandOptionRole,
+			Name:        "role",
+			Description: "対象のロール",
+			Required:    true,
+		}, {
+			Type:        discordgo.ApplicationCommandOptionUser,
+			Name:        "user",
+			Description: "対象のメンバー",
+			Required:    true,
+		}},
+	}, func(s *discordgo.Session, i *discordgo.InteractionCreate, opts command.Options) {
+		roleID, userID := opts.ID("role"), opts.ID("user")
+		if e.findRule(roleID) == nil {
+			command.Respond(s, i, fmt.Sprintf("<@&%s> は期限付きロールではありません。", roleID))
+			return
+		}
+		e.setGrant(roleID, userID, nil)
+		slog.Info("Reset role grant", "USER", userID, "ROLE", roleID, "BY", i.Member.User.ID)
+		command.Respond(s, i, fmt.Sprintf("<@%s> の <@&%s> の記録を消去しました。", userID, roleID))
+	})
+}
+
+// 設定と付与状況を表示用の文字列に変換
+func (e *expiryManager) status() string {
+	if len(e.rules) == 0 {
+		return "期限付きロールは設定されていません。"
+	}
+	b := &strings.Builder{}
+	e.grants.View(func(g *Grants) {
+		for _, r := range e.rules {
+			expired := utils.SlicesCount(utils.MapValues((*g)[r.RoleID]), func(gr *Grant) bool {
+				return gr.ExpiredAt != nil
+			})
+			fmt.Fprintf(b, "- <@&%s> 起点: %s", r.RoleID, r.Anchor)
+			if r.Anchor == AnchorFixed {
+				fmt.Fprintf(b, " (%s)", r.At.Format(time.DateTime))
+			}
+			if r.Duration != "" {
+				fmt.Fprintf(b, " 有効期間: %s", r.Duration)
+			}
+			if r.Protect {
+				fmt.Fprint(b, " 再付与保護あり")
+			}
+			fmt.Fprintf(b, " / 記録 %d件 (うち期限切れ %d件)\n", len((*g)[r.RoleID]), expired)
+		}
+	})
+	return b.String()
+}
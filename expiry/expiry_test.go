@@ -0,0 +1,187 @@
+package expiry_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+	"github.com/gw31415/pgautorole/expiry"
+	"github.com/gw31415/pgautorole/internal/store"
+)
+
+// メンバーの一覧を返し、ロールの剥奪を記録するトランスポート
+type fakeDiscord struct {
+	members []*discordgo.Member
+	// 剥奪したロール(ユーザーID/ロールID)
+	removed []string
+}
+
+func (f *fakeDiscord) RoundTrip(req *http.Request) (*http.Response, error) {
+	res := &http.Response{StatusCode: http.StatusNoContent, Body: http.NoBody, Header: http.Header{}, Request: req}
+	switch {
+	case req.Method == http.MethodGet && strings.HasSuffix(req.URL.Path, "/members"):
+		members := f.members
+		if req.URL.Query().Get("after") != "" {
+			members = nil
+		}
+		b, _ := json.Marshal(members)
+		res.StatusCode = http.StatusOK
+		res.Body = io.NopCloser(bytes.NewReader(b))
+	case req.Method == http.MethodDelete:
+		parts := strings.Split(req.URL.Path, "/")
+		f.removed = append(f.removed, parts[len(parts)-3]+"/"+parts[len(parts)-1])
+	}
+	return res, nil
+}
+
+func session(t *testing.T, f *fakeDiscord) *discordgo.Session {
+	s, err := discordgo.New("Bot token")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Client = &http.Client{Transport: f}
+	return s
+}
+
+func member(id string, joinedAt time.Time, roles ...string) *discordgo.Member {
+	return &discordgo.Member{GuildID: "g", User: &discordgo.User{ID: id}, JoinedAt: joinedAt, Roles: roles}
+}
+
+func TestRefreshExpiredRoles(t *testing.T) {
+	now := time.Now()
+	rules, err := expiry.ParseRules([]byte(`[
+		{"role_id": "event", "anchor": "grant", "duration": "30d"},
+		{"role_id": "trial", "anchor": "join", "duration": "1w"}
+	]`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	grants := store.Memory(expiry.Grants{
+		"event": {"old": {GrantedAt: now.Add(-31 * 24 * time.Hour)}},
+	})
+	f := &fakeDiscord{members: []*discordgo.Member{
+		member("old", now, "event"),
+		member("new", now, "event"),
+		member("joined", now.Add(-8*24*time.Hour), "trial"),
+		member("recent", now.Add(-24*time.Hour), "trial"),
+	}}
+	expiry.NewExpiryManager("g", rules, grants, nil).RefreshExpiredRoles(session(t, f))
+
+	if strings.Join(f.removed, ",") != "old/event,joined/trial" {
+		t.Fatalf("unexpected removed roles: %v", f.removed)
+	}
+	grants.View(func(g *expiry.Grants) {
+		if g := (*g)["event"]["old"]; g == nil || g.ExpiredAt == nil {
+			t.Fatalf("expected expired grant: %+v", g)
+		}
+		// 付与日時が不明なロールは確認した日時から有効期間を開始する
+		if g := (*g)["event"]["new"]; g == nil || g.GrantedAt.IsZero() || g.ExpiredAt != nil {
+			t.Fatalf("expected discovered grant: %+v", g)
+		}
+		if g := (*g)["trial"]["joined"]; g == nil || g.ExpiredAt == nil {
+			t.Fatalf("expected expired grant: %+v", g)
+		}
+		if _, ok := (*g)["trial"]["recent"]; ok {
+			t.Fatal("unexpected grant for unexpired join anchored role")
+		}
+	})
+}
+
+func TestRefreshExpiredRolesAborted(t *testing.T) {
+	rules, err := expiry.ParseRules([]byte(`[{"role_id": "trial", "anchor": "join", "duration": "1w"}]`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	grants := store.Memory(expiry.Grants{})
+	f := &fakeDiscord{members: []*discordgo.Member{
+		member("joined", time.Now().Add(-8*24*time.Hour), "trial"),
+		member("recent", time.Now(), "trial"),
+	}}
+	var changes, total int
+	expiry.NewExpiryManager("g", rules, grants, func(c, n int) bool {
+		changes, total = c, n
+		return false
+	}).RefreshExpiredRoles(session(t, f))
+
+	if changes != 1 || total != 2 {
+		t.Fatalf("unexpected bulk check: %d/%d", changes, total)
+	}
+	if len(f.removed) != 0 {
+		t.Fatalf("unexpected removed roles: %v", f.removed)
+	}
+}
+
+func TestMemberRoleUpdateHandler(t *testing.T) {
+	rules, err := expiry.ParseRules([]byte(`[
+		{"role_id": "event", "anchor": "grant", "duration": "30d", "protect": true}
+	]`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expiredAt := time.Now().Add(-time.Hour)
+	grants := store.Memory(expiry.Grants{
+		"event": {"expired": {ExpiredAt: &expiredAt}},
+	})
+	f := &fakeDiscord{}
+	s := session(t, f)
+	m := expiry.NewExpiryManager("g", rules, grants, nil)
+
+	update := func(id string) {
+		m.MemberRoleUpdateHandler(s, &discordgo.GuildMemberUpdate{
+			Member:       member(id, time.Now(), "event"),
+			BeforeUpdate: member(id, time.Now()),
+		})
+	}
+	// 期限切れ後の再付与は取り消す
+	update("expired")
+	// 新たな付与は記録する
+	update("fresh")
+
+	if strings.Join(f.removed, ",") != "expired/event" {
+		t.Fatalf("unexpected removed roles: %v", f.removed)
+	}
+	grants.View(func(g *expiry.Grants) {
+		if g := (*g)["event"]["fresh"]; g == nil || g.GrantedAt.IsZero() {
+			t.Fatalf("expected recorded grant: %+v", g)
+		}
+	})
+}
+
+func TestMemberRoleUpdateHandlerWithoutBeforeUpdate(t *testing.T) {
+	rules, err := expiry.ParseRules([]byte(`[
+		{"role_id": "event", "anchor": "grant", "duration": "30d"}
+	]`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	grantedAt := time.Now().Add(-10 * 24 * time.Hour)
+	grants := store.Memory(expiry.Grants{
+		"event": {"granted": {GrantedAt: grantedAt}},
+	})
+	f := &fakeDiscord{}
+	s := session(t, f)
+	m := expiry.NewExpiryManager("g", rules, grants, nil)
+
+	// 変更前のロールが不明な更新では、有効期間を開始し直さない
+	for _, id := range []string{"granted", "unknown"} {
+		m.MemberRoleUpdateHandler(s, &discordgo.GuildMemberUpdate{Member: member(id, time.Now(), "event")})
+	}
+
+	if len(f.removed) != 0 {
+		t.Fatalf("unexpected removed roles: %v", f.removed)
+	}
+	grants.View(func(g *expiry.Grants) {
+		if g := (*g)["event"]["granted"]; g == nil || !g.GrantedAt.Equal(grantedAt) {
+			t.Fatalf("expected unchanged grant: %+v", g)
+		}
+		// 記録がない場合は確認した日時から有効期間を開始する
+		if g := (*g)["event"]["unknown"]; g == nil || g.GrantedAt.IsZero() {
+			t.Fatalf("expected recorded grant: %+v", g)
+		}
+	})
+}
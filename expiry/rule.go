@@ -0,0 +1,116 @@
+package expiry
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/gw31415/pgautorole/internal/utils"
+)
+
+// 有効期間の起点
+type Anchor string
+
+const (
+	// サーバーへの参加日時
+	AnchorJoin Anchor = "join"
+	// ロールが付与された日時
+	AnchorGrant Anchor = "grant"
+	// 固定の日時
+	AnchorFixed Anchor = "fixed"
+)
+
+// ロールの有効期限の設定
+type Rule struct {
+	// 対象のロールID
+	RoleID string `json:"role_id"`
+	// 起点
+	Anchor Anchor `json:"anchor"`
+	// 起点からの有効期間(固定の日時の場合は省略可)
+	Duration string `json:"duration,omitempty"`
+	// 起点となる固定の日時(RFC3339)
+	At time.Time `json:"at,omitempty"`
+	// 期限切れ後に手動で再付与されたロールを取り消すかどうか
+	Protect bool `json:"protect,omitempty"`
+
+	// 解析済みの有効期間
+	duration time.Duration
+}
+
+// 設定を検証し、有効期間を解析する
+func (r *Rule) validate() error {
+	if r.RoleID == "" {
+		return fmt.Errorf("role_id is required")
+	}
+	d, err := utils.ParseDuration(r.Duration)
+	if err != nil {
+		return fmt.Errorf("role %s: %w", r.RoleID, err)
+	}
+	r.duration = d
+	switch r.Anchor {
+	case AnchorJoin, AnchorGrant:
+		if d <= 0 {
+			return fmt.Errorf("role %s: duration is required for anchor %q", r.RoleID, r.Anchor)
+		}
+	case AnchorFixed:
+		if r.At.IsZero() {
+			return fmt.Errorf("role %s: at is required for anchor %q", r.RoleID, r.Anchor)
+		}
+	default:
+		return fmt.Errorf("role %s: unknown anchor %q", r.RoleID, r.Anchor)
+	}
+	return nil
+}
+
+// 有効期限を計算
+// 起点が不明な場合はfalseを返す
+func (r *Rule) ExpiresAt(joinedAt, grantedAt time.Time) (time.Time, bool) {
+	var anchor time.Time
+	switch r.Anchor {
+	case AnchorJoin:
+		anchor = joinedAt
+	case AnchorGrant:
+		anchor = grantedAt
+	case AnchorFixed:
+		anchor = r.At
+	}
+	if anchor.IsZero() {
+		return time.Time{}, false
+	}
+	return anchor.Add(r.duration), true
+}
+
+// 参加日時を起点とする有効期限の設定を生成
+// 新入生ロールなど、他のマネージャが有効期限の計算に用いる
+func NewJoinRule(roleID string, d time.Duration) *Rule {
+	return &Rule{RoleID: roleID, Anchor: AnchorJoin, Duration: d.String(), duration: d}
+}
+
+// JSONファイルから有効期限の設定を読み込む
+func LoadRules(path string) ([]*Rule, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return ParseRules(b)
+}
+
+// JSONから有効期限の設定を解析
+func ParseRules(b []byte) ([]*Rule, error) {
+	rules := []*Rule{}
+	if err := json.Unmarshal(b, &rules); err != nil {
+		return nil, err
+	}
+	seen := map[string]bool{}
+	for _, r := range rules {
+		if err := r.validate(); err != nil {
+			return nil, err
+		}
+		if seen[r.RoleID] {
+			return nil, fmt.Errorf("role %s: duplicated rule", r.RoleID)
+		}
+		seen[r.RoleID] = true
+	}
+	return rules, nil
+}
@@ -0,0 +1,65 @@
+package expiry_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/gw31415/pgautorole/expiry"
+)
+
+func TestParseRules(t *testing.T) {
+	t.Run("Valid", func(t *testing.T) {
+		rules, err := expiry.ParseRules([]byte(`[
+			{"role_id": "event", "anchor": "grant", "duration": "30d", "protect": true},
+			{"role_id": "trial", "anchor": "join", "duration": "1w"},
+			{"role_id": "mod", "anchor": "fixed", "at": "2026-12-31T00:00:00+09:00"}
+		]`))
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if len(rules) != 3 {
+			t.Fatalf("unexpected length: %v", len(rules))
+		}
+	})
+	t.Run("Invalid", func(t *testing.T) {
+		srcs := []string{
+			`[{"anchor": "join", "duration": "1d"}]`,
+			`[{"role_id": "a", "anchor": "join"}]`,
+			`[{"role_id": "a", "anchor": "fixed"}]`,
+			`[{"role_id": "a", "anchor": "unknown", "duration": "1d"}]`,
+			`[{"role_id": "a", "anchor": "join", "duration": "1d"}, {"role_id": "a", "anchor": "grant", "duration": "1d"}]`,
+		}
+		for _, src := range srcs {
+			if _, err := expiry.ParseRules([]byte(src)); err == nil {
+				t.Fatalf("unexpected nil error for %s", src)
+			}
+		}
+	})
+}
+
+func TestExpiresAt(t *testing.T) {
+	rules, err := expiry.ParseRules([]byte(`[
+		{"role_id": "grant", "anchor": "grant", "duration": "30d"},
+		{"role_id": "join", "anchor": "join", "duration": "1d"},
+		{"role_id": "fixed", "anchor": "fixed", "at": "2026-12-31T00:00:00Z", "duration": "1h"}
+	]`))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	joinedAt := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	grantedAt := time.Date(2026, 2, 1, 0, 0, 0, 0, time.UTC)
+	expected := []time.Time{
+		grantedAt.Add(30 * 24 * time.Hour),
+		joinedAt.Add(24 * time.Hour),
+		time.Date(2026, 12, 31, 1, 0, 0, 0, time.UTC),
+	}
+	for i, r := range rules {
+		at, ok := r.ExpiresAt(joinedAt, grantedAt)
+		if !ok || !at.Equal(expected[i]) {
+			t.Fatalf("unexpected expiry for %s: %v", r.RoleID, at)
+		}
+	}
+	if _, ok := rules[0].ExpiresAt(joinedAt, time.Time{}); ok {
+		t.Fatalf("unexpected expiry without grant time")
+	}
+}
@@ -0,0 +1,328 @@
+package command
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+// 1メッセージに収まる最大文字数
+const MAX_MESSAGE_LENGTH = 2000
+
+// スラッシュコマンドのハンドラ
+type Handler func(s *discordgo.Session, i *discordgo.InteractionCreate, opts Options)
+
+// スラッシュコマンドのルーター
+type Router struct {
+	// commands, handlersを操作するためのロック
+	mu sync.RWMutex
+	// サーバーID
+	guildID string
+	// 登録順のコマンド定義
+	commands []*discordgo.ApplicationCommand
+	// コマンドパス("course create"など)からハンドラへのマップ
+	handlers map[string]Handler
+}
+
+// スラッシュコマンドのルーターを生成
+func NewRouter(guildID string) *Router {
+	return &Router{
+		guildID:  guildID,
+		handlers: make(map[string]Handler),
+	}
+}
+
+// サブコマンドを持たないコマンドを登録
+func (r *Router) Command(cmd *discordgo.ApplicationCommand, h Handler) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.commands = append(r.commands, cmd)
+	r.handlers[cmd.Name] = h
+}
+
+// サブコマンドを登録
+// 同名の親コマンドが既にあればそこにサブコマンドを追加する
+func (r *Router) Subcommand(parent *discordgo.ApplicationCommand, sub *discordgo.ApplicationCommandOption, h Handler) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	sub.Type = discordgo.ApplicationCommandOptionSubCommand
+	var cmd *discordgo.ApplicationCommand
+	for _, c := range r.commands {
+		if c.Name == parent.Name {
+			cmd = c
+			break
+		}
+	}
+	if cmd == nil {
+		// 親コマンドの定義は呼び出し側と共有しないようコピーする
+		c := *parent
+		c.Options = nil
+		cmd = &c
+		r.commands = append(r.commands, cmd)
+	}
+	cmd.Options = append(cmd.Options, sub)
+	r.handlers[parent.Name+" "+sub.Name] = h
+}
+
+// 登録済みのコマンドをサーバーに反映
+func (r *Router) ReadyHandler(s *discordgo.Session, u *discordgo.Ready) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	_, err := s.ApplicationCommandBulkOverwrite(s.State.User.ID, r.guildID, r.commands)
+	if err != nil {
+		slog.Error("Failed to register application commands", "err", err)
+		return
+	}
+	slog.Info("Application commands registered", "COUNT", len(r.commands))
+}
+
+// コマンドを対応するハンドラに振り分けるハンドラ
+func (r *Router) InteractionCreateHandler(s *discordgo.Session, i *discordgo.InteractionCreate) {
+	if i.Type != discordgo.InteractionApplicationCommand || i.GuildID != r.guildID {
+		return
+	}
+
+	data := i.ApplicationCommandData()
+	path := []string{data.Name}
+	opts := data.Options
+	// サブコマンドを辿ってハンドラのパスを組み立てる
+	for len(opts) == 1 && (opts[0].Type == discordgo.ApplicationCommandOptionSubCommand || opts[0].Type == discordgo.ApplicationCommandOptionSubCommandGroup) {
+		path = append(path, opts[0].Name)
+		opts = opts[0].Options
+	}
+
+	r.mu.RLock()
+	h := r.handlers[strings.Join(path, " ")]
+	r.mu.RUnlock()
+
+	if h == nil {
+		slog.Warn("Unknown command", "COMMAND", strings.Join(path, " "))
+		return
+	}
+	slog.Info("Command invoked", "COMMAND", strings.Join(path, " "), "USER", i.Member.User.ID)
+	h(s, i, Options{opts, data.Resolved, i.GuildID})
+}
+
+// コマンドに即座に応答する(本人にのみ表示)
+func Respond(s *discordgo.Session, i *discordgo.InteractionCreate, content string) {
+	err := s.InteractionRespond(i.Interaction, &discordgo.InteractionResponse{
+		Type: discordgo.InteractionResponseChannelMessageWithSource,
+		Data: &discordgo.InteractionResponseData{
+			Content: truncate(content),
+			Flags:   discordgo.MessageFlagsEphemeral,
+		},
+	})
+	if err != nil {
+		slog.Error("Failed to respond to interaction", "err", err)
+	}
+}
+
+// 応答を保留する(本人にのみ表示)
+func deferResponse(s *discordgo.Session, i *discordgo.InteractionCreate) bool {
+	err := s.InteractionRespond(i.Interaction, &discordgo.InteractionResponse{
+		Type: discordgo.InteractionResponseDeferredChannelMessageWithSource,
+		Data: &discordgo.InteractionResponseData{
+			Flags: discordgo.MessageFlagsEphemeral,
+		},
+	})
+	if err != nil {
+		slog.Error("Failed to defer interaction", "err", err)
+		return false
+	}
+	return true
+}
+
+// 保留した応答を編集する
+func editResponse(s *discordgo.Session, i *discordgo.InteractionCreate, edit *discordgo.WebhookEdit) {
+	if _, err := s.InteractionResponseEdit(i.Interaction, edit); err != nil {
+		slog.Error("Failed to edit interaction response", "err", err)
+	}
+}
+
+// 時間のかかる処理を行い、その結果で応答する(本人にのみ表示)
+// 結果が1メッセージに収まらない場合はテキストファイルとして添付する
+func Deferred(s *discordgo.Session, i *discordgo.InteractionCreate, f func() string) {
+	if !deferResponse(s, i) {
+		return
+	}
+
+	content := f()
+	edit := &discordgo.WebhookEdit{Content: &content}
+	if len(content) > MAX_MESSAGE_LENGTH {
+		summary := truncate(content)
+		edit = &discordgo.WebhookEdit{
+			Content: &summary,
+			Files: []*discordgo.File{{
+				Name:        "result.txt",
+				ContentType: "text/plain",
+				Reader:      strings.NewReader(content),
+			}},
+		}
+	}
+	editResponse(s, i, edit)
+}
+
+// 時間のかかる処理を行い、その結果をファイルとして添付して応答する(本人にのみ表示)
+// fileがnilの場合はメッセージのみで応答する
+func DeferredFile(s *discordgo.Session, i *discordgo.InteractionCreate, f func() (content string, file *discordgo.File)) {
+	if !deferResponse(s, i) {
+		return
+	}
+
+	content, file := f()
+	content = truncate(content)
+	edit := &discordgo.WebhookEdit{Content: &content}
+	if file != nil {
+		edit.Files = []*discordgo.File{file}
+	}
+	editResponse(s, i, edit)
+}
+
+// 1メッセージに収まるよう文字列を切り詰める
+func truncate(content string) string {
+	if len(content) <= MAX_MESSAGE_LENGTH {
+		return content
+	}
+	const ellipsis = "\n…"
+	// マルチバイト文字の途中で切らないようにする
+	cut := MAX_MESSAGE_LENGTH - len(ellipsis)
+	for cut > 0 && !isRuneStart(content[cut]) {
+		cut--
+	}
+	return content[:cut] + ellipsis
+}
+
+// 1メッセージに収まるよう行単位で文字列を分割する
+// 1行で収まらない行は切り詰める
+func SplitMessage(content string) []string {
+	chunks := []string{}
+	current := ""
+	for _, line := range strings.Split(content, "\n") {
+		line = truncate(line)
+		if current != "" && len(current)+1+len(line) > MAX_MESSAGE_LENGTH {
+			chunks = append(chunks, current)
+			current = ""
+		}
+		if current != "" {
+			current += "\n"
+		}
+		current += line
+	}
+	if strings.TrimSpace(current) != "" {
+		chunks = append(chunks, current)
+	}
+	return chunks
+}
+
+func isRuneStart(b byte) bool {
+	return b&0xC0 != 0x80
+}
+
+// コマンドを既定で使用できる権限を指定するための値を生成
+func Permission(p int64) *int64 {
+	return &p
+}
+
+// コマンドの引数
+type Options struct {
+	opts     []*discordgo.ApplicationCommandInteractionDataOption
+	resolved *discordgo.ApplicationCommandInteractionDataResolved
+	guildID  string
+}
+
+// 名前から引数を取得
+func (o Options) Get(name string) *discordgo.ApplicationCommandInteractionDataOption {
+	for _, opt := range o.opts {
+		if opt.Name == name {
+			return opt
+		}
+	}
+	return nil
+}
+
+// 文字列の引数を取得
+func (o Options) String(name string) string {
+	if opt := o.Get(name); opt != nil {
+		return opt.StringValue()
+	}
+	return ""
+}
+
+// 整数の引数を取得
+func (o Options) Int(name string) (int64, bool) {
+	if opt := o.Get(name); opt != nil {
+		return opt.IntValue(), true
+	}
+	return 0, false
+}
+
+// 真偽値の引数を取得
+func (o Options) Bool(name string) bool {
+	if opt := o.Get(name); opt != nil {
+		return opt.BoolValue()
+	}
+	return false
+}
+
+// ユーザーやロール、チャンネルなどIDで渡される引数を取得
+func (o Options) ID(name string) string {
+	if opt := o.Get(name); opt != nil {
+		if id, ok := opt.Value.(string); ok {
+			return id
+		}
+	}
+	return ""
+}
+
+// ユーザーの引数をサーバーのメンバーとして取得
+func (o Options) Member(name string) *discordgo.Member {
+	id := o.ID(name)
+	if id == "" || o.resolved == nil {
+		return nil
+	}
+	member := o.resolved.Members[id]
+	if member == nil {
+		return nil
+	}
+	// Resolvedのメンバー情報にはユーザー情報が含まれない
+	m := *member
+	m.User = o.resolved.Users[id]
+	m.GuildID = o.guildID
+	return &m
+}
+
+// 添付ファイルの引数を取得
+func (o Options) Attachment(name string) *discordgo.MessageAttachment {
+	id := o.ID(name)
+	if id == "" || o.resolved == nil {
+		return nil
+	}
+	return o.resolved.Attachments[id]
+}
+
+// 読み込む添付ファイルの最大サイズ
+const MAX_ATTACHMENT_SIZE = 1 << 20
+
+// 添付ファイルの内容を取得
+func DownloadAttachment(s *discordgo.Session, a *discordgo.MessageAttachment) ([]byte, error) {
+	if a.Size > MAX_ATTACHMENT_SIZE {
+		return nil, fmt.Errorf("attachment is too large: %d bytes", a.Size)
+	}
+	resp, err := s.Client.Get(a.URL)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("failed to download attachment: %s", resp.Status)
+	}
+	return io.ReadAll(io.LimitReader(resp.Body, MAX_ATTACHMENT_SIZE))
+}
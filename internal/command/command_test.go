@@ -0,0 +1,49 @@
+package command_test
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/gw31415/pgautorole/internal/command"
+)
+
+func TestSplitMessage(t *testing.T) {
+	t.Run("Short", func(t *testing.T) {
+		chunks := command.SplitMessage("a\nb")
+		if len(chunks) != 1 || chunks[0] != "a\nb" {
+			t.Fatalf("unexpected chunks: %q", chunks)
+		}
+	})
+	t.Run("Long", func(t *testing.T) {
+		line := strings.Repeat("あ", 100)
+		lines := []string{}
+		for range 50 {
+			lines = append(lines, line)
+		}
+		chunks := command.SplitMessage(strings.Join(lines, "\n"))
+		if len(chunks) < 2 {
+			t.Fatalf("expected multiple chunks: %v", len(chunks))
+		}
+		total := 0
+		for _, c := range chunks {
+			if len(c) > command.MAX_MESSAGE_LENGTH {
+				t.Fatalf("chunk too long: %v", len(c))
+			}
+			total += strings.Count(c, "\n") + 1
+		}
+		if total != len(lines) {
+			t.Fatalf("lines lost: %v", total)
+		}
+	})
+	t.Run("LongLine", func(t *testing.T) {
+		chunks := command.SplitMessage(strings.Repeat("a", 3000))
+		if len(chunks) != 1 || len(chunks[0]) > command.MAX_MESSAGE_LENGTH {
+			t.Fatalf("unexpected chunks: %v", len(chunks))
+		}
+	})
+	t.Run("Empty", func(t *testing.T) {
+		if chunks := command.SplitMessage(""); len(chunks) != 0 {
+			t.Fatalf("unexpected chunks: %q", chunks)
+		}
+	})
+}
@@ -0,0 +1,82 @@
+package store
+
+import (
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// JSONファイルに永続化される値
+type Store[T any] struct {
+	// valueを操作するためのロック
+	mu sync.RWMutex
+	// 保存先のパス(空の場合は永続化しない)
+	path string
+	// 現在の値
+	value T
+}
+
+// ファイルから値を読み込んでStoreを生成
+// ファイルが存在しない場合はinitialを初期値とする
+func Open[T any](path string, initial T) (*Store[T], error) {
+	s := &Store[T]{path: path, value: initial}
+	if path == "" {
+		return s, nil
+	}
+	b, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return s, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(b, &s.value); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// 永続化しないStoreを生成
+func Memory[T any](initial T) *Store[T] {
+	return &Store[T]{value: initial}
+}
+
+// 値を読み取る
+// fの中で値を変更してはならない
+func (s *Store[T]) View(f func(v *T)) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	f(&s.value)
+}
+
+// 値を更新して保存する
+// fがエラーを返した場合は保存しない
+func (s *Store[T]) Update(f func(v *T) error) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := f(&s.value); err != nil {
+		return err
+	}
+	return s.save()
+}
+
+// 一時ファイルに書き込んでから置き換えることで、書き込み途中のファイルが残らないようにする
+func (s *Store[T]) save() error {
+	if s.path == "" {
+		return nil
+	}
+	b, err := json.MarshalIndent(s.value, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(s.path), 0o755); err != nil {
+		return err
+	}
+	tmp := s.path + ".tmp"
+	if err := os.WriteFile(tmp, b, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, s.path)
+}
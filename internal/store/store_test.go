@@ -0,0 +1,57 @@
+package store_test
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+
+	"github.com/gw31415/pgautorole/internal/store"
+)
+
+func TestStore(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "sub", "store.json")
+
+	t.Run("Initial", func(t *testing.T) {
+		s, err := store.Open(path, map[string]int{"a": 1})
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		s.View(func(v *map[string]int) {
+			if (*v)["a"] != 1 {
+				t.Fatalf("unexpected value: %v", *v)
+			}
+		})
+		err = s.Update(func(v *map[string]int) error {
+			(*v)["b"] = 2
+			return nil
+		})
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	})
+
+	t.Run("Reopen", func(t *testing.T) {
+		s, err := store.Open(path, map[string]int{})
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		s.View(func(v *map[string]int) {
+			if len(*v) != 2 || (*v)["b"] != 2 {
+				t.Fatalf("unexpected value: %v", *v)
+			}
+		})
+	})
+
+	t.Run("Error", func(t *testing.T) {
+		s, err := store.Open(path, map[string]int{})
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		err = s.Update(func(v *map[string]int) error {
+			return errors.New("abort")
+		})
+		if err == nil {
+			t.Fatalf("unexpected nil")
+		}
+	})
+}
@@ -0,0 +1,93 @@
+package utils
+
+import "github.com/bwmarrin/discordgo"
+
+// 一度に取得するメンバー数
+const MEMBERS_PER_REQUEST = 1000
+
+// サーバーのメンバーをMEMBERS_PER_REQUESTずつ取得し、ページごとにfを呼び出す
+func ForEachMemberPage(s *discordgo.Session, guildID string, f func(members []*discordgo.Member)) error {
+	after := ""
+	for {
+		members, err := s.GuildMembers(guildID, after, MEMBERS_PER_REQUEST)
+		if err != nil {
+			return err
+		}
+		if len(members) == 0 {
+			return nil
+		}
+		f(members)
+		after = members[len(members)-1].User.ID
+	}
+}
+
+// サーバーの全メンバーを取得
+func GuildMembers(s *discordgo.Session, guildID string) ([]*discordgo.Member, error) {
+	all := []*discordgo.Member{}
+	err := ForEachMemberPage(s, guildID, func(members []*discordgo.Member) {
+		all = append(all, members...)
+	})
+	return all, err
+}
+
+// 自動処理の対象外とする理由
+type SkipReason string
+
+const (
+	// 対象
+	NotSkipped SkipReason = ""
+	// ボット
+	SkippedBot SkipReason = "bot"
+	// メンバー認証を通過していない
+	SkippedPending SkipReason = "pending"
+)
+
+// 自動処理の対象とするメンバーの条件
+type MemberFilter struct {
+	// ボットを対象外とする
+	SkipBots bool
+	// メンバー認証(Membership Screening)を通過していないメンバーを対象外とする
+	SkipPending bool
+}
+
+// メンバーが自動処理の対象外かどうか
+func (f MemberFilter) Skip(member *discordgo.Member) SkipReason {
+	if f.SkipBots && member.User != nil && member.User.Bot {
+		return SkippedBot
+	}
+	if f.SkipPending && member.Pending {
+		return SkippedPending
+	}
+	return NotSkipped
+}
+
+// 自動処理の対象外としたメンバーの集計
+type SkipCounts map[SkipReason]int
+
+// 対象外かどうか判定し、対象外なら集計する
+func (c SkipCounts) Skip(f MemberFilter, member *discordgo.Member) bool {
+	reason := f.Skip(member)
+	if reason == NotSkipped {
+		return false
+	}
+	c[reason]++
+	return true
+}
+
+// ログ出力用の属性
+func (c SkipCounts) LogAttrs() []any {
+	return []any{"SKIPPED_BOTS", c[SkippedBot], "SKIPPED_PENDING", c[SkippedPending]}
+}
+
+// ユーザーにダイレクトメッセージを送信
+func SendDirectMessage(s *discordgo.Session, userID, content string) error {
+	ch, err := s.UserChannelCreate(userID)
+	if err != nil {
+		return err
+	}
+	_, err = s.ChannelMessageSendComplex(ch.ID, &discordgo.MessageSend{
+		Content:         content,
+		AllowedMentions: &discordgo.MessageAllowedMentions{},
+	})
+	return err
+}
@@ -0,0 +1,43 @@
+package utils
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"time"
+)
+
+var durationPart = regexp.MustCompile(`^([0-9]+(?:\.[0-9]+)?)([a-zµ]+)`)
+
+// 期間を解析
+// time.ParseDurationの単位に加え、日(d)と週(w)を使用できる
+func ParseDuration(s string) (time.Duration, error) {
+	var total time.Duration
+	rest := s
+	for rest != "" {
+		m := durationPart.FindStringSubmatch(rest)
+		if m == nil {
+			return 0, fmt.Errorf("不正な期間 %q", s)
+		}
+		switch m[2] {
+		case "d", "w":
+			n, err := strconv.ParseFloat(m[1], 64)
+			if err != nil {
+				return 0, fmt.Errorf("不正な期間 %q", s)
+			}
+			unit := 24 * time.Hour
+			if m[2] == "w" {
+				unit *= 7
+			}
+			total += time.Duration(n * float64(unit))
+		default:
+			d, err := time.ParseDuration(m[0])
+			if err != nil {
+				return 0, fmt.Errorf("不正な期間 %q", s)
+			}
+			total += d
+		}
+		rest = rest[len(m[0]):]
+	}
+	return total, nil
+}
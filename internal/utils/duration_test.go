@@ -0,0 +1,26 @@
+package utils_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/gw31415/pgautorole/internal/utils"
+)
+
+func TestParseDuration(t *testing.T) {
+	cases := map[string]time.Duration{
+		"90d":       90 * 24 * time.Hour,
+		"1w12h":     7*24*time.Hour + 12*time.Hour,
+		"2160h0m0s": 2160 * time.Hour,
+		"1.5d":      36 * time.Hour,
+	}
+	for src, want := range cases {
+		got, err := utils.ParseDuration(src)
+		if err != nil {
+			t.Fatalf("unexpected error for %q: %v", src, err)
+		}
+		if got != want {
+			t.Fatalf("unexpected duration for %q: %v", src, got)
+		}
+	}
+}
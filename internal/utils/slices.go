@@ -46,3 +46,12 @@ func SlicesDifference[T comparable](a []T, b []T) []T {
 		return !slices.Contains(b, v)
 	})
 }
+
+// マップの値をスライスとして取得
+func MapValues[K comparable, V any](m map[K]V) []V {
+	values := make([]V, 0, len(m))
+	for _, v := range m {
+		values = append(values, v)
+	}
+	return values
+}
@@ -1,16 +1,29 @@
 package main
 
 import (
+	"cmp"
+	_ "expvar"
 	"log/slog"
+	"net/http"
 	"os"
 	"os/signal"
+	"path/filepath"
+	"slices"
+	"strconv"
 	"strings"
 	"syscall"
 	"time"
 
 	"github.com/bwmarrin/discordgo"
+	"github.com/gw31415/pgautorole/breaker"
 	"github.com/gw31415/pgautorole/course"
+	"github.com/gw31415/pgautorole/expiry"
+	"github.com/gw31415/pgautorole/internal/command"
+	"github.com/gw31415/pgautorole/internal/store"
+	"github.com/gw31415/pgautorole/internal/utils"
 	"github.com/gw31415/pgautorole/newbie"
+	"github.com/gw31415/pgautorole/preflight"
+	"github.com/gw31415/pgautorole/snapshot"
 	"github.com/robfig/cron/v3"
 )
 
@@ -29,10 +42,79 @@ var (
 	NEWBIE_ROLE_ID = os.Getenv("NEWBIE_ROLE_ID")
 	// 新規会員のロールをリフレッシュするスケジュール
 	NEWBIE_REFRESHING_CRON = os.Getenv("NEWBIE_REFRESHING_CRON")
-	// 新規会員のロールの有効期間
+	// 新規会員のロールの有効期間(NEWBIE_RULEを指定した場合は不要)
 	NEWBIE_MAX_DURATION, _ = time.ParseDuration(os.Getenv("NEWBIE_MAX_DURATION"))
 	// 新規会員から外すロール(ホワイトリスト)
-	NEWBIE_WHITE_ROLE_IDS = strings.Split(os.Getenv("NEWBIE_WHITE_ROLE_IDS"), ",")
+	// 空の場合に空文字列のロールIDを含まないようにする
+	NEWBIE_WHITE_ROLE_IDS = strings.FieldsFunc(os.Getenv("NEWBIE_WHITE_ROLE_IDS"), func(r rune) bool {
+		return r == ','
+	})
+	// 新規会員の判定式(省略時は既定の判定式)
+	NEWBIE_RULE = os.Getenv("NEWBIE_RULE")
+	// 新規会員の判定式で使用するロールの別名
+	NEWBIE_RULE_ROLES = os.Getenv("NEWBIE_RULE_ROLES")
+	// 新規会員の経過時間を再参加前の初回参加日時から数える(省略時は現在の参加日時から数える)
+	NEWBIE_AGE_FROM_FIRST_JOIN = len(os.Getenv("NEWBIE_AGE_FROM_FIRST_JOIN")) > 0
+	// 新規会員のダイジェストを投稿するスケジュール(省略時は投稿しない)
+	NEWBIE_DIGEST_CRON = os.Getenv("NEWBIE_DIGEST_CRON")
+
+	// 期限付きロールの設定ファイル(省略時は使用しない)
+	EXPIRY_CONFIG = os.Getenv("EXPIRY_CONFIG")
+	// 期限切れのロールを剥奪するスケジュール
+	EXPIRY_REFRESHING_CRON = cmp.Or(os.Getenv("EXPIRY_REFRESHING_CRON"), "@hourly")
+
+	// コース作成時のロールの設定ファイル(省略時は既定の設定)
+	COURSE_ROLE_TEMPLATE = os.Getenv("COURSE_ROLE_TEMPLATE")
+
+	// コースごとのカテゴリとチャンネルの設定ファイル(省略時は管理しない)
+	COURSE_CHANNEL_TEMPLATE = os.Getenv("COURSE_CHANNEL_TEMPLATE")
+
+	// 同時に受講できるコース数の上限(省略時は無制限)
+	COURSE_MAX_ENROLLMENTS = cmp.Or(os.Getenv("COURSE_MAX_ENROLLMENTS"), "0")
+	// 受講できるコース数の上限を適用しないロールID
+	COURSE_ENROLLMENT_EXEMPT_ROLE_IDS = strings.FieldsFunc(os.Getenv("COURSE_ENROLLMENT_EXEMPT_ROLE_IDS"), func(r rune) bool {
+		return r == ','
+	})
+
+	// コースのレベルの昇格ルールの設定ファイル(省略時は自動昇格しない)
+	COURSE_PROMOTION_CONFIG = os.Getenv("COURSE_PROMOTION_CONFIG")
+	// 昇格ルールを評価するスケジュール
+	COURSE_PROMOTION_CRON = cmp.Or(os.Getenv("COURSE_PROMOTION_CRON"), "@daily")
+
+	// コースレベルロールが重複した場合の解決方針
+	COURSE_CONFLICT_POLICY = os.Getenv("COURSE_CONFLICT_POLICY")
+
+	// コース関連ロールを検査・修復するスケジュール
+	COURSE_REPAIR_CRON = cmp.Or(os.Getenv("COURSE_REPAIR_CRON"), "@daily")
+
+	// ボットも自動処理の対象とする
+	INCLUDE_BOTS = len(os.Getenv("INCLUDE_BOTS")) > 0
+	// メンバー認証を通過していないメンバーも自動処理の対象とする
+	INCLUDE_PENDING = len(os.Getenv("INCLUDE_PENDING")) > 0
+
+	// 永続化データの保存先
+	DATA_DIR = cmp.Or(os.Getenv("DATA_DIR"), "data")
+
+	// 運営用チャンネルのID
+	STAFF_CHANNEL_ID = os.Getenv("STAFF_CHANNEL_ID")
+
+	// メトリクス(/debug/vars)を公開するアドレス(省略時は公開しない)
+	METRICS_ADDR = os.Getenv("METRICS_ADDR")
+
+	// ロールのスナップショットを保存するスケジュール
+	SNAPSHOT_CRON = cmp.Or(os.Getenv("SNAPSHOT_CRON"), "@daily")
+	// 保存するスナップショットの数(省略時は14, 0で無制限)
+	SNAPSHOT_RETENTION = cmp.Or(os.Getenv("SNAPSHOT_RETENTION"), "14")
+
+	// ロールの変更を停止するまでの変更数(省略時は100, 0以下で無効)
+	BREAKER_MAX_CHANGES = cmp.Or(os.Getenv("BREAKER_MAX_CHANGES"), "100")
+	// ロールの変更数を数える期間
+	BREAKER_WINDOW = cmp.Or(os.Getenv("BREAKER_WINDOW"), "5m")
+	// 定期更新で変更してよいメンバーの割合(%, 省略時は20, 0以下で無効)
+	BREAKER_MAX_BULK_PERCENT = cmp.Or(os.Getenv("BREAKER_MAX_BULK_PERCENT"), "20")
+
+	// 起動時の検査で操作できないロールがあれば起動しない
+	PREFLIGHT_STRICT = len(os.Getenv("PREFLIGHT_STRICT")) > 0
 )
 
 func main() {
@@ -42,7 +124,7 @@ func main() {
 	}
 
 	// 環境変数のチェック
-	if DISCORD_TOKEN == "" || MEMBER_ROLE_ID == "" || NEWBIE_ROLE_ID == "" || NEWBIE_REFRESHING_CRON == "" || NEWBIE_MAX_DURATION == 0 {
+	if DISCORD_TOKEN == "" || MEMBER_ROLE_ID == "" || NEWBIE_ROLE_ID == "" || NEWBIE_REFRESHING_CRON == "" || (NEWBIE_MAX_DURATION == 0 && NEWBIE_RULE == "") {
 		slog.Error("Please set environment variables")
 		return
 	}
@@ -50,14 +132,53 @@ func main() {
 	// Discordセッションの初期化
 	discord, err := discordgo.New("Bot " + DISCORD_TOKEN)
 	if err != nil {
-		slog.Error("Error creating Discord session:", err)
+		slog.Error("Error creating Discord session", "err", err)
 		return
 	}
 	discord.Identify.Intents = discordgo.IntentsGuildMembers | discordgo.IntentsGuilds
 
+	// サーキットブレーカーの設定
+	breakerWindow, err := time.ParseDuration(BREAKER_WINDOW)
+	if err != nil {
+		slog.Error("Error parsing BREAKER_WINDOW", "err", err)
+		return
+	}
+	breakerMaxChanges, err := strconv.Atoi(BREAKER_MAX_CHANGES)
+	if err != nil {
+		slog.Error("Error parsing BREAKER_MAX_CHANGES", "BREAKER_MAX_CHANGES", BREAKER_MAX_CHANGES, "err", err)
+		return
+	}
+	breakerMaxBulkPercent, err := strconv.Atoi(BREAKER_MAX_BULK_PERCENT)
+	if err != nil {
+		slog.Error("Error parsing BREAKER_MAX_BULK_PERCENT", "BREAKER_MAX_BULK_PERCENT", BREAKER_MAX_BULK_PERCENT, "err", err)
+		return
+	}
+	breakerState, err := store.Open(filepath.Join(DATA_DIR, "breaker_state.json"), breaker.State{})
+	if err != nil {
+		slog.Error("Error loading circuit breaker state", "err", err)
+		return
+	}
+	circuitbreaker := breaker.NewCircuitBreaker(discord, breaker.Options{
+		MaxChanges:     breakerMaxChanges,
+		Window:         breakerWindow,
+		MaxBulkPercent: breakerMaxBulkPercent,
+		AlertChannelID: STAFF_CHANNEL_ID,
+		State:          breakerState,
+	})
+	discord.Client.Transport = circuitbreaker.Transport(discord.Client.Transport)
+	if circuitbreaker.Paused() {
+		slog.Warn("Role mutations are paused. Use /bot resume to continue.")
+	}
+
+	// 自動処理の対象とするメンバーの条件
+	filter := utils.MemberFilter{SkipBots: !INCLUDE_BOTS, SkipPending: !INCLUDE_PENDING}
+
 	// cronの初期化
 	cr := cron.New()
 
+	// スラッシュコマンドの初期化
+	router := command.NewRouter(GUILD_ID)
+
 	// 対応外のサーバーから退出する設定
 	discord.AddHandler(func(s *discordgo.Session, m *discordgo.GuildCreate) {
 		if m.Guild.ID != GUILD_ID {
@@ -74,34 +195,276 @@ func main() {
 		}
 	})
 
+	// ロールを変更するハンドラ(権限の事前検査の後に登録する)
+	mutationHandlers := []any{}
+
+	// 権限の事前検査の対象とするロール
+	preflightTargets := []preflight.Target{
+		{RoleID: MEMBER_ROLE_ID, Label: "MEMBER_ROLE_ID"},
+		{RoleID: NEWBIE_ROLE_ID, Label: "NEWBIE_ROLE_ID"},
+	}
+	for _, id := range NEWBIE_WHITE_ROLE_IDS {
+		preflightTargets = append(preflightTargets, preflight.Target{RoleID: id, Label: "NEWBIE_WHITE_ROLE_IDS"})
+	}
+
 	// NewbieManagerの設定
 	slog.Info("Setting up NewbieManager", "MEMBER_ROLE_ID", MEMBER_ROLE_ID, "NEWBIE_ROLE_ID", NEWBIE_ROLE_ID, "NEWBIE_MAX_DURATION", NEWBIE_MAX_DURATION)
-	newbiemanager := newbie.NewNewbieManager(GUILD_ID, NEWBIE_ROLE_ID, MEMBER_ROLE_ID, NEWBIE_WHITE_ROLE_IDS, NEWBIE_MAX_DURATION)
-	discord.AddHandler(newbiemanager.MemberRoleUpdateHandler)
+	joinHistory, err := store.Open(filepath.Join(DATA_DIR, "join_history.json"), newbie.JoinHistory{})
+	if err != nil {
+		slog.Error("Error loading join history", "err", err)
+		return
+	}
+	aliases, err := newbie.ParseRoleAliases(NEWBIE_RULE_ROLES)
+	if err != nil {
+		slog.Error("Error parsing NEWBIE_RULE_ROLES", "err", err)
+		return
+	}
+	aliases["Member"] = []string{MEMBER_ROLE_ID}
+	aliases["Newbie"] = []string{NEWBIE_ROLE_ID}
+	aliases["White"] = NEWBIE_WHITE_ROLE_IDS
+	rule, err := newbie.ParseRule(cmp.Or(NEWBIE_RULE, newbie.DefaultRuleSource(NEWBIE_MAX_DURATION)), aliases)
+	if err != nil {
+		slog.Error("Error parsing NEWBIE_RULE", "err", err)
+		return
+	}
+	slog.Info("Newbie rule", "NEWBIE_RULE", rule)
+	newbiemanager := newbie.NewNewbieManager(GUILD_ID, NEWBIE_ROLE_ID, MEMBER_ROLE_ID, rule, joinHistory, filter, func(changes, total int) bool {
+		return circuitbreaker.AllowBulk("新入生ロールの定期更新", changes, total)
+	}, NEWBIE_AGE_FROM_FIRST_JOIN)
+	mutationHandlers = append(mutationHandlers,
+		newbiemanager.MemberRoleUpdateHandler,
+		newbiemanager.MemberAddHandler,
+		newbiemanager.MemberRemoveHandler,
+	)
 	_, err = cr.AddFunc(NEWBIE_REFRESHING_CRON, func() {
 		slog.Info("Refreshing newbie roles")
 		newbiemanager.RefreshNewbieRoles(discord)
 	})
 	if err != nil {
-		slog.Error("Error adding cron job:", err)
+		slog.Error("Error adding cron job", "err", err)
 		return
 	}
+	if NEWBIE_DIGEST_CRON != "" {
+		if STAFF_CHANNEL_ID == "" {
+			slog.Error("Please set STAFF_CHANNEL_ID to post newbie digest")
+			return
+		}
+		_, err = cr.AddFunc(NEWBIE_DIGEST_CRON, func() {
+			slog.Info("Posting newbie digest")
+			newbiemanager.PostDigest(discord, STAFF_CHANNEL_ID)
+		})
+		if err != nil {
+			slog.Error("Error adding cron job", "err", err)
+			return
+		}
+	}
+	newbiemanager.RegisterCommands(router)
+	circuitbreaker.RegisterCommands(router)
+
+	// ExpiryManagerの設定
+	if EXPIRY_CONFIG != "" {
+		rules, err := expiry.LoadRules(EXPIRY_CONFIG)
+		if err != nil {
+			slog.Error("Error loading EXPIRY_CONFIG", "err", err)
+			return
+		}
+		slog.Info("Setting up ExpiryManager", "RULES", len(rules))
+		grants, err := store.Open(filepath.Join(DATA_DIR, "role_grants.json"), expiry.Grants{})
+		if err != nil {
+			slog.Error("Error loading role grants", "err", err)
+			return
+		}
+		for _, r := range rules {
+			preflightTargets = append(preflightTargets, preflight.Target{RoleID: r.RoleID, Label: "EXPIRY_CONFIG"})
+		}
+		expirymanager := expiry.NewExpiryManager(GUILD_ID, rules, grants, func(changes, total int) bool {
+			return circuitbreaker.AllowBulk("期限付きロールの定期更新", changes, total)
+		})
+		mutationHandlers = append(mutationHandlers, expirymanager.MemberRoleUpdateHandler)
+		_, err = cr.AddFunc(EXPIRY_REFRESHING_CRON, func() {
+			slog.Info("Refreshing expired roles")
+			expirymanager.RefreshExpiredRoles(discord)
+		})
+		if err != nil {
+			slog.Error("Error adding cron job", "err", err)
+			return
+		}
+		expirymanager.RegisterCommands(router)
+	}
 
 	// CourseManagerの設定
 	slog.Info("Setting up CourseManager")
-	coursemanager := course.NewCourseManager(GUILD_ID)
-	discord.AddHandler(coursemanager.ReadyHandler)
-	discord.AddHandler(coursemanager.GuildCreateHandler)
-	discord.AddHandler(coursemanager.GuildRoleCreateHandler)
-	discord.AddHandler(coursemanager.GulidRoleUpdateHandler)
-	discord.AddHandler(coursemanager.GuildRoleDeleteHandler)
-	discord.AddHandler(coursemanager.MemberRoleUpdateHandler)
+	roleTemplate, err := course.LoadRoleTemplate(COURSE_ROLE_TEMPLATE)
+	if err != nil {
+		slog.Error("Error loading COURSE_ROLE_TEMPLATE", "err", err)
+		return
+	}
+	channelTemplate, err := course.LoadChannelTemplate(COURSE_CHANNEL_TEMPLATE)
+	if err != nil {
+		slog.Error("Error loading COURSE_CHANNEL_TEMPLATE", "err", err)
+		return
+	}
+	courseChannels, err := store.Open(filepath.Join(DATA_DIR, "course_channels.json"), course.CourseChannels{})
+	if err != nil {
+		slog.Error("Error loading course channels", "err", err)
+		return
+	}
+	courseDefinitions, err := store.Open(filepath.Join(DATA_DIR, "course_definitions.json"), course.CourseDefinitions{})
+	if err != nil {
+		slog.Error("Error loading course definitions", "err", err)
+		return
+	}
+	courseWaitlists, err := store.Open(filepath.Join(DATA_DIR, "course_waitlists.json"), course.Waitlists{})
+	if err != nil {
+		slog.Error("Error loading course waitlists", "err", err)
+		return
+	}
+	courseHistory, err := store.Open(filepath.Join(DATA_DIR, "course_history.json"), course.CourseHistory{})
+	if err != nil {
+		slog.Error("Error loading course history", "err", err)
+		return
+	}
+	courseAuditLog, err := store.Open(filepath.Join(DATA_DIR, "course_audit.json"), course.AuditLog{})
+	if err != nil {
+		slog.Error("Error loading course audit log", "err", err)
+		return
+	}
+	promotionRules, err := course.LoadPromotionRules(COURSE_PROMOTION_CONFIG)
+	if err != nil {
+		slog.Error("Error loading COURSE_PROMOTION_CONFIG", "err", err)
+		return
+	}
+	conflictPolicy, err := course.ParseConflictPolicy(COURSE_CONFLICT_POLICY)
+	if err != nil {
+		slog.Error("Error parsing COURSE_CONFLICT_POLICY", "err", err)
+		return
+	}
+	maxEnrollments, err := strconv.Atoi(COURSE_MAX_ENROLLMENTS)
+	if err != nil || maxEnrollments < 0 {
+		slog.Error("Error parsing COURSE_MAX_ENROLLMENTS", "COURSE_MAX_ENROLLMENTS", COURSE_MAX_ENROLLMENTS, "err", err)
+		return
+	}
+	coursemanager := course.NewCourseManager(GUILD_ID, course.Options{
+		Filter:          filter,
+		RoleTemplate:    roleTemplate,
+		ChannelTemplate: channelTemplate,
+		Channels:        courseChannels,
+		Definitions:     courseDefinitions,
+		Waitlists:       courseWaitlists,
+		MaxEnrollments:  maxEnrollments,
+		ExemptRoleIDs:   COURSE_ENROLLMENT_EXEMPT_ROLE_IDS,
+		History:         courseHistory,
+		AuditLog:        courseAuditLog,
+		PromotionRules:  promotionRules,
+		ConflictPolicy:  conflictPolicy,
+		AllowBulk:       circuitbreaker.AllowBulk,
+	})
+	mutationHandlers = append(mutationHandlers,
+		coursemanager.ReadyHandler,
+		coursemanager.GuildCreateHandler,
+		coursemanager.GuildRoleCreateHandler,
+		coursemanager.GulidRoleUpdateHandler,
+		coursemanager.GuildRoleDeleteHandler,
+		coursemanager.MemberRoleUpdateHandler,
+		coursemanager.MemberAddHandler,
+		coursemanager.MemberRemoveHandler,
+	)
+	coursemanager.RegisterCommands(router)
+	_, err = cr.AddFunc(COURSE_REPAIR_CRON, func() {
+		coursemanager.ReconcileCourseRoles(discord)
+	})
+	if err != nil {
+		slog.Error("Error adding cron job", "err", err)
+		return
+	}
+	if len(promotionRules) > 0 {
+		_, err = cr.AddFunc(COURSE_PROMOTION_CRON, func() {
+			slog.Info("Promoting course members")
+			coursemanager.PromoteMembers(discord)
+		})
+		if err != nil {
+			slog.Error("Error adding cron job", "err", err)
+			return
+		}
+	}
+
+	// SnapshotManagerの設定
+	snapshotRetention, err := strconv.Atoi(SNAPSHOT_RETENTION)
+	if err != nil || snapshotRetention < 0 {
+		slog.Error("Error parsing SNAPSHOT_RETENTION", "SNAPSHOT_RETENTION", SNAPSHOT_RETENTION, "err", err)
+		return
+	}
+	snapshots, err := store.Open(filepath.Join(DATA_DIR, "role_snapshots.json"), snapshot.Snapshots{})
+	if err != nil {
+		slog.Error("Error loading role snapshots", "err", err)
+		return
+	}
+	snapshotmanager := snapshot.NewSnapshotManager(GUILD_ID, func(s *discordgo.Session) []string {
+		return append(coursemanager.ManagedRoleIDs(s), NEWBIE_ROLE_ID)
+	}, snapshots, snapshotRetention, circuitbreaker.Paused)
+	_, err = cr.AddFunc(SNAPSHOT_CRON, func() {
+		slog.Info("Taking role snapshot")
+		if _, err := snapshotmanager.TakeSnapshot(discord); err != nil {
+			slog.Error("Failed to take role snapshot", "err", err)
+		}
+	})
+	if err != nil {
+		slog.Error("Error adding cron job", "err", err)
+		return
+	}
+	snapshotmanager.RegisterCommands(router)
+
+	// メンバー本人向けのロールの説明
+	router.Command(&discordgo.ApplicationCommand{
+		Name:        "whyroles",
+		Description: "自分のロールがbotにどう扱われているかを表示",
+	}, func(s *discordgo.Session, i *discordgo.InteractionCreate, opts command.Options) {
+		command.Respond(s, i, "**新入生ロール**\n"+newbiemanager.ExplainToMember(i.Member)+"\n**コース**\n"+coursemanager.ExplainToMember(i.Member))
+	})
+
+	// 権限の事前検査の設定
+	checker := preflight.NewPreflightChecker(GUILD_ID, func(s *discordgo.Session) []preflight.Target {
+		targets := slices.Clone(preflightTargets)
+		for _, id := range coursemanager.ManagedRoleIDs(s) {
+			targets = append(targets, preflight.Target{RoleID: id, Label: "course"})
+		}
+		return targets
+	})
+	checker.RegisterCommands(router)
+
+	// 権限の事前検査(接続前にAPIで検査し、厳格モードで問題があればロールを変更する前に終了する)
+	report, err := checker.Check(discord)
+	if err != nil {
+		slog.Error("Error running preflight check", "err", err)
+		if PREFLIGHT_STRICT {
+			return
+		}
+	} else if !report.OK() && PREFLIGHT_STRICT {
+		slog.Error("Preflight check failed in strict mode", "MANAGE_ROLES", report.ManageRoles, "PROBLEMS", len(report.Problems))
+		return
+	}
+	for _, h := range mutationHandlers {
+		discord.AddHandler(h)
+	}
+
+	// スラッシュコマンドの設定
+	discord.AddHandler(router.ReadyHandler)
+	discord.AddHandler(router.InteractionCreateHandler)
+
+	// メトリクスの公開
+	if METRICS_ADDR != "" {
+		go func() {
+			if err := http.ListenAndServe(METRICS_ADDR, nil); err != nil {
+				slog.Error("Error serving metrics", "err", err)
+			}
+		}()
+	}
 
 	// Discordセッションの開始
 	slog.Info("Opening discord connection")
 	err = discord.Open()
 	if err != nil {
-		slog.Error("Error opening discord connection:", err)
+		slog.Error("Error opening discord connection", "err", err)
 		return
 	}
 	defer discord.Close()
@@ -0,0 +1,38 @@
+package newbie
+
+import (
+	"github.com/bwmarrin/discordgo"
+	"github.com/gw31415/pgautorole/internal/command"
+)
+
+// /newbie コマンド
+var newbieCommand = &discordgo.ApplicationCommand{
+	Name:                     "newbie",
+	Description:              "新入生ロールの管理",
+	DefaultMemberPermissions: command.Permission(discordgo.PermissionManageRoles),
+}
+
+func (n *newbieManager) RegisterCommands(r *command.Router) {
+	r.Subcommand(newbieCommand, &discordgo.ApplicationCommandOption{
+		Name:        "list",
+		Description: "現在の新入生と最近卒業した会員を表示",
+	}, func(s *discordgo.Session, i *discordgo.InteractionCreate, opts command.Options) {
+		command.Deferred(s, i, func() string {
+			roster, err := n.Roster(s)
+			if err != nil {
+				return "名簿の作成に失敗しました: " + err.Error()
+			}
+			return roster.String()
+		})
+	})
+	r.Subcommand(newbieCommand, &discordgo.ApplicationCommandOption{
+		Name:        "explain",
+		Description: "メンバーが新入生かどうかの判定理由を表示",
+		Options: []*discordgo.ApplicationCommandOption{{
+			Type:        discordgo.ApplicationCommandOptionUser,
+			Name:        "user",
+			Description: "対象のメンバー",
+			Required:    true,
+		}},
+	}, n.explainCommand)
+}
@@ -0,0 +1,126 @@
+package newbie
+
+import (
+	"log/slog"
+	"slices"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+// ユーザーIDから参加履歴へのマップ
+type JoinHistory map[string]*JoinRecord
+
+// メンバーの参加履歴
+type JoinRecord struct {
+	// サーバーに参加した日時
+	JoinedAt []time.Time `json:"joined_at"`
+	// サーバーから退出した日時
+	LeftAt []time.Time `json:"left_at,omitempty"`
+}
+
+// 初回参加日時
+func (r *JoinRecord) FirstJoinedAt() time.Time {
+	if len(r.JoinedAt) == 0 {
+		return time.Time{}
+	}
+	return slices.MinFunc(r.JoinedAt, time.Time.Compare)
+}
+
+// 参加日時を記録する
+// 既に記録されている場合は何もしない
+func (r *JoinRecord) addJoin(t time.Time) bool {
+	if t.IsZero() || slices.ContainsFunc(r.JoinedAt, t.Equal) {
+		return false
+	}
+	r.JoinedAt = append(r.JoinedAt, t)
+	return true
+}
+
+// 経過時間の起点とするメンバーの参加日時を取得
+// 初回参加日時から数える設定の場合は再参加する前の参加日時を用いる
+func (n *newbieManager) joinedAt(member *discordgo.Member) time.Time {
+	if n.fromFirstJoin {
+		return n.firstJoinedAt(member)
+	}
+	return member.JoinedAt
+}
+
+// 経過時間の起点とする参加日時の呼び方
+func (n *newbieManager) joinLabel() string {
+	if n.fromFirstJoin {
+		return "初回参加"
+	}
+	return "参加"
+}
+
+// メンバーの初回参加日時を取得
+// 記録されている参加日時とDiscord上の参加日時のうち早い方を用いる
+func (n *newbieManager) firstJoinedAt(member *discordgo.Member) time.Time {
+	joinedAt := member.JoinedAt
+	n.history.View(func(h *JoinHistory) {
+		if r := (*h)[member.User.ID]; r != nil {
+			if first := r.FirstJoinedAt(); !first.IsZero() && (joinedAt.IsZero() || first.Before(joinedAt)) {
+				joinedAt = first
+			}
+		}
+	})
+	return joinedAt
+}
+
+// メンバーの参加日時をまとめて記録
+func (n *newbieManager) recordJoins(members []*discordgo.Member) {
+	err := n.history.Update(func(h *JoinHistory) error {
+		for _, member := range members {
+			r := (*h)[member.User.ID]
+			if r == nil {
+				r = &JoinRecord{}
+				(*h)[member.User.ID] = r
+			}
+			if r.addJoin(member.JoinedAt) && len(r.LeftAt) > 0 {
+				slog.Info("Member rejoined", "USER", member.User.ID, "FIRST_JOINED_AT", r.FirstJoinedAt(), "REJOIN_COUNT", len(r.JoinedAt)-1)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		slog.Error("Failed to save join history", "err", err)
+	}
+}
+
+// メンバーの退出日時を記録
+func (n *newbieManager) recordLeave(userID string, t time.Time) {
+	err := n.history.Update(func(h *JoinHistory) error {
+		r := (*h)[userID]
+		if r == nil {
+			r = &JoinRecord{}
+			(*h)[userID] = r
+		}
+		r.LeftAt = append(r.LeftAt, t)
+		return nil
+	})
+	if err != nil {
+		slog.Error("Failed to save join history", "err", err)
+	}
+}
+
+func (n *newbieManager) MemberAddHandler(s *discordgo.Session, m *discordgo.GuildMemberAdd) {
+	// イベントが発生したサーバーが異なる場合は無視
+	if m.GuildID != n.guildID {
+		return
+	}
+
+	n.recordJoins([]*discordgo.Member{m.Member})
+	// 他のボットによりロールが復元された状態で再参加した場合に備え、すぐに判定する
+	n.applyNewbieRole(s, m.Member)
+}
+
+func (n *newbieManager) MemberRemoveHandler(s *discordgo.Session, m *discordgo.GuildMemberRemove) {
+	// イベントが発生したサーバーが異なる場合は無視
+	if m.GuildID != n.guildID {
+		return
+	}
+
+	slog.Info("Member left", "USER", m.User.ID)
+	n.recordLeave(m.User.ID, time.Now())
+}
@@ -0,0 +1,404 @@
+package internal
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/gw31415/pgautorole/internal/utils"
+)
+
+// 判定対象のメンバーの情報
+type Subject struct {
+	// 付与されているロールID
+	Roles []string
+	// 初回参加からの経過時間
+	Age time.Duration
+	// ボットかどうか
+	Bot bool
+}
+
+// 判定式
+type Expr interface {
+	// 式を評価し、結果とそれを決定した節を返す
+	Eval(s *Subject) (bool, Expr)
+	// 式で参照しているロールID
+	RoleIDs() []string
+	// 式の文字列表現
+	String() string
+}
+
+// 論理積
+type andExpr struct{ left, right Expr }
+
+func (e *andExpr) Eval(s *Subject) (bool, Expr) {
+	if v, by := e.left.Eval(s); !v {
+		return v, by
+	}
+	return e.right.Eval(s)
+}
+func (e *andExpr) RoleIDs() []string {
+	return append(e.left.RoleIDs(), e.right.RoleIDs()...)
+}
+func (e *andExpr) String() string {
+	return e.left.String() + " && " + e.right.String()
+}
+
+// 論理和
+type orExpr struct{ left, right Expr }
+
+func (e *orExpr) Eval(s *Subject) (bool, Expr) {
+	if v, by := e.left.Eval(s); v {
+		return v, by
+	}
+	return e.right.Eval(s)
+}
+func (e *orExpr) RoleIDs() []string {
+	return append(e.left.RoleIDs(), e.right.RoleIDs()...)
+}
+func (e *orExpr) String() string {
+	return e.left.String() + " || " + e.right.String()
+}
+
+// 否定
+type notExpr struct{ inner Expr }
+
+func (e *notExpr) Eval(s *Subject) (bool, Expr) {
+	v, by := e.inner.Eval(s)
+	// 直下の節で決まった場合は否定を含めて決定した節とする
+	if by == e.inner {
+		by = e
+	}
+	return !v, by
+}
+func (e *notExpr) RoleIDs() []string {
+	return e.inner.RoleIDs()
+}
+func (e *notExpr) String() string {
+	switch e.inner.(type) {
+	case *andExpr, *orExpr:
+		return "!(" + e.inner.String() + ")"
+	}
+	return "!" + e.inner.String()
+}
+
+// 括弧
+type parenExpr struct{ inner Expr }
+
+func (e *parenExpr) Eval(s *Subject) (bool, Expr) {
+	return e.inner.Eval(s)
+}
+func (e *parenExpr) RoleIDs() []string {
+	return e.inner.RoleIDs()
+}
+func (e *parenExpr) String() string {
+	return "(" + e.inner.String() + ")"
+}
+
+// ロール引数
+type roleArg struct {
+	// 式中での表記
+	name string
+	// 該当するロールID(いずれかを持っていれば該当)
+	ids []string
+}
+
+// ロールの所持判定
+type roleExpr struct {
+	// has: 全て持っている, any: いずれかを持っている
+	fn   string
+	args []roleArg
+}
+
+func (e *roleExpr) Eval(s *Subject) (bool, Expr) {
+	held := func(a roleArg) bool {
+		return slices.ContainsFunc(a.ids, func(id string) bool {
+			return slices.Contains(s.Roles, id)
+		})
+	}
+	if e.fn == "any" {
+		return slices.ContainsFunc(e.args, held), e
+	}
+	return !slices.ContainsFunc(e.args, func(a roleArg) bool { return !held(a) }), e
+}
+func (e *roleExpr) RoleIDs() []string {
+	ids := []string{}
+	for _, a := range e.args {
+		ids = append(ids, a.ids...)
+	}
+	return ids
+}
+func (e *roleExpr) String() string {
+	names := []string{}
+	for _, a := range e.args {
+		names = append(names, a.name)
+	}
+	return e.fn + "(" + strings.Join(names, ", ") + ")"
+}
+
+// 経過時間の比較
+type ageExpr struct {
+	op  tokenKind
+	d   time.Duration
+	src string
+}
+
+func (e *ageExpr) Eval(s *Subject) (bool, Expr) {
+	switch e.op {
+	case tokenLT:
+		return s.Age < e.d, e
+	case tokenLE:
+		return s.Age <= e.d, e
+	case tokenGT:
+		return s.Age > e.d, e
+	default:
+		return s.Age >= e.d, e
+	}
+}
+func (e *ageExpr) RoleIDs() []string {
+	return nil
+}
+func (e *ageExpr) String() string {
+	ops := map[tokenKind]string{tokenLT: "<", tokenLE: "<=", tokenGT: ">", tokenGE: ">="}
+	return "age " + ops[e.op] + " " + e.src
+}
+
+// ボットかどうか
+type botExpr struct{}
+
+func (e *botExpr) Eval(s *Subject) (bool, Expr) {
+	return s.Bot, e
+}
+func (e *botExpr) RoleIDs() []string {
+	return nil
+}
+func (e *botExpr) String() string {
+	return "bot"
+}
+
+// 判定式の最上位の論理積に含まれる経過時間の上限(age < d, age <= d)のうち最小のもの
+// 上限がない場合はfalseを返す
+func AgeLimit(e Expr) (time.Duration, bool) {
+	switch e := e.(type) {
+	case *andExpr:
+		l, lok := AgeLimit(e.left)
+		r, rok := AgeLimit(e.right)
+		switch {
+		case lok && rok:
+			return min(l, r), true
+		case lok:
+			return l, true
+		}
+		return r, rok
+	case *parenExpr:
+		return AgeLimit(e.inner)
+	case *ageExpr:
+		if e.op == tokenLT || e.op == tokenLE {
+			return e.d, true
+		}
+	}
+	return 0, false
+}
+
+// 節が経過時間の比較かどうか
+func IsAgeClause(e Expr) bool {
+	_, ok := e.(*ageExpr)
+	return ok
+}
+
+// 節が否定(ホワイトリストのロールやボットによる除外など)かどうか
+func IsNegation(e Expr) bool {
+	_, ok := e.(*notExpr)
+	return ok
+}
+
+// 判定式を解析
+// aliasesはロールの別名から該当するロールIDへのマップ
+func Parse(src string, aliases map[string][]string) (Expr, error) {
+	tokens, err := tokenize(src)
+	if err != nil {
+		return nil, err
+	}
+	p := &parser{tokens: tokens, aliases: aliases}
+	e, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if t := p.peek(); t.kind != tokenEOF {
+		return nil, fmt.Errorf("%d文字目: 余分な %q があります", t.pos+1, t.text)
+	}
+	return e, nil
+}
+
+type parser struct {
+	tokens  []token
+	pos     int
+	aliases map[string][]string
+}
+
+func (p *parser) peek() token {
+	return p.tokens[p.pos]
+}
+
+func (p *parser) next() token {
+	t := p.tokens[p.pos]
+	if t.kind != tokenEOF {
+		p.pos++
+	}
+	return t
+}
+
+func (p *parser) expect(kind tokenKind, what string) (token, error) {
+	t := p.next()
+	if t.kind != kind {
+		if t.kind == tokenEOF {
+			return t, fmt.Errorf("%d文字目: %sが必要です", t.pos+1, what)
+		}
+		return t, fmt.Errorf("%d文字目: %sが必要ですが %q があります", t.pos+1, what, t.text)
+	}
+	return t, nil
+}
+
+// or := and ("||" and)*
+func (p *parser) parseOr() (Expr, error) {
+	left, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	for p.peek().kind == tokenOr {
+		p.next()
+		right, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		left = &orExpr{left, right}
+	}
+	return left, nil
+}
+
+// and := unary ("&&" unary)*
+func (p *parser) parseAnd() (Expr, error) {
+	left, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+	for p.peek().kind == tokenAnd {
+		p.next()
+		right, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		left = &andExpr{left, right}
+	}
+	return left, nil
+}
+
+// unary := "!" unary | primary
+func (p *parser) parseUnary() (Expr, error) {
+	if p.peek().kind == tokenNot {
+		p.next()
+		inner, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return &notExpr{inner}, nil
+	}
+	return p.parsePrimary()
+}
+
+// primary := "(" or ")" | ("has" | "any") "(" role ("," role)* ")" | "age" op duration | "bot"
+func (p *parser) parsePrimary() (Expr, error) {
+	t := p.next()
+	switch {
+	case t.kind == tokenLParen:
+		inner, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if _, err := p.expect(tokenRParen, "\")\""); err != nil {
+			return nil, err
+		}
+		return &parenExpr{inner}, nil
+	case t.kind == tokenIdent && (t.text == "has" || t.text == "any"):
+		if _, err := p.expect(tokenLParen, "\"(\""); err != nil {
+			return nil, err
+		}
+		e := &roleExpr{fn: t.text}
+		for {
+			arg, err := p.parseRole()
+			if err != nil {
+				return nil, err
+			}
+			e.args = append(e.args, arg)
+			if p.peek().kind != tokenComma {
+				break
+			}
+			p.next()
+		}
+		if _, err := p.expect(tokenRParen, "\")\""); err != nil {
+			return nil, err
+		}
+		return e, nil
+	case t.kind == tokenIdent && t.text == "age":
+		op := p.next()
+		if op.kind < tokenLT || op.kind > tokenGE {
+			return nil, fmt.Errorf("%d文字目: 比較演算子が必要です", op.pos+1)
+		}
+		dt, err := p.expect(tokenDuration, "期間")
+		if err != nil {
+			return nil, err
+		}
+		d, err := utils.ParseDuration(dt.text)
+		if err != nil {
+			return nil, fmt.Errorf("%d文字目: %w", dt.pos+1, err)
+		}
+		return &ageExpr{op.kind, d, dt.text}, nil
+	case t.kind == tokenIdent && t.text == "bot":
+		return &botExpr{}, nil
+	case t.kind == tokenEOF:
+		return nil, fmt.Errorf("%d文字目: 式が必要です", t.pos+1)
+	default:
+		return nil, fmt.Errorf("%d文字目: 不明な %q", t.pos+1, t.text)
+	}
+}
+
+// role := ident | number
+func (p *parser) parseRole() (roleArg, error) {
+	t := p.next()
+	switch t.kind {
+	case tokenNumber:
+		return roleArg{t.text, []string{t.text}}, nil
+	case tokenIdent:
+		ids, ok := p.aliases[t.text]
+		if !ok {
+			return roleArg{}, fmt.Errorf("%d文字目: 未定義のロール %q", t.pos+1, t.text)
+		}
+		return roleArg{t.text, ids}, nil
+	default:
+		return roleArg{}, fmt.Errorf("%d文字目: ロールが必要です", t.pos+1)
+	}
+}
+
+// "別名=ロールID|ロールID,別名=ロールID" の形式のロールの別名定義を解析
+func ParseAliases(s string) (map[string][]string, error) {
+	aliases := make(map[string][]string)
+	for _, def := range strings.Split(s, ",") {
+		def = strings.TrimSpace(def)
+		if def == "" {
+			continue
+		}
+		name, ids, ok := strings.Cut(def, "=")
+		name = strings.TrimSpace(name)
+		if !ok || name == "" {
+			return nil, fmt.Errorf("不正な別名定義 %q", def)
+		}
+		aliases[name] = []string{}
+		for _, id := range strings.Split(ids, "|") {
+			if id = strings.TrimSpace(id); id != "" {
+				aliases[name] = append(aliases[name], id)
+			}
+		}
+	}
+	return aliases, nil
+}
@@ -0,0 +1,133 @@
+package internal_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/gw31415/pgautorole/newbie/internal"
+)
+
+var aliases = map[string][]string{
+	"Member": {"member"},
+	"Alumni": {"alumni"},
+	"Staff":  {"staff1", "staff2"},
+	"Empty":  {},
+}
+
+func TestParse(t *testing.T) {
+	t.Run("Valid", func(t *testing.T) {
+		srcs := []string{
+			"has(Member)",
+			"has(Member) && !any(Alumni, Staff) && age < 90d && !bot",
+			"(has(Member) || has(123456789)) && age >= 1w12h",
+			"!(bot || any(Empty))",
+		}
+		for _, src := range srcs {
+			e, err := internal.Parse(src, aliases)
+			if err != nil {
+				t.Fatalf("unexpected error for %q: %v", src, err)
+			}
+			if e.String() != src {
+				t.Fatalf("unexpected string: %q", e.String())
+			}
+		}
+	})
+	t.Run("Invalid", func(t *testing.T) {
+		srcs := []string{
+			"",
+			"has(Unknown)",
+			"has(Member",
+			"has(Member) & bot",
+			"age < 90x",
+			"age == 90d",
+			"has(Member) bot",
+		}
+		for _, src := range srcs {
+			if _, err := internal.Parse(src, aliases); err == nil {
+				t.Fatalf("unexpected nil error for %q", src)
+			}
+		}
+	})
+}
+
+func TestEval(t *testing.T) {
+	e, err := internal.Parse("has(Member) && !any(Alumni, Staff) && age < 90d && !bot", aliases)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	cases := []struct {
+		name    string
+		subject internal.Subject
+		want    bool
+		by      string
+	}{
+		{"Newbie", internal.Subject{Roles: []string{"member"}, Age: 24 * time.Hour}, true, "!bot"},
+		{"NotMember", internal.Subject{Roles: []string{}, Age: 24 * time.Hour}, false, "has(Member)"},
+		{"Staff", internal.Subject{Roles: []string{"member", "staff2"}, Age: 24 * time.Hour}, false, "!any(Alumni, Staff)"},
+		{"Old", internal.Subject{Roles: []string{"member"}, Age: 91 * 24 * time.Hour}, false, "age < 90d"},
+		{"Bot", internal.Subject{Roles: []string{"member"}, Bot: true}, false, "!bot"},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			got, by := e.Eval(&c.subject)
+			if got != c.want {
+				t.Fatalf("unexpected result: %v", got)
+			}
+			if by.String() != c.by {
+				t.Fatalf("unexpected deciding clause: %s", by.String())
+			}
+		})
+	}
+}
+
+func TestAgeLimit(t *testing.T) {
+	cases := []struct {
+		src  string
+		want time.Duration
+		ok   bool
+	}{
+		{"has(Member) && age < 90d", 90 * 24 * time.Hour, true},
+		{"(age <= 1w && has(Member)) && age < 30d", 7 * 24 * time.Hour, true},
+		{"has(Member) && age >= 1d", 0, false},
+		{"has(Member) || age < 90d", 0, false},
+		{"!(age < 90d)", 0, false},
+	}
+	for _, c := range cases {
+		e, err := internal.Parse(c.src, aliases)
+		if err != nil {
+			t.Fatalf("unexpected error for %q: %v", c.src, err)
+		}
+		got, ok := internal.AgeLimit(e)
+		if got != c.want || ok != c.ok {
+			t.Fatalf("unexpected limit for %q: %v, %v", c.src, got, ok)
+		}
+	}
+}
+
+func TestClauseKinds(t *testing.T) {
+	e, err := internal.Parse("has(Member) && !any(Alumni) && age < 90d", aliases)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	_, by := e.Eval(&internal.Subject{Roles: []string{"member", "alumni"}})
+	if !internal.IsNegation(by) || internal.IsAgeClause(by) {
+		t.Fatalf("unexpected clause: %s", by)
+	}
+	_, by = e.Eval(&internal.Subject{Roles: []string{"member"}, Age: 100 * 24 * time.Hour})
+	if !internal.IsAgeClause(by) || internal.IsNegation(by) {
+		t.Fatalf("unexpected clause: %s", by)
+	}
+}
+
+func TestParseAliases(t *testing.T) {
+	a, err := internal.ParseAliases("Alumni=1, Staff=2|3,")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(a) != 2 || len(a["Alumni"]) != 1 || len(a["Staff"]) != 2 {
+		t.Fatalf("unexpected aliases: %v", a)
+	}
+	if _, err := internal.ParseAliases("Alumni"); err == nil {
+		t.Fatalf("unexpected nil error")
+	}
+}
@@ -0,0 +1,109 @@
+package internal
+
+import (
+	"fmt"
+	"unicode"
+)
+
+// トークンの種類
+type tokenKind int
+
+const (
+	tokenEOF tokenKind = iota
+	// 識別子
+	tokenIdent
+	// 数字のみからなるロールID
+	tokenNumber
+	// 単位付きの期間
+	tokenDuration
+	tokenLParen
+	tokenRParen
+	tokenComma
+	tokenNot
+	tokenAnd
+	tokenOr
+	tokenLT
+	tokenLE
+	tokenGT
+	tokenGE
+)
+
+// 字句
+type token struct {
+	kind tokenKind
+	text string
+	// 式中の位置(文字数)
+	pos int
+}
+
+// 式を字句に分解
+func tokenize(src string) ([]token, error) {
+	rs := []rune(src)
+	tokens := []token{}
+	for i := 0; i < len(rs); {
+		r := rs[i]
+		switch {
+		case unicode.IsSpace(r):
+			i++
+			continue
+		case r == '(':
+			tokens = append(tokens, token{tokenLParen, "(", i})
+		case r == ')':
+			tokens = append(tokens, token{tokenRParen, ")", i})
+		case r == ',':
+			tokens = append(tokens, token{tokenComma, ",", i})
+		case r == '!':
+			tokens = append(tokens, token{tokenNot, "!", i})
+		case r == '&' || r == '|':
+			if i+1 >= len(rs) || rs[i+1] != r {
+				return nil, fmt.Errorf("%d文字目: %c%cの誤りです", i+1, r, r)
+			}
+			kind := tokenAnd
+			if r == '|' {
+				kind = tokenOr
+			}
+			tokens = append(tokens, token{kind, string([]rune{r, r}), i})
+			i += 2
+			continue
+		case r == '<' || r == '>':
+			kind, text := tokenLT, "<"
+			if r == '>' {
+				kind, text = tokenGT, ">"
+			}
+			if i+1 < len(rs) && rs[i+1] == '=' {
+				tokens = append(tokens, token{kind + 1, text + "=", i})
+				i += 2
+				continue
+			}
+			tokens = append(tokens, token{kind, text, i})
+		case unicode.IsDigit(r):
+			// 数字のみならロールID、単位が続けば期間
+			start := i
+			hasUnit := false
+			for i < len(rs) && (unicode.IsDigit(rs[i]) || rs[i] == '.' || unicode.IsLetter(rs[i])) {
+				if unicode.IsLetter(rs[i]) {
+					hasUnit = true
+				}
+				i++
+			}
+			kind := tokenNumber
+			if hasUnit {
+				kind = tokenDuration
+			}
+			tokens = append(tokens, token{kind, string(rs[start:i]), start})
+			continue
+		case r == '_' || unicode.IsLetter(r):
+			start := i
+			for i < len(rs) && (rs[i] == '_' || unicode.IsLetter(rs[i]) || unicode.IsDigit(rs[i])) {
+				i++
+			}
+			tokens = append(tokens, token{tokenIdent, string(rs[start:i]), start})
+			continue
+		default:
+			return nil, fmt.Errorf("%d文字目: 不明な文字 %q", i+1, r)
+		}
+		i++
+	}
+	tokens = append(tokens, token{tokenEOF, "", len(rs)})
+	return tokens, nil
+}
@@ -1,11 +1,14 @@
 package newbie
 
 import (
+	"errors"
 	"log/slog"
 	"slices"
-	"time"
 
 	"github.com/bwmarrin/discordgo"
+	"github.com/gw31415/pgautorole/expiry"
+	"github.com/gw31415/pgautorole/internal/command"
+	"github.com/gw31415/pgautorole/internal/store"
 	"github.com/gw31415/pgautorole/internal/utils"
 )
 
@@ -13,8 +16,20 @@ import (
 type NewbieManager interface {
 	// 会員ロール変化時に新規会員ロールを操作するハンドラ
 	MemberRoleUpdateHandler(s *discordgo.Session, m *discordgo.GuildMemberUpdate)
+	// メンバー参加時に参加履歴を記録し、新規会員ロールを操作するハンドラ
+	MemberAddHandler(s *discordgo.Session, m *discordgo.GuildMemberAdd)
+	// メンバー退出時に参加履歴を記録するハンドラ
+	MemberRemoveHandler(s *discordgo.Session, m *discordgo.GuildMemberRemove)
 	// 新規会員ロールを更新
 	RefreshNewbieRoles(s *discordgo.Session)
+	// 新規会員の名簿を作成
+	Roster(s *discordgo.Session) (*Roster, error)
+	// 新規会員の名簿をチャンネルに投稿
+	PostDigest(s *discordgo.Session, channelID string)
+	// メンバー本人向けに新規会員ロールの判定理由を説明
+	ExplainToMember(member *discordgo.Member) string
+	// スラッシュコマンドを登録
+	RegisterCommands(r *command.Router)
 }
 
 type newbieManager struct {
@@ -24,35 +39,88 @@ type newbieManager struct {
 	newbieRoleID string
 	// 会員ロールID
 	memberRoleID string
-	// 新規会員から外すロール(ホワイトリスト)
-	whiteRoleIDs []string
-	// 新規会員とみなす期間
-	newbieDuration time.Duration
+	// 新規会員の判定式
+	rule *Rule
+	// 判定式の経過時間の上限から求めた新規会員ロールの有効期限(上限がない場合はnil)
+	expiry *expiry.Rule
+	// メンバーの参加履歴
+	history *store.Store[JoinHistory]
+	// 自動処理の対象とするメンバーの条件
+	filter utils.MemberFilter
+	// 定期更新で変更するメンバー数と対象のメンバー数から、更新を行ってよいかを判定する(nilの場合は常に行う)
+	allowBulk func(changes, total int) bool
+	// 経過時間を初回参加日時から数えるかどうか(falseの場合は現在の参加日時から数える)
+	fromFirstJoin bool
 }
 
 // 新規会員マネージャを作成
-func NewNewbieManager(guildID, newbieRoleID, memberRoleID string, whiteRoleIDs []string, newbieDuration time.Duration) NewbieManager {
+func NewNewbieManager(guildID, newbieRoleID, memberRoleID string, rule *Rule, history *store.Store[JoinHistory], filter utils.MemberFilter, allowBulk func(changes, total int) bool, fromFirstJoin bool) NewbieManager {
+	var expiryRule *expiry.Rule
+	if limit, ok := rule.AgeLimit(); ok {
+		expiryRule = expiry.NewJoinRule(newbieRoleID, limit)
+	}
 	return &newbieManager{
-		guildID:        guildID,
-		newbieRoleID:   newbieRoleID,
-		memberRoleID:   memberRoleID,
-		whiteRoleIDs:   whiteRoleIDs,
-		newbieDuration: newbieDuration,
+		guildID:       guildID,
+		newbieRoleID:  newbieRoleID,
+		memberRoleID:  memberRoleID,
+		rule:          rule,
+		expiry:        expiryRule,
+		history:       history,
+		filter:        filter,
+		allowBulk:     allowBulk,
+		fromFirstJoin: fromFirstJoin,
 	}
 }
 
 // userが新規会員に該当するかどうか
 func (n *newbieManager) checkNewbie(member *discordgo.Member) (bool, error) {
-	// 会員でない場合は新規会員ではない
-	if !slices.Contains(member.Roles, n.memberRoleID) {
-		return false, nil
+	if member.User == nil {
+		return false, errors.New("member has no user")
+	}
+	isNewbie, _ := n.rule.expr.Eval(n.subject(member))
+	return isNewbie, nil
+}
+
+// 新規会員ロールの変更内容
+type roleChange int
+
+const (
+	unchanged roleChange = iota
+	added
+	removed
+)
+
+// メンバーの新規会員ロールを判定結果に合わせる
+// 対象外のメンバーは判定しない
+func (n *newbieManager) applyNewbieRole(s *discordgo.Session, member *discordgo.Member) roleChange {
+	if n.filter.Skip(member) != utils.NotSkipped {
+		return unchanged
 	}
-	// ホワイトリストに含まれるロールを持っている場合は新規会員ではない
-	if len(utils.SlicesIntersect(member.Roles, n.whiteRoleIDs)) > 0 {
-		return false, nil
+	isNewbie, err := n.checkNewbie(member)
+	if err != nil {
+		return unchanged
 	}
-	// JoinedAtからNEWBIE_DURAITON経っていない新規会員
-	return time.Since(member.JoinedAt) < n.newbieDuration, nil
+	hasNewbieRole := slices.Contains(member.Roles, n.newbieRoleID)
+	if isNewbie && !hasNewbieRole {
+		// 新規会員の場合は新規会員ロールを付与
+		slog.Info("Add newbie role", "member.User.ID", member.User.ID)
+		err := s.GuildMemberRoleAdd(n.guildID, member.User.ID, n.newbieRoleID)
+		if err != nil {
+			slog.Error("Failed to add newbie role", "err", err)
+			return unchanged
+		}
+		return added
+	} else if !isNewbie && hasNewbieRole {
+		// 新規会員でない新規会員ロールがいた場合は新規会員ロールを削除
+		slog.Info("Remove newbie role", "member.User.ID", member.User.ID)
+		err := s.GuildMemberRoleRemove(n.guildID, member.User.ID, n.newbieRoleID)
+		if err != nil {
+			slog.Error("Failed to remove newbie role", "err", err)
+			return unchanged
+		}
+		return removed
+	}
+	return unchanged
 }
 
 func (n *newbieManager) MemberRoleUpdateHandler(s *discordgo.Session, m *discordgo.GuildMemberUpdate) {
@@ -71,45 +139,24 @@ func (n *newbieManager) MemberRoleUpdateHandler(s *discordgo.Session, m *discord
 	// }
 
 	// 追加されたロールと削除されたロールを取得
-	added := utils.SlicesDifference(roles, rolesBefore)
-	removed := utils.SlicesDifference(rolesBefore, roles)
-
-	// 会員ロールが付与された時
-	if slices.Contains(added, n.memberRoleID) {
-		isNewbie, err := n.checkNewbie(m.Member)
-		if err == nil && isNewbie {
-			slog.Info("Add newbie role", "m.User.ID", m.User.ID)
-			s.GuildMemberRoleAdd(m.GuildID, m.User.ID, n.newbieRoleID)
-		}
-	}
-	// 新規会員ロールまたはホワイトリストロールが付与された時
-	if slices.Contains(added, n.newbieRoleID) || len(utils.SlicesIntersect(added, n.whiteRoleIDs)) > 0 {
-		isNewbie, err := n.checkNewbie(m.Member)
-		if err == nil && !isNewbie {
-			// 条件にあてはまらない場合キャンセル
-			slog.Info("Refuse newbie role", "m.User.ID", m.User.ID)
-			s.GuildMemberRoleRemove(m.GuildID, m.User.ID, n.newbieRoleID)
-		}
-	}
-	// 会員ロールが剥奪され、新規会員ロールが存在する場合
-	if !slices.Contains(m.Roles, n.memberRoleID) && slices.Contains(m.Roles, n.newbieRoleID) {
-		slog.Info("Remove newbie role", "m.User.ID", m.User.ID)
-		s.GuildMemberRoleRemove(m.GuildID, m.User.ID, n.newbieRoleID)
+	addedRoles := utils.SlicesDifference(roles, rolesBefore)
+	removedRoles := utils.SlicesDifference(rolesBefore, roles)
+
+	// メンバー認証を通過した時は、保留していた判定を行う
+	if m.BeforeUpdate != nil && m.BeforeUpdate.Pending && !m.Member.Pending {
+		slog.Info("Member passed screening", "m.User.ID", m.User.ID)
+		n.applyNewbieRole(s, m.Member)
+		return
 	}
-	// 新規会員ロールが剥奪された時またはホワイトリストロールが剥奪された時
-	if !slices.Contains(removed, n.newbieRoleID) || len(utils.SlicesIntersect(removed, n.whiteRoleIDs)) > 0 {
-		isNewbie, err := n.checkNewbie(m.Member)
-		if err == nil && isNewbie {
-			// 条件にあてはまる場合リストア
-			slog.Info("Restore newbie role", "m.User.ID", m.User.ID)
-			s.GuildMemberRoleAdd(m.GuildID, m.User.ID, n.newbieRoleID)
-		}
+
+	// 判定式が参照するロールまたは新規会員ロールが変化した時は判定し直す
+	// 条件にあてはまらない場合は新規会員ロールをキャンセルし、あてはまる場合はリストアする
+	watched := append(n.rule.expr.RoleIDs(), n.newbieRoleID)
+	if len(utils.SlicesIntersect(addedRoles, watched)) > 0 || len(utils.SlicesIntersect(removedRoles, watched)) > 0 {
+		n.applyNewbieRole(s, m.Member)
 	}
 }
 
-// 一度に取得するメンバー数
-const MEMBERS_PER_REQUEST = 1000
-
 func (n *newbieManager) RefreshNewbieRoles(s *discordgo.Session) {
 	guildIsOnline := slices.ContainsFunc(s.State.Guilds, func(g *discordgo.Guild) bool {
 		return g.ID == n.guildID
@@ -118,37 +165,35 @@ func (n *newbieManager) RefreshNewbieRoles(s *discordgo.Session) {
 		return
 	}
 
-	after := ""
-	for {
-		// MEMBER_PER_REQUESTずつメンバーを取得
-		m, err := s.GuildMembers(n.guildID, after, MEMBERS_PER_REQUEST)
-		// メンバーが取得できなかった場合は終了
-		if err != nil || len(m) == 0 {
-			break
-		}
-
-		// 全メンバーに対して処理
+	skipped := utils.SkipCounts{}
+	targets := []*discordgo.Member{}
+	err := utils.ForEachMemberPage(s, n.guildID, func(m []*discordgo.Member) {
+		// 参加履歴に未記録のメンバーを記録
+		n.recordJoins(m)
 		for _, member := range m {
-			isNewbie, err := n.checkNewbie(member)
-			if err == nil {
-				if isNewbie {
-					// 新規会員の場合は新規会員ロールを付与
-					slog.Info("Add newbie role", "member.User.ID", member.User.ID)
-					err := s.GuildMemberRoleAdd(n.guildID, member.User.ID, n.newbieRoleID)
-					if err != nil {
-						slog.Error("Failed to add newbie role", err)
-					}
-				} else if slices.Contains(member.Roles, n.newbieRoleID) {
-					// 新規会員でない新規会員ロールがいた場合は新規会員ロールを削除
-					slog.Info("Remove newbie role", "member.User.ID", member.User.ID)
-					err := s.GuildMemberRoleRemove(n.guildID, member.User.ID, n.newbieRoleID)
-					if err != nil {
-						slog.Error("Failed to remove newbie role", err)
-					}
-				}
+			if !skipped.Skip(n.filter, member) {
+				targets = append(targets, member)
 			}
 		}
+	})
+	if err != nil {
+		slog.Error("Failed to get members", "err", err)
+	}
+
+	// 変更するメンバーが多すぎる場合は設定の誤りとみなして更新しない
+	planned := utils.SlicesCount(targets, func(member *discordgo.Member) bool {
+		isNewbie, err := n.checkNewbie(member)
+		return err == nil && isNewbie != slices.Contains(member.Roles, n.newbieRoleID)
+	})
+	if n.allowBulk != nil && !n.allowBulk(planned, len(targets)) {
+		slog.Warn("Newbie roles refresh aborted", "CHANGES", planned, "MEMBERS", len(targets))
+		return
+	}
 
-		after = m[len(m)-1].User.ID
+	// 全メンバーに対して処理
+	changes := map[roleChange]int{}
+	for _, member := range targets {
+		changes[n.applyNewbieRole(s, member)]++
 	}
+	slog.Info("Newbie roles refreshed", append([]any{"ADDED", changes[added], "REMOVED", changes[removed]}, skipped.LogAttrs()...)...)
 }
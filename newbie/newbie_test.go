@@ -0,0 +1,49 @@
+package newbie_test
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+	"github.com/gw31415/pgautorole/internal/store"
+	"github.com/gw31415/pgautorole/internal/utils"
+	"github.com/gw31415/pgautorole/newbie"
+)
+
+func TestRejoinedMemberAge(t *testing.T) {
+	rule, err := newbie.ParseRule(newbie.DefaultRuleSource(30*24*time.Hour), map[string][]string{
+		"Member": {"member"},
+		"Newbie": {"newbie"},
+		"White":  {},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 60日前に初めて参加し、昨日再参加したメンバー
+	now := time.Now()
+	history := store.Memory(newbie.JoinHistory{
+		"u": {JoinedAt: []time.Time{now.Add(-60 * 24 * time.Hour), now.Add(-24 * time.Hour)}},
+	})
+	member := &discordgo.Member{User: &discordgo.User{ID: "u"}, JoinedAt: now.Add(-24 * time.Hour), Roles: []string{"member"}}
+
+	cases := []struct {
+		name          string
+		fromFirstJoin bool
+		newbie        bool
+	}{
+		// 既定では現在の参加日時から数えるため、再参加したメンバーは新入生になる
+		{"CurrentJoin", false, true},
+		// 初回参加日時から数える設定では新入生にならない
+		{"FirstJoin", true, false},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			m := newbie.NewNewbieManager("g", "newbie", "member", rule, history, utils.MemberFilter{}, nil, c.fromFirstJoin)
+			got := strings.HasPrefix(m.ExplainToMember(member), "新入生の条件を満たしているため")
+			if got != c.newbie {
+				t.Fatalf("unexpected result: %v", m.ExplainToMember(member))
+			}
+		})
+	}
+}
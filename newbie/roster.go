@@ -0,0 +1,131 @@
+package newbie
+
+import (
+	"fmt"
+	"log/slog"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+	"github.com/gw31415/pgautorole/internal/command"
+	"github.com/gw31415/pgautorole/internal/utils"
+	"github.com/gw31415/pgautorole/newbie/internal"
+)
+
+// 「最近」卒業したとみなす期間
+const RECENT_GRADUATION_WINDOW = 7 * 24 * time.Hour
+
+// 新規会員の名簿
+type Roster struct {
+	// 現在の新規会員
+	Newbies []RosterEntry
+	// 最近新規会員の期間が終了した会員
+	Graduated []RosterEntry
+	// 期間内だがホワイトリストのロールなどにより判定式で除外されている会員
+	Excluded []RosterEntry
+}
+
+// 名簿の各項目
+type RosterEntry struct {
+	Member *discordgo.Member
+	// 新規会員の期間が終了する(した)日時(判定式に経過時間の上限がない場合はゼロ値)
+	ExpiresAt time.Time
+}
+
+// 期限までの残り日数(端数切り上げ)
+func (e *RosterEntry) DaysRemaining(now time.Time) int {
+	d := e.ExpiresAt.Sub(now)
+	if d <= 0 {
+		return 0
+	}
+	return int((d + 24*time.Hour - 1) / (24 * time.Hour))
+}
+
+// 名簿を作成
+func (n *newbieManager) Roster(s *discordgo.Session) (*Roster, error) {
+	members, err := utils.GuildMembers(s, n.guildID)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	roster := &Roster{}
+	for _, member := range members {
+		if member.User == nil || n.filter.Skip(member) != utils.NotSkipped {
+			continue
+		}
+		entry := RosterEntry{Member: member}
+		hasLimit := false
+		if n.expiry != nil {
+			entry.ExpiresAt, hasLimit = n.expiry.ExpiresAt(n.joinedAt(member), time.Time{})
+		}
+		// 判定式を決定した節によって区分する
+		isNewbie, by := n.rule.expr.Eval(n.subject(member))
+		switch {
+		case isNewbie:
+			roster.Newbies = append(roster.Newbies, entry)
+		case !hasLimit:
+			// 期間がない場合は卒業・除外の区別がない
+		case internal.IsAgeClause(by):
+			if now.Sub(entry.ExpiresAt) < RECENT_GRADUATION_WINDOW {
+				roster.Graduated = append(roster.Graduated, entry)
+			}
+		case internal.IsNegation(by) && entry.ExpiresAt.After(now):
+			roster.Excluded = append(roster.Excluded, entry)
+		}
+	}
+
+	// 期限の近い順に並べる
+	for _, entries := range [][]RosterEntry{roster.Newbies, roster.Graduated, roster.Excluded} {
+		slices.SortFunc(entries, func(a, b RosterEntry) int {
+			return a.ExpiresAt.Compare(b.ExpiresAt)
+		})
+	}
+	return roster, nil
+}
+
+// 名簿を表示用の文字列に変換
+func (r *Roster) String() string {
+	now := time.Now()
+	b := &strings.Builder{}
+
+	fmt.Fprintf(b, "**新入生** (%d人)\n", len(r.Newbies))
+	for _, e := range r.Newbies {
+		if e.ExpiresAt.IsZero() {
+			fmt.Fprintf(b, "- <@%s> 期限なし\n", e.Member.User.ID)
+			continue
+		}
+		fmt.Fprintf(b, "- <@%s> 残り%d日 (%sまで)\n", e.Member.User.ID, e.DaysRemaining(now), e.ExpiresAt.Format(time.DateOnly))
+	}
+	fmt.Fprintf(b, "**最近卒業した会員** (過去%d日間, %d人)\n", RECENT_GRADUATION_WINDOW/(24*time.Hour), len(r.Graduated))
+	for _, e := range r.Graduated {
+		fmt.Fprintf(b, "- <@%s> %sに卒業\n", e.Member.User.ID, e.ExpiresAt.Format(time.DateOnly))
+	}
+	fmt.Fprintf(b, "**ホワイトリスト等により除外** (%d人)\n", len(r.Excluded))
+	for _, e := range r.Excluded {
+		fmt.Fprintf(b, "- <@%s> (本来は%sまで)\n", e.Member.User.ID, e.ExpiresAt.Format(time.DateOnly))
+	}
+	return b.String()
+}
+
+// 名簿をチャンネルに投稿
+func (n *newbieManager) PostDigest(s *discordgo.Session, channelID string) {
+	roster, err := n.Roster(s)
+	if err != nil {
+		slog.Error("Failed to create newbie roster", "err", err)
+		return
+	}
+	// 1メッセージに収まらない場合は複数のメッセージに分けて投稿する
+	for _, content := range command.SplitMessage("## 新入生ダイジェスト\n" + roster.String()) {
+		_, err = s.ChannelMessageSendComplex(channelID, &discordgo.MessageSend{
+			Content: content,
+			// 名簿に含まれるメンバーにメンションを飛ばさない
+			AllowedMentions: &discordgo.MessageAllowedMentions{},
+		})
+		if err != nil {
+			slog.Error("Failed to post newbie digest", "err", err)
+			return
+		}
+	}
+}
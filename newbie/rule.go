@@ -0,0 +1,141 @@
+package newbie
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+	"github.com/gw31415/pgautorole/internal/command"
+	"github.com/gw31415/pgautorole/internal/utils"
+	"github.com/gw31415/pgautorole/newbie/internal"
+)
+
+// 新規会員の判定式
+type Rule struct {
+	expr internal.Expr
+}
+
+// 判定式を解析
+// aliasesは判定式で使用するロールの別名から該当するロールIDへのマップ
+func ParseRule(src string, aliases map[string][]string) (*Rule, error) {
+	expr, err := internal.Parse(src, aliases)
+	if err != nil {
+		return nil, err
+	}
+	return &Rule{expr}, nil
+}
+
+// "別名=ロールID|ロールID,別名=ロールID" の形式のロールの別名定義を解析
+func ParseRoleAliases(s string) (map[string][]string, error) {
+	return internal.ParseAliases(s)
+}
+
+// 既定の判定式
+// 会員ロール(Member)を持ち、ホワイトリストのロール(White)を持たず、初回参加からdが経過していない
+func DefaultRuleSource(d time.Duration) string {
+	return fmt.Sprintf("has(Member) && !any(White) && age < %ds", int64(d.Seconds()))
+}
+
+// 判定式の経過時間の上限(新入生とみなす期間)
+// 判定式に上限がない場合はfalseを返す
+func (r *Rule) AgeLimit() (time.Duration, bool) {
+	return internal.AgeLimit(r.expr)
+}
+
+// 判定式の文字列表現
+func (r *Rule) String() string {
+	return r.expr.String()
+}
+
+// 判定対象のメンバーの情報を作成
+func (n *newbieManager) subject(member *discordgo.Member) *internal.Subject {
+	return &internal.Subject{
+		Roles: member.Roles,
+		Age:   time.Since(n.joinedAt(member)),
+		Bot:   member.User != nil && member.User.Bot,
+	}
+}
+
+// 判定結果とその理由を説明する文字列を作成
+func (n *newbieManager) explain(member *discordgo.Member) string {
+	subject := n.subject(member)
+	result, by := n.rule.expr.Eval(subject)
+	clause, _ := by.Eval(subject)
+
+	b := &strings.Builder{}
+	switch n.filter.Skip(member) {
+	case utils.SkippedBot:
+		fmt.Fprintf(b, "<@%s> はボットのため自動処理の対象外です。\n", member.User.ID)
+	case utils.SkippedPending:
+		fmt.Fprintf(b, "<@%s> はメンバー認証を通過していないため、判定を保留しています。\n", member.User.ID)
+	}
+	if result {
+		fmt.Fprintf(b, "<@%s> は新入生の条件を**満たしています**。\n", member.User.ID)
+	} else {
+		fmt.Fprintf(b, "<@%s> は新入生の条件を**満たしていません**。\n", member.User.ID)
+	}
+	fmt.Fprintf(b, "- 決定した節: `%s` (%v)\n", by.String(), clause)
+	fmt.Fprintf(b, "- 判定式: `%s`\n", n.rule.String())
+	fmt.Fprintf(b, "- %s: %s (%d日経過)\n", n.joinLabel(), n.joinedAt(member).Format(time.DateOnly), int(subject.Age/(24*time.Hour)))
+	return b.String()
+}
+
+// メンバー本人向けに、新規会員ロールの判定結果とその理由を平易に説明する
+func (n *newbieManager) ExplainToMember(member *discordgo.Member) string {
+	switch n.filter.Skip(member) {
+	case utils.SkippedBot:
+		return "ボットのため新入生ロールは自動処理の対象外です。"
+	case utils.SkippedPending:
+		return "メンバー認証を通過していないため、新入生ロールの判定を保留しています。認証を通過すると判定します。"
+	}
+	subject := n.subject(member)
+	result, by := n.rule.expr.Eval(subject)
+
+	b := &strings.Builder{}
+	hasNewbieRole := slices.Contains(member.Roles, n.newbieRoleID)
+	switch {
+	case result && hasNewbieRole:
+		fmt.Fprintf(b, "新入生の条件を満たしているため、<@&%s> が付いています。\n", n.newbieRoleID)
+	case result:
+		fmt.Fprintf(b, "新入生の条件を満たしているため、<@&%s> が付与されます。\n", n.newbieRoleID)
+	case hasNewbieRole:
+		fmt.Fprintf(b, "新入生の条件を満たしていないため、<@&%s> は外されます。\n", n.newbieRoleID)
+	default:
+		fmt.Fprintf(b, "新入生の条件を満たしていないため、<@&%s> は付きません。\n", n.newbieRoleID)
+	}
+	if slices.Contains(member.Roles, n.memberRoleID) {
+		fmt.Fprintf(b, "- <@&%s>: あり\n", n.memberRoleID)
+	} else {
+		fmt.Fprintf(b, "- <@&%s>: なし\n", n.memberRoleID)
+	}
+	// 判定式が参照するロールのうち、会員ロールと新規会員ロール以外で持っているもの
+	others := []string{}
+	for _, id := range utils.SlicesIntersect(member.Roles, n.rule.expr.RoleIDs()) {
+		mention := "<@&" + id + ">"
+		if id != n.memberRoleID && id != n.newbieRoleID && !slices.Contains(others, mention) {
+			others = append(others, mention)
+		}
+	}
+	if len(others) > 0 {
+		fmt.Fprintf(b, "- 判定に関わるその他のロール: %s\n", strings.Join(others, "、"))
+	}
+	days := int(subject.Age / (24 * time.Hour))
+	if limit, ok := n.rule.AgeLimit(); ok {
+		fmt.Fprintf(b, "- %sから%d日経過(新入生の期間: %d日)\n", n.joinLabel(), days, int(limit/(24*time.Hour)))
+	} else {
+		fmt.Fprintf(b, "- %sから%d日経過\n", n.joinLabel(), days)
+	}
+	fmt.Fprintf(b, "- 決め手となった条件: `%s`\n", by.String())
+	return b.String()
+}
+
+func (n *newbieManager) explainCommand(s *discordgo.Session, i *discordgo.InteractionCreate, opts command.Options) {
+	member, err := s.GuildMember(n.guildID, opts.ID("user"))
+	if err != nil {
+		command.Respond(s, i, "メンバー情報の取得に失敗しました: "+err.Error())
+		return
+	}
+	command.Respond(s, i, n.explain(member))
+}
@@ -0,0 +1,180 @@
+package preflight
+
+import (
+	"fmt"
+	"log/slog"
+	"slices"
+	"strings"
+
+	"github.com/bwmarrin/discordgo"
+	"github.com/gw31415/pgautorole/internal/command"
+)
+
+// 権限の事前検査
+type PreflightChecker interface {
+	// botのロールと権限を検査する
+	Check(s *discordgo.Session) (*Report, error)
+	// スラッシュコマンドを登録
+	RegisterCommands(r *command.Router)
+}
+
+// botが操作するロール
+type Target struct {
+	RoleID string
+	// 設定項目名などの説明
+	Label string
+}
+
+// 操作できないロール
+type Problem struct {
+	Target
+	// ロール名(ロールが存在しない場合は空)
+	Name   string
+	Reason string
+}
+
+// 検査の結果
+type Report struct {
+	// botの最上位のロール(ロールを持っていない場合はnil)
+	HighestRole *discordgo.Role
+	// ロールの管理権限を持っているかどうか
+	ManageRoles bool
+	// 操作できないロール
+	Problems []Problem
+}
+
+// 全てのロールを操作できるかどうか
+func (r *Report) OK() bool {
+	return r.ManageRoles && len(r.Problems) == 0
+}
+
+func (r *Report) String() string {
+	lines := []string{}
+	if r.HighestRole != nil {
+		lines = append(lines, fmt.Sprintf("botの最上位のロール: %s(位置: %d)", r.HighestRole.Name, r.HighestRole.Position))
+	} else {
+		lines = append(lines, "botはロールを持っていません。")
+	}
+	if !r.ManageRoles {
+		lines = append(lines, "botにロールの管理権限がありません。")
+	}
+	if len(r.Problems) > 0 {
+		lines = append(lines, fmt.Sprintf("操作できないロールが%d件あります。", len(r.Problems)))
+		for _, p := range r.Problems {
+			name := p.RoleID
+			if p.Name != "" {
+				name = fmt.Sprintf("%s(%s)", p.Name, p.RoleID)
+			}
+			lines = append(lines, fmt.Sprintf("- %s %s: %s", p.Label, name, p.Reason))
+		}
+	}
+	if r.OK() {
+		lines = append(lines, "全てのロールを操作できます。")
+	}
+	return strings.Join(lines, "\n")
+}
+
+// ロールの一覧とbotのロールから、対象のロールを操作できるか検査する
+// ロールIDが空の対象は無視する
+func Inspect(guildID string, roles []*discordgo.Role, botRoleIDs []string, targets []Target) *Report {
+	byID := make(map[string]*discordgo.Role)
+	for _, r := range roles {
+		byID[r.ID] = r
+	}
+
+	report := &Report{}
+	var permissions int64
+	if everyone := byID[guildID]; everyone != nil {
+		permissions = everyone.Permissions
+	}
+	for _, id := range botRoleIDs {
+		r := byID[id]
+		if r == nil {
+			continue
+		}
+		permissions |= r.Permissions
+		if report.HighestRole == nil || r.Position > report.HighestRole.Position {
+			report.HighestRole = r
+		}
+	}
+	report.ManageRoles = permissions&(discordgo.PermissionManageRoles|discordgo.PermissionAdministrator) != 0
+
+	seen := make(map[string]bool)
+	for _, t := range targets {
+		if t.RoleID == "" || seen[t.RoleID] {
+			continue
+		}
+		seen[t.RoleID] = true
+		r := byID[t.RoleID]
+		switch {
+		case r == nil:
+			report.Problems = append(report.Problems, Problem{t, "", "ロールが存在しません"})
+		case r.ID == guildID:
+			report.Problems = append(report.Problems, Problem{t, r.Name, "@everyoneは付与・剥奪できません"})
+		case r.Managed:
+			report.Problems = append(report.Problems, Problem{t, r.Name, "連携サービスが管理するロールです"})
+		case report.HighestRole == nil || r.Position >= report.HighestRole.Position:
+			report.Problems = append(report.Problems, Problem{t, r.Name, "botの最上位のロール以上の位置にあります"})
+		}
+	}
+	return report
+}
+
+type preflightChecker struct {
+	// サーバーID
+	guildID string
+	// 検査対象のロールを返す(検査のたびに呼び出す)
+	targets func(s *discordgo.Session) []Target
+}
+
+// 権限の事前検査を生成
+func NewPreflightChecker(guildID string, targets func(s *discordgo.Session) []Target) PreflightChecker {
+	return &preflightChecker{guildID, targets}
+}
+
+func (c *preflightChecker) Check(s *discordgo.Session) (*Report, error) {
+	roles, err := s.GuildRoles(c.guildID)
+	if err != nil {
+		return nil, err
+	}
+	// 接続前でもステートに依存せずbotのユーザーを取得する
+	user, err := s.User("@me")
+	if err != nil {
+		return nil, err
+	}
+	bot, err := s.GuildMember(c.guildID, user.ID)
+	if err != nil {
+		return nil, err
+	}
+	report := Inspect(c.guildID, roles, bot.Roles, c.targets(s))
+	slices.SortStableFunc(report.Problems, func(a, b Problem) int {
+		return strings.Compare(a.Label, b.Label)
+	})
+	slog.Info("Preflight checked", "MANAGE_ROLES", report.ManageRoles, "PROBLEMS", len(report.Problems))
+	for _, p := range report.Problems {
+		slog.Warn("Unmanageable role", "LABEL", p.Label, "ROLE", p.RoleID, "ROLE_NAME", p.Name, "REASON", p.Reason)
+	}
+	return report, nil
+}
+
+// bot自体の管理コマンド
+var botCommand = &discordgo.ApplicationCommand{
+	Name:                     "bot",
+	Description:              "botの管理",
+	DefaultMemberPermissions: command.Permission(discordgo.PermissionManageRoles),
+}
+
+func (c *preflightChecker) RegisterCommands(r *command.Router) {
+	r.Subcommand(botCommand, &discordgo.ApplicationCommandOption{
+		Name:        "preflight",
+		Description: "botがロールを操作できるか検査",
+	}, func(s *discordgo.Session, i *discordgo.InteractionCreate, opts command.Options) {
+		command.Deferred(s, i, func() string {
+			report, err := c.Check(s)
+			if err != nil {
+				return "検査に失敗しました: " + err.Error()
+			}
+			return report.String()
+		})
+	})
+}
@@ -0,0 +1,68 @@
+package preflight_test
+
+import (
+	"testing"
+
+	"github.com/bwmarrin/discordgo"
+	"github.com/gw31415/pgautorole/preflight"
+)
+
+func TestInspect(t *testing.T) {
+	roles := []*discordgo.Role{
+		{ID: "guild", Name: "@everyone", Position: 0},
+		{ID: "bot", Name: "Bot", Position: 5, Permissions: discordgo.PermissionManageRoles},
+		{ID: "member", Name: "一般", Position: 2},
+		{ID: "newbie", Name: "新入生", Position: 6},
+		{ID: "booster", Name: "Booster", Position: 1, Managed: true},
+	}
+
+	t.Run("Problems", func(t *testing.T) {
+		report := preflight.Inspect("guild", roles, []string{"bot"}, []preflight.Target{
+			{RoleID: "member", Label: "MEMBER_ROLE_ID"},
+			{RoleID: "newbie", Label: "NEWBIE_ROLE_ID"},
+			{RoleID: "booster", Label: "NEWBIE_WHITE_ROLE_IDS"},
+			{RoleID: "missing", Label: "NEWBIE_WHITE_ROLE_IDS"},
+			{RoleID: "", Label: "NEWBIE_WHITE_ROLE_IDS"},
+			{RoleID: "member", Label: "course"},
+		})
+		if !report.ManageRoles {
+			t.Fatal("expected manage roles permission")
+		}
+		if report.HighestRole == nil || report.HighestRole.ID != "bot" {
+			t.Fatalf("unexpected highest role: %v", report.HighestRole)
+		}
+		got := []string{}
+		for _, p := range report.Problems {
+			got = append(got, p.RoleID)
+		}
+		want := []string{"newbie", "booster", "missing"}
+		if len(got) != len(want) {
+			t.Fatalf("unexpected problems: %v", got)
+		}
+		for i := range want {
+			if got[i] != want[i] {
+				t.Fatalf("unexpected problems: %v", got)
+			}
+		}
+		if report.OK() {
+			t.Fatal("expected not OK")
+		}
+	})
+	t.Run("NoPermission", func(t *testing.T) {
+		report := preflight.Inspect("guild", roles, []string{"member"}, []preflight.Target{
+			{RoleID: "booster", Label: "x"},
+		})
+		if report.ManageRoles || report.OK() {
+			t.Fatal("expected no manage roles permission")
+		}
+	})
+	t.Run("Administrator", func(t *testing.T) {
+		admin := append(roles, &discordgo.Role{ID: "admin", Position: 10, Permissions: discordgo.PermissionAdministrator})
+		report := preflight.Inspect("guild", admin, []string{"admin"}, []preflight.Target{
+			{RoleID: "newbie", Label: "NEWBIE_ROLE_ID"},
+		})
+		if !report.OK() {
+			t.Fatalf("expected OK: %s", report)
+		}
+	})
+}
@@ -0,0 +1,309 @@
+package snapshot
+
+import (
+	"fmt"
+	"log/slog"
+	"strings"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+	"github.com/gw31415/pgautorole/breaker"
+	"github.com/gw31415/pgautorole/internal/command"
+	"github.com/gw31415/pgautorole/internal/store"
+	"github.com/gw31415/pgautorole/internal/utils"
+)
+
+// 復元した変更に対する他の処理の変更を待ってから、復元後の状態を確認するまでの時間
+const RESTORE_SETTLE_DELAY = 5 * time.Second
+
+// ロールのスナップショットのマネージャ
+type SnapshotManager interface {
+	// 現在のロールの付与状況をスナップショットとして保存
+	TakeSnapshot(s *discordgo.Session) (*Snapshot, error)
+	// スラッシュコマンドを登録
+	RegisterCommands(r *command.Router)
+}
+
+type snapshotManager struct {
+	// サーバーID
+	guildID string
+	// 対象のロールIDを返す(スナップショットを取るたびに呼び出す)
+	roleIDs func(s *discordgo.Session) []string
+	// 保存したスナップショット
+	snapshots *store.Store[Snapshots]
+	// 保存するスナップショットの数(0の場合は無制限)
+	retention int
+	// ロールの変更が停止中かどうか(nilの場合は確認しない)
+	paused func() bool
+}
+
+// ロールのスナップショットのマネージャを生成
+func NewSnapshotManager(guildID string, roleIDs func(s *discordgo.Session) []string, snapshots *store.Store[Snapshots], retention int, paused func() bool) SnapshotManager {
+	return &snapshotManager{guildID, roleIDs, snapshots, retention, paused}
+}
+
+// 現在のロールの付与状況を取得する
+// サーバーにいるメンバーのユーザーIDも返す
+func (m *snapshotManager) current(s *discordgo.Session) (*Snapshot, map[string]bool, error) {
+	members, err := utils.GuildMembers(s, m.guildID)
+	if err != nil {
+		return nil, nil, err
+	}
+	present := make(map[string]bool)
+	for _, member := range members {
+		present[member.User.ID] = true
+	}
+	return New(time.Now(), m.roleIDs(s), members), present, nil
+}
+
+func (m *snapshotManager) TakeSnapshot(s *discordgo.Session) (*Snapshot, error) {
+	snap, _, err := m.current(s)
+	if err != nil {
+		return nil, err
+	}
+	if err := m.save(snap); err != nil {
+		return nil, err
+	}
+	return snap, nil
+}
+
+// スナップショットを保存し、古いものを破棄する
+func (m *snapshotManager) save(snap *Snapshot) error {
+	err := m.snapshots.Update(func(snaps *Snapshots) error {
+		// IDが重複する場合は連番を付ける
+		id := snap.ID
+		for i := 2; snaps.Find(snap.ID) != nil; i++ {
+			snap.ID = fmt.Sprintf("%s-%d", id, i)
+		}
+		*snaps = append(*snaps, snap).Prune(m.retention)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	slog.Info("Role snapshot taken", "SNAPSHOT", snap.ID, "MEMBERS", len(snap.Members), "ASSIGNMENTS", snap.Assignments())
+	return nil
+}
+
+// IDからスナップショットを取得する
+func (m *snapshotManager) find(id string) *Snapshot {
+	var snap *Snapshot
+	m.snapshots.View(func(snaps *Snapshots) {
+		snap = snaps.Find(id)
+	})
+	return snap
+}
+
+// 変更の説明文
+func describeChange(c Change) string {
+	if c.Add {
+		return fmt.Sprintf("- <@%s> +<@&%s>", c.UserID, c.RoleID)
+	}
+	return fmt.Sprintf("- <@%s> -<@&%s>", c.UserID, c.RoleID)
+}
+
+// 2つのスナップショットの差分(toが空の場合は現在の状態との差分)
+func (m *snapshotManager) diff(s *discordgo.Session, fromID, toID string) string {
+	from := m.find(fromID)
+	if from == nil {
+		return fmt.Sprintf("スナップショット %q が見つかりません。", fromID)
+	}
+	to := m.find(toID)
+	if toID == "" {
+		current, _, err := m.current(s)
+		if err != nil {
+			return "メンバーの取得に失敗しました: " + err.Error()
+		}
+		to, toID = current, "現在"
+	} else if to == nil {
+		return fmt.Sprintf("スナップショット %q が見つかりません。", toID)
+	}
+	changes := Diff(from, to)
+	lines := []string{fmt.Sprintf("%s から %s への変更: %d件", from.ID, toID, len(changes))}
+	for _, c := range changes {
+		lines = append(lines, describeChange(c))
+	}
+	return strings.Join(lines, "\n")
+}
+
+// スナップショットの状態に戻すための変更を計画または反映する
+// 反映する前に現在の状態をスナップショットとして保存する
+func (m *snapshotManager) restore(s *discordgo.Session, id string, apply bool) string {
+	target := m.find(id)
+	if target == nil {
+		return fmt.Sprintf("スナップショット %q が見つかりません。", id)
+	}
+	current, present, err := m.current(s)
+	if err != nil {
+		return "メンバーの取得に失敗しました: " + err.Error()
+	}
+	changes, departed := []Change{}, 0
+	for _, c := range Diff(current, target) {
+		if !present[c.UserID] {
+			departed++
+			continue
+		}
+		changes = append(changes, c)
+	}
+
+	lines := []string{}
+	if apply {
+		// 停止中は全ての変更が拒否されるため、復元前のスナップショットも保存せずに中止する
+		if m.paused != nil && m.paused() {
+			slog.Warn("Role snapshot restore aborted", "SNAPSHOT", target.ID, "CHANGES", len(changes))
+			return fmt.Sprintf("ロールの変更が停止中のため、スナップショット %s に戻す変更を反映しませんでした。\n`/bot status` で停止した理由を確認し、`/bot resume` で再開してから再度お試しください。", target.ID)
+		}
+		if len(changes) > 0 {
+			if err := m.save(current); err != nil {
+				return "復元前のスナップショットの保存に失敗しました: " + err.Error()
+			}
+		}
+		failed := 0
+		for _, c := range changes {
+			// 運営者が内容を確認して実行した復元は、途中で停止しないよう変更数の上限を適用しない
+			var err error
+			if c.Add {
+				err = s.GuildMemberRoleAdd(m.guildID, c.UserID, c.RoleID, breaker.OperatorRequest)
+			} else {
+				err = s.GuildMemberRoleRemove(m.guildID, c.UserID, c.RoleID, breaker.OperatorRequest)
+			}
+			if err != nil {
+				slog.Error("Failed to restore role", "USER", c.UserID, "ROLE", c.RoleID, "ADD", c.Add, "err", err)
+				lines = append(lines, "- 失敗: "+strings.TrimPrefix(describeChange(c), "- "))
+				failed++
+				continue
+			}
+			lines = append(lines, describeChange(c))
+		}
+		slog.Info("Role snapshot restored", "SNAPSHOT", target.ID, "CHANGES", len(changes)-failed, "FAILED", failed)
+		header := fmt.Sprintf("スナップショット %s に戻すため、%d件の変更を反映しました(失敗: %d件)。", target.ID, len(changes)-failed, failed)
+		if len(changes) > 0 {
+			header += fmt.Sprintf("\n復元前の状態は %s として保存しました。", current.ID)
+		}
+		lines = append([]string{header}, lines...)
+		if len(changes) > failed {
+			lines = append(lines, m.drift(s, target, changes)...)
+		}
+	} else {
+		lines = append(lines, fmt.Sprintf("スナップショット %s に戻すには%d件の変更が必要です(`mode: apply` で反映します)。", target.ID, len(changes)))
+		for _, c := range changes {
+			lines = append(lines, describeChange(c))
+		}
+	}
+	if departed > 0 {
+		lines = append(lines, fmt.Sprintf("退出したメンバーの%d件の変更は無視しました。", departed))
+	}
+	return strings.Join(lines, "\n")
+}
+
+// 復元した変更が他の処理(コースのロールの整合性の維持など)によって変えられていないか確認する
+// 変更したメンバーについて、復元後の状態とスナップショットの差分を返す
+func (m *snapshotManager) drift(s *discordgo.Session, target *Snapshot, changes []Change) []string {
+	time.Sleep(RESTORE_SETTLE_DELAY)
+	after, _, err := m.current(s)
+	if err != nil {
+		slog.Error("Failed to verify restored roles", "SNAPSHOT", target.ID, "err", err)
+		return []string{"復元後の状態の確認に失敗しました: " + err.Error()}
+	}
+	restored := map[string]bool{}
+	for _, c := range changes {
+		restored[c.UserID] = true
+	}
+	drift := []Change{}
+	for _, c := range Diff(after, target) {
+		if restored[c.UserID] {
+			drift = append(drift, c)
+		}
+	}
+	if len(drift) == 0 {
+		return nil
+	}
+	slog.Warn("Restored roles drifted", "SNAPSHOT", target.ID, "CHANGES", len(drift))
+	lines := []string{fmt.Sprintf("復元後に他の処理によって変更され、スナップショットと異なるロールが%d件あります(スナップショットの状態に戻すための変更):", len(drift))}
+	for _, c := range drift {
+		lines = append(lines, describeChange(c))
+	}
+	return lines
+}
+
+// 保存したスナップショットの一覧
+func (m *snapshotManager) list() string {
+	lines := []string{}
+	m.snapshots.View(func(snaps *Snapshots) {
+		for _, snap := range *snaps {
+			lines = append(lines, fmt.Sprintf("- %s: %d人, %d件", snap.ID, len(snap.Members), snap.Assignments()))
+		}
+	})
+	if len(lines) == 0 {
+		return "保存したスナップショットはありません。"
+	}
+	return strings.Join(append([]string{"保存したスナップショット(古い順)"}, lines...), "\n")
+}
+
+// /snapshot コマンド
+var snapshotCommand = &discordgo.ApplicationCommand{
+	Name:                     "snapshot",
+	Description:              "ロールのスナップショットの管理",
+	DefaultMemberPermissions: command.Permission(discordgo.PermissionManageRoles),
+}
+
+func (m *snapshotManager) RegisterCommands(r *command.Router) {
+	idOption := func(name, description string, required bool) *discordgo.ApplicationCommandOption {
+		return &discordgo.ApplicationCommandOption{
+			Type:        discordgo.ApplicationCommandOptionString,
+			Name:        name,
+			Description: description,
+			Required:    required,
+		}
+	}
+	r.Subcommand(snapshotCommand, &discordgo.ApplicationCommandOption{
+		Name:        "list",
+		Description: "保存したスナップショットを表示",
+	}, func(s *discordgo.Session, i *discordgo.InteractionCreate, opts command.Options) {
+		command.Respond(s, i, m.list())
+	})
+	r.Subcommand(snapshotCommand, &discordgo.ApplicationCommandOption{
+		Name:        "take",
+		Description: "現在のロールの付与状況をスナップショットとして保存",
+	}, func(s *discordgo.Session, i *discordgo.InteractionCreate, opts command.Options) {
+		command.Deferred(s, i, func() string {
+			snap, err := m.TakeSnapshot(s)
+			if err != nil {
+				return "スナップショットの保存に失敗しました: " + err.Error()
+			}
+			return fmt.Sprintf("スナップショット %s を保存しました(%d人, %d件)。", snap.ID, len(snap.Members), snap.Assignments())
+		})
+	})
+	r.Subcommand(snapshotCommand, &discordgo.ApplicationCommandOption{
+		Name:        "diff",
+		Description: "スナップショットの間のロールの変更を表示",
+		Options: []*discordgo.ApplicationCommandOption{
+			idOption("from", "比較元のスナップショットのID", true),
+			idOption("to", "比較先のスナップショットのID(省略時は現在の状態)", false),
+		},
+	}, func(s *discordgo.Session, i *discordgo.InteractionCreate, opts command.Options) {
+		from, to := opts.String("from"), opts.String("to")
+		command.Deferred(s, i, func() string {
+			return m.diff(s, from, to)
+		})
+	})
+	r.Subcommand(snapshotCommand, &discordgo.ApplicationCommandOption{
+		Name:        "restore",
+		Description: "ロールの付与状況をスナップショットの状態に戻す",
+		Options: []*discordgo.ApplicationCommandOption{idOption("id", "スナップショットのID", true), {
+			Type:        discordgo.ApplicationCommandOptionString,
+			Name:        "mode",
+			Description: "変更を確認するか反映するか(省略時は確認)",
+			Choices: []*discordgo.ApplicationCommandOptionChoice{
+				{Name: "確認", Value: "plan"},
+				{Name: "反映", Value: "apply"},
+			},
+		}},
+	}, func(s *discordgo.Session, i *discordgo.InteractionCreate, opts command.Options) {
+		id := opts.String("id")
+		apply := opts.String("mode") == "apply"
+		command.Deferred(s, i, func() string {
+			return m.restore(s, id, apply)
+		})
+	})
+}
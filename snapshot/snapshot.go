@@ -0,0 +1,120 @@
+package snapshot
+
+import (
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+// スナップショットのIDの形式(同じ秒に保存しても重複しないようミリ秒まで含める)
+const ID_FORMAT = "20060102-150405.000"
+
+// ある時点での管理対象のロールの付与状況
+type Snapshot struct {
+	ID string    `json:"id"`
+	At time.Time `json:"at"`
+	// 対象としたロールID
+	RoleIDs []string `json:"role_ids"`
+	// ユーザーIDから持っていた対象のロールIDへのマップ(対象のロールを持たないメンバーは含まない)
+	Members map[string][]string `json:"members"`
+}
+
+// 保存したスナップショット(古い順)
+type Snapshots []*Snapshot
+
+// メンバーのロールから対象のロールの付与状況を記録する
+func New(at time.Time, roleIDs []string, members []*discordgo.Member) *Snapshot {
+	roleIDs = slices.Clone(roleIDs)
+	slices.Sort(roleIDs)
+	roleIDs = slices.Compact(roleIDs)
+	snap := &Snapshot{ID: at.Format(ID_FORMAT), At: at, RoleIDs: roleIDs, Members: map[string][]string{}}
+	for _, m := range members {
+		held := []string{}
+		for _, id := range m.Roles {
+			if _, ok := slices.BinarySearch(roleIDs, id); ok {
+				held = append(held, id)
+			}
+		}
+		if len(held) > 0 {
+			slices.Sort(held)
+			snap.Members[m.User.ID] = slices.Compact(held)
+		}
+	}
+	return snap
+}
+
+// 付与されているロールの総数
+func (s *Snapshot) Assignments() int {
+	n := 0
+	for _, roles := range s.Members {
+		n += len(roles)
+	}
+	return n
+}
+
+// ロールの変更
+type Change struct {
+	UserID string
+	RoleID string
+	// 付与する場合はtrue、剥奪する場合はfalse
+	Add bool
+}
+
+// fromの状態をtoの状態にするための最小限のロールの変更
+// 両方のスナップショットで対象としたロールのみを比較する
+// ユーザーごとに付与、剥奪の順に並べる
+func Diff(from, to *Snapshot) []Change {
+	common := []string{}
+	for _, id := range from.RoleIDs {
+		if slices.Contains(to.RoleIDs, id) {
+			common = append(common, id)
+		}
+	}
+	users := []string{}
+	for u := range from.Members {
+		users = append(users, u)
+	}
+	for u := range to.Members {
+		if _, ok := from.Members[u]; !ok {
+			users = append(users, u)
+		}
+	}
+	slices.Sort(users)
+
+	changes := []Change{}
+	for _, u := range users {
+		before, after := from.Members[u], to.Members[u]
+		for _, id := range common {
+			if !slices.Contains(before, id) && slices.Contains(after, id) {
+				changes = append(changes, Change{u, id, true})
+			}
+		}
+		for _, id := range common {
+			if slices.Contains(before, id) && !slices.Contains(after, id) {
+				changes = append(changes, Change{u, id, false})
+			}
+		}
+	}
+	return changes
+}
+
+// IDからスナップショットを探す
+func (s Snapshots) Find(id string) *Snapshot {
+	idx := slices.IndexFunc(s, func(snap *Snapshot) bool {
+		return strings.EqualFold(snap.ID, id)
+	})
+	if idx < 0 {
+		return nil
+	}
+	return s[idx]
+}
+
+// 新しいものからretention件を残して古いスナップショットを破棄する
+func (s Snapshots) Prune(retention int) Snapshots {
+	if retention <= 0 || len(s) <= retention {
+		return s
+	}
+	return slices.Clone(s[len(s)-retention:])
+}
@@ -0,0 +1,80 @@
+package snapshot_test
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+	"github.com/gw31415/pgautorole/snapshot"
+)
+
+func member(id string, roles ...string) *discordgo.Member {
+	return &discordgo.Member{User: &discordgo.User{ID: id}, Roles: roles}
+}
+
+func TestNew(t *testing.T) {
+	at := time.Date(2026, 10, 1, 3, 0, 0, 0, time.UTC)
+	snap := snapshot.New(at, []string{"course", "newbie", "course"}, []*discordgo.Member{
+		member("a", "other", "newbie", "course"),
+		member("b", "other"),
+	})
+	if snap.ID != "20261001-030000.000" {
+		t.Fatalf("unexpected id: %v", snap.ID)
+	}
+	if !reflect.DeepEqual(snap.RoleIDs, []string{"course", "newbie"}) {
+		t.Fatalf("unexpected role ids: %v", snap.RoleIDs)
+	}
+	want := map[string][]string{"a": {"course", "newbie"}}
+	if !reflect.DeepEqual(snap.Members, want) {
+		t.Fatalf("unexpected members: %v", snap.Members)
+	}
+	if snap.Assignments() != 2 {
+		t.Fatalf("unexpected assignments: %v", snap.Assignments())
+	}
+}
+
+func TestDiff(t *testing.T) {
+	from := &snapshot.Snapshot{
+		RoleIDs: []string{"course", "level", "newbie"},
+		Members: map[string][]string{
+			"a": {"newbie"},
+			"b": {"course", "level"},
+		},
+	}
+	to := &snapshot.Snapshot{
+		// 比較元にしかないロール(newbie)と比較先にしかないロール(deleted)は比較しない
+		RoleIDs: []string{"course", "deleted", "level"},
+		Members: map[string][]string{
+			"a": {"course", "level"},
+			"c": {"course", "deleted"},
+		},
+	}
+	got := snapshot.Diff(from, to)
+	want := []snapshot.Change{
+		{UserID: "a", RoleID: "course", Add: true},
+		{UserID: "a", RoleID: "level", Add: true},
+		{UserID: "b", RoleID: "course", Add: false},
+		{UserID: "b", RoleID: "level", Add: false},
+		{UserID: "c", RoleID: "course", Add: true},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("unexpected changes: %v", got)
+	}
+	if len(snapshot.Diff(to, to)) != 0 {
+		t.Fatal("expected no changes for the same snapshot")
+	}
+}
+
+func TestPrune(t *testing.T) {
+	snaps := snapshot.Snapshots{{ID: "1"}, {ID: "2"}, {ID: "3"}}
+	if got := snaps.Prune(2); len(got) != 2 || got[0].ID != "2" {
+		t.Fatalf("unexpected snapshots: %v", got)
+	}
+	if got := snaps.Prune(0); len(got) != 3 {
+		t.Fatalf("unexpected snapshots: %v", got)
+	}
+	if snaps.Find("3") == nil || snaps.Find("4") != nil {
+		t.Fatal("unexpected find result")
+	}
+}